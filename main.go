@@ -20,13 +20,147 @@ limitations under the License.
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
 	"github.com/intelsdi-x/snap-plugin-publisher-postgresql/postgresql"
-	"github.com/intelsdi-x/snap/control/plugin"
 )
 
 func main() {
-	meta := postgresql.Meta()
-	plugin.Start(meta, postgresql.NewPostgreSQLPublisher(), os.Args[1])
+	if len(os.Args) > 1 && os.Args[1] == "switchover" {
+		os.Exit(switchover(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Exit(backfill(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "--check" || os.Args[1] == "-check") {
+		os.Exit(check(os.Args[2:]))
+	}
+	publisher := postgresql.NewPostgreSQLPublisher()
+	go drainOnSignal(publisher)
+	plugin.StartPublisher(publisher, postgresql.Name, postgresql.Version)
+}
+
+// drainOnSignal lets the publishes in flight finish before the plugin
+// exits on SIGTERM or SIGINT, e.g. when it is restarted for an upgrade
+func drainOnSignal(publisher *postgresql.PostgreSQLPublisher) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	publisher.Drain()
+	os.Exit(0)
+}
+
+// switchover replaces the configured table with its staging table
+func switchover(args []string) int {
+	flags := flag.NewFlagSet("switchover", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the publisher config options")
+	flags.Parse(args)
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "switchover: -config is required")
+		return 2
+	}
+
+	config, err := postgresql.LoadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "switchover: %v\n", err)
+		return 1
+	}
+	if err := postgresql.SwitchStagingTable(config); err != nil {
+		fmt.Fprintf(os.Stderr, "switchover: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// check verifies the connection and permissions of a config before it is
+// used in a task
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the publisher config options")
+	flags.Parse(args)
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "check: -config is required")
+		return 2
+	}
+
+	config, err := postgresql.LoadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 1
+	}
+	if err := postgresql.Check(config); err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 1
+	}
+	fmt.Println("check: all checks passed")
+	return 0
+}
+
+// backfill writes the metrics of an export file with a publisher config
+func backfill(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the publisher config options")
+	file := flags.String("file", "", "JSON or CSV file with the exported metrics")
+	format := flags.String("format", "", "format of the file, 'json' or 'csv'; taken from its extension by default")
+	flags.Parse(args)
+	if *configFile == "" || *file == "" {
+		fmt.Fprintln(os.Stderr, "backfill: -config and -file are required")
+		return 2
+	}
+
+	config, err := postgresql.LoadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 1
+	}
+	written, err := postgresql.Backfill(config, *file, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v after writing %d rows\n", err, written)
+		return 1
+	}
+	fmt.Printf("backfill: wrote %d rows\n", written)
+	return 0
+}
+
+// migrate moves the rows of the configured table from the text schema to
+// its dual write table in the typed schema, and swaps the tables when
+// finalizing
+func migrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the publisher config options")
+	batchSize := flags.Int("batch-size", 10000, "number of rows copied per statement")
+	finalize := flags.Bool("finalize", false, "copy the last rows with the tables locked and swap them")
+	flags.Parse(args)
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "migrate: -config is required")
+		return 2
+	}
+
+	config, err := postgresql.LoadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	progress := func(copied int64) {
+		fmt.Printf("migrate: copied %d rows\n", copied)
+	}
+	copied, err := postgresql.Migrate(config, *batchSize, *finalize, progress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v after copying %d rows\n", err, copied)
+		return 1
+	}
+	if *finalize {
+		fmt.Printf("migrate: copied %d rows and swapped the tables\n", copied)
+	} else {
+		fmt.Printf("migrate: copied %d rows, run with -finalize to swap the tables\n", copied)
+	}
+	return 0
 }
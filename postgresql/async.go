@@ -0,0 +1,245 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"sync"
+	"time"
+)
+
+// queuedBatch is a batch of an async publish with the config it is
+// written with
+type queuedBatch struct {
+	cfg *publisherConfig
+	tableBatch
+}
+
+// asyncQueue holds the batches of async publishes until its workers
+// write them
+type asyncQueue struct {
+	opts    AsyncConfig
+	batches chan queuedBatch
+	workers sync.WaitGroup
+
+	// mutex guards closing batches against concurrent enqueues
+	mutex  sync.RWMutex
+	closed bool
+
+	// bytes is the approximate size of the rows queued or collected by
+	// the workers and not written yet; room is signalled when it shrinks
+	bytesMutex sync.Mutex
+	bytes      int64
+	room       *sync.Cond
+
+	// used is when a publish last enqueued, guarded by the publisher mutex
+	used time.Time
+}
+
+// newAsyncQueue returns an empty queue for opts without workers
+func newAsyncQueue(opts AsyncConfig) *asyncQueue {
+	q := &asyncQueue{opts: opts, batches: make(chan queuedBatch, opts.QueueDepth)}
+	q.room = sync.NewCond(&q.bytesMutex)
+	return q
+}
+
+// enqueue queues the batches of an async publish on the queue of the
+// async options of cfg
+func (s *PostgreSQLPublisher) enqueue(cfg *publisherConfig, batches []tableBatch) {
+	logger := cfg.Log.logger()
+	for _, batch := range batches {
+		for {
+			queued, closed := s.asyncQueue(cfg.Async).put(queuedBatch{cfg: cfg, tableBatch: batch})
+			if closed {
+				// closed as idle meanwhile, a new queue takes it
+				continue
+			}
+			if !queued {
+				logger.Warnf("Async queue is full, dropped %d metrics of %s", len(batch.rows), batch.table)
+				s.stats.drop(len(batch.rows))
+			}
+			break
+		}
+	}
+}
+
+// asyncQueue returns the queue for opts, starting it on first use
+func (s *PostgreSQLPublisher) asyncQueue(opts AsyncConfig) *asyncQueue {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := s.queues[opts]
+	if q == nil {
+		q = newAsyncQueue(opts)
+		for i := 0; i < opts.Workers; i++ {
+			q.workers.Add(1)
+			go s.runWorker(q)
+		}
+		if s.queues == nil {
+			s.queues = make(map[AsyncConfig]*asyncQueue)
+		}
+		s.queues[opts] = q
+	}
+	q.used = timeNow()
+	return q
+}
+
+// closeQueue closes q once its queued batches are written
+func (s *PostgreSQLPublisher) closeQueue(q *asyncQueue) {
+	defer s.inflight.Done()
+	q.close()
+}
+
+// put adds b to the queue, waiting for room unless the queue drops
+// batches when full; the queue is full when it holds queue_depth batches
+// or its rows take queue_max_size. closed is set when the queue no longer
+// takes batches
+func (q *asyncQueue) put(b queuedBatch) (queued, closed bool) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.closed {
+		return false, true
+	}
+	size := rowsSize(b.rows)
+	if !q.reserve(size) {
+		return false, false
+	}
+	if !q.opts.DropWhenFull {
+		q.batches <- b
+		return true, false
+	}
+	select {
+	case q.batches <- b:
+		return true, false
+	default:
+		q.release(size)
+		return false, false
+	}
+}
+
+// reserve accounts size bytes to the queue, waiting until they fit
+// queue_max_size unless the queue drops batches when full; a batch larger
+// than queue_max_size is taken once the queue is empty
+func (q *asyncQueue) reserve(size int64) bool {
+	q.bytesMutex.Lock()
+	defer q.bytesMutex.Unlock()
+	for q.opts.MaxSize > 0 && q.bytes > 0 && q.bytes+size > q.opts.MaxSize {
+		if q.opts.DropWhenFull {
+			return false
+		}
+		q.room.Wait()
+	}
+	q.bytes += size
+	return true
+}
+
+// release gives back the size bytes of written or dropped rows
+func (q *asyncQueue) release(size int64) {
+	q.bytesMutex.Lock()
+	q.bytes -= size
+	q.bytesMutex.Unlock()
+	q.room.Broadcast()
+}
+
+// size returns the approximate bytes of the rows held by the queue
+func (q *asyncQueue) size() int64 {
+	q.bytesMutex.Lock()
+	defer q.bytesMutex.Unlock()
+	return q.bytes
+}
+
+// rowOverhead approximates the bytes a row takes besides its strings
+const rowOverhead = 128
+
+// rowsSize returns the approximate bytes rows take in memory
+func rowsSize(rows []row) int64 {
+	var size int64
+	for _, r := range rows {
+		size += int64(rowOverhead + len(r.timePosted) + len(r.key) + len(r.value) + len(r.tags) + len(r.raw) +
+			len(r.unit) + len(r.description))
+	}
+	return size
+}
+
+// close stops taking batches and waits until the workers wrote all
+// queued ones
+func (q *asyncQueue) close() {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.batches)
+	}
+	q.mutex.Unlock()
+	q.workers.Wait()
+}
+
+// pendingKey identifies the rows a worker collects into one batch
+type pendingKey struct {
+	cfg   *publisherConfig
+	table string
+}
+
+// runWorker collects the queued batches of each table and config, and
+// writes them every flush interval or once they reach batch_size rows
+func (s *PostgreSQLPublisher) runWorker(q *asyncQueue) {
+	defer q.workers.Done()
+	var (
+		keys    []pendingKey
+		pending = make(map[pendingKey][]row)
+	)
+	flush := func(key pendingKey) {
+		// publish_timeout bounds every write of the worker
+		ctx, cancel := publishContext(key.cfg)
+		defer cancel()
+		if err := s.writeBatches(ctx, key.cfg, []tableBatch{{table: key.table, rows: pending[key]}}); err != nil {
+			key.cfg.Log.logger().Errorf("Async write of %d metrics to %s failed: %v", len(pending[key]), key.table, err)
+		}
+		q.release(rowsSize(pending[key]))
+		delete(pending, key)
+	}
+	flushAll := func() {
+		for _, key := range keys {
+			if _, ok := pending[key]; ok {
+				flush(key)
+			}
+		}
+		keys = keys[:0]
+	}
+
+	ticker := time.NewTicker(q.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case b, ok := <-q.batches:
+			if !ok {
+				flushAll()
+				return
+			}
+			key := pendingKey{cfg: b.cfg, table: b.table}
+			if _, ok := pending[key]; !ok {
+				keys = append(keys, key)
+			}
+			pending[key] = append(pending[key], b.rows...)
+			if len(pending[key]) >= b.cfg.Write.BatchSize {
+				flush(key)
+			}
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAsyncQueue(t *testing.T) {
+	Convey("TestAsyncQueue", t, func() {
+		q := newAsyncQueue(AsyncConfig{QueueDepth: 1, DropWhenFull: true})
+
+		queued, closed := q.put(queuedBatch{})
+		So(queued, ShouldBeTrue)
+		So(closed, ShouldBeFalse)
+
+		queued, closed = q.put(queuedBatch{})
+		So(queued, ShouldBeFalse)
+		So(closed, ShouldBeFalse)
+
+		<-q.batches
+		q.close()
+		queued, closed = q.put(queuedBatch{})
+		So(queued, ShouldBeFalse)
+		So(closed, ShouldBeTrue)
+	})
+}
+
+func TestAsyncQueueMaxSize(t *testing.T) {
+	Convey("TestAsyncQueueMaxSize", t, func() {
+		rows := []row{{timePosted: "2017-01-02T03:04:05Z", key: "foo", value: "1", tags: "{}"}}
+		size := rowsSize(rows)
+
+		Convey("Batches over queue_max_size are dropped", func() {
+			q := newAsyncQueue(AsyncConfig{QueueDepth: 10, MaxSize: size + 1, DropWhenFull: true})
+			queued, _ := q.put(queuedBatch{tableBatch: tableBatch{rows: rows}})
+			So(queued, ShouldBeTrue)
+			So(q.size(), ShouldEqual, size)
+			queued, _ = q.put(queuedBatch{tableBatch: tableBatch{rows: rows}})
+			So(queued, ShouldBeFalse)
+			So(q.size(), ShouldEqual, size)
+
+			q.release(size)
+			queued, _ = q.put(queuedBatch{tableBatch: tableBatch{rows: rows}})
+			So(queued, ShouldBeTrue)
+		})
+
+		Convey("Publishes wait until written rows make room", func() {
+			q := newAsyncQueue(AsyncConfig{QueueDepth: 10, MaxSize: size + 1})
+			queued, _ := q.put(queuedBatch{tableBatch: tableBatch{rows: rows}})
+			So(queued, ShouldBeTrue)
+			done := make(chan bool)
+			go func() {
+				queued, _ := q.put(queuedBatch{tableBatch: tableBatch{rows: rows}})
+				done <- queued
+			}()
+			select {
+			case <-done:
+				t.Error("put did not wait for room")
+			case <-time.After(50 * time.Millisecond):
+			}
+			q.release(size)
+			So(<-done, ShouldBeTrue)
+		})
+	})
+}
+
+func TestPublishAsync(t *testing.T) {
+	Convey("TestPublishAsync", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["async"] = true
+		config["workers"] = int64(1)
+		config["flush_interval"] = "1h"
+		metric := func(name string, value int) []plugin.Metric {
+			return []plugin.Metric{
+				{Namespace: plugin.NewNamespace(name), Timestamp: time.Now(), Data: value},
+			}
+		}
+
+		Convey("Drain writes the queued metrics", func() {
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			So(sp.Publish(metric("foo", 1), config), ShouldBeNil)
+			So(sp.Publish(metric("bar", 2), config), ShouldBeNil)
+
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			mock.ExpectClose()
+			sp.Drain()
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Metrics are written once batch_size are queued", func() {
+			config["batch_size"] = int64(2)
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			So(sp.Publish(metric("foo", 1), config), ShouldBeNil)
+			So(sp.Publish(metric("bar", 2), config), ShouldBeNil)
+
+			deadline := time.Now().Add(time.Second)
+			for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			mock.ExpectClose()
+			sp.Drain()
+		})
+
+		Convey("Each async options keep their queue until it is idle", func() {
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			opts := AsyncConfig{Enabled: true, QueueDepth: 1, Workers: 1, FlushInterval: time.Hour}
+			other := opts
+			other.Workers = 2
+			q := sp.asyncQueue(opts)
+			So(sp.asyncQueue(other) != q, ShouldBeTrue)
+			So(sp.asyncQueue(opts) == q, ShouldBeTrue)
+			So(sp.queues, ShouldHaveLength, 2)
+
+			// the idle connection is closed along
+			mock.ExpectClose()
+			defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+			now := time.Now().Add(idleTimeout + time.Second)
+			timeNow = func() time.Time { return now }
+			sp.asyncQueue(other)
+			So(sp.begin(), ShouldBeNil)
+			sp.closeIdle()
+			sp.inflight.Done()
+			So(sp.queues, ShouldHaveLength, 1)
+			So(sp.asyncQueue(opts) != q, ShouldBeTrue)
+
+			sp.Drain()
+			for i := 0; i < 100 && mock.ExpectationsWereMet() != nil; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
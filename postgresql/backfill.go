@@ -0,0 +1,344 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+)
+
+const (
+	// formatJSON reads the metrics as the JSON the Snap file publisher
+	// writes: arrays or single metrics, one after the other
+	formatJSON = "json"
+	// formatCSV reads the metrics as CSV with a header naming the
+	// backfillColumns
+	formatCSV = "csv"
+)
+
+// backfillChunk is the number of metrics of a file published at once
+const backfillChunk = 10000
+
+// backfillColumns are the columns of CSV exports, namespace and data are
+// required
+var backfillColumns = []string{"timestamp", "namespace", "data", "tags", "unit", "version", "description"}
+
+// exportedMetric is a metric as exported by Snap, its namespace is a
+// string like /intel/psutil/load/load1 or an array of elements
+type exportedMetric struct {
+	Namespace   json.RawMessage
+	Data        interface{}
+	Tags        map[string]string
+	Timestamp   time.Time
+	Unit        string
+	Version     int64
+	Description string
+}
+
+// Backfill writes the metrics exported to file, as formatJSON or
+// formatCSV, through the publish pipeline with config, and returns the
+// number of rows written; the format is taken from the file extension
+// when empty
+func Backfill(config plugin.Config, file, format string) (int, error) {
+	if format == "" {
+		format = formatJSON
+		if strings.EqualFold(filepath.Ext(file), ".csv") {
+			format = formatCSV
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// a one-off run writes synchronously and runs no background jobs
+	backfillConfig := make(plugin.Config, len(config))
+	for key, value := range config {
+		backfillConfig[key] = value
+	}
+	backfillConfig["async"] = false
+	for _, key := range []string{"stats_listen", "stats_log_interval", "maintenance_schedule"} {
+		delete(backfillConfig, key)
+	}
+	p := NewPostgreSQLPublisher()
+	defer p.Drain()
+	return backfill(p, backfillConfig, f, format)
+}
+
+// backfill publishes the metrics read from r in chunks of backfillChunk
+func backfill(p *PostgreSQLPublisher, config plugin.Config, r io.Reader, format string) (int, error) {
+	var (
+		chunk   []plugin.Metric
+		written int
+	)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		// filtered metrics are not written and, with error_policy=skip,
+		// neither are the skipped ones, which were logged by the publish
+		before := p.stats.written()
+		err := p.Publish(chunk, config)
+		written += int(p.stats.written() - before)
+		if err != nil && !isMetricErrors(err) {
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	add := func(m plugin.Metric) error {
+		chunk = append(chunk, m)
+		if len(chunk) < backfillChunk {
+			return nil
+		}
+		return flush()
+	}
+	var err error
+	switch format {
+	case formatJSON:
+		err = readJSONMetrics(r, add)
+	case formatCSV:
+		err = readCSVMetrics(r, add)
+	default:
+		return 0, fmt.Errorf("Invalid format '%s' (expected '%s' or '%s')", format, formatJSON, formatCSV)
+	}
+	if err == nil {
+		err = flush()
+	}
+	return written, err
+}
+
+// readJSONMetrics passes the metrics of a JSON export to add in order
+func readJSONMetrics(r io.Reader, add func(plugin.Metric) error) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Invalid JSON value %d: %v", n, err)
+		}
+		var exported []exportedMetric
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 && raw[0] == '[' {
+			if err := decodeNumbers(raw, &exported); err != nil {
+				return fmt.Errorf("Invalid JSON value %d: %v", n, err)
+			}
+		} else {
+			var e exportedMetric
+			if err := decodeNumbers(raw, &e); err != nil {
+				return fmt.Errorf("Invalid JSON value %d: %v", n, err)
+			}
+			exported = append(exported, e)
+		}
+		for _, e := range exported {
+			m, err := e.metric()
+			if err != nil {
+				return fmt.Errorf("Invalid metric in JSON value %d: %v", n, err)
+			}
+			if err := add(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeNumbers decodes data into v keeping numbers as json.Number
+func decodeNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// metric returns the plugin.Metric of e, with integers as int64 and other
+// numbers as float64
+func (e exportedMetric) metric() (plugin.Metric, error) {
+	ns, err := parseExportedNamespace(e.Namespace)
+	if err != nil {
+		return plugin.Metric{}, err
+	}
+	data := e.Data
+	if number, ok := data.(json.Number); ok {
+		if data, err = number.Int64(); err != nil {
+			if data, err = number.Float64(); err != nil {
+				return plugin.Metric{}, err
+			}
+		}
+	}
+	return plugin.Metric{
+		Namespace:   plugin.NewNamespace(ns...),
+		Data:        data,
+		Tags:        e.Tags,
+		Timestamp:   e.Timestamp,
+		Unit:        e.Unit,
+		Version:     e.Version,
+		Description: e.Description,
+	}, nil
+}
+
+// parseExportedNamespace returns the elements of a namespace exported as
+// a string, separated by slashes or else dots, or as an array of strings
+// or of elements with a Value
+func parseExportedNamespace(raw json.RawMessage) ([]string, error) {
+	var ns string
+	if err := json.Unmarshal(raw, &ns); err == nil {
+		return splitNamespace(ns)
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return nil, fmt.Errorf("Invalid namespace %s (expected a string or an array)", raw)
+	}
+	parts := make([]string, len(elements))
+	for i, element := range elements {
+		if err := json.Unmarshal(element, &parts[i]); err == nil {
+			continue
+		}
+		var e struct{ Value string }
+		if err := json.Unmarshal(element, &e); err != nil {
+			return nil, fmt.Errorf("Invalid namespace element %s", element)
+		}
+		parts[i] = e.Value
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("Empty namespace")
+	}
+	return parts, nil
+}
+
+// splitNamespace splits a namespace string like /intel/psutil/load/load1,
+// or intel.psutil.load.load1 when it has no slash
+func splitNamespace(ns string) ([]string, error) {
+	if strings.Contains(ns, "/") {
+		ns = strings.Trim(ns, "/")
+		if ns == "" {
+			return nil, fmt.Errorf("Empty namespace")
+		}
+		return strings.Split(ns, "/"), nil
+	}
+	if ns == "" {
+		return nil, fmt.Errorf("Empty namespace")
+	}
+	return strings.Split(ns, "."), nil
+}
+
+// readCSVMetrics passes the metrics of a CSV export to add in order; the
+// first record names the columns
+func readCSVMetrics(r io.Reader, add func(plugin.Metric) error) error {
+	records := csv.NewReader(r)
+	header, err := records.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range backfillColumns {
+			known = known || name == column
+		}
+		if !known {
+			return fmt.Errorf("Unknown CSV column '%s' (expected %s)", name, strings.Join(backfillColumns, ", "))
+		}
+		index[name] = i
+	}
+	for _, required := range []string{"namespace", "data"} {
+		if _, ok := index[required]; !ok {
+			return fmt.Errorf("CSV header has no %s column", required)
+		}
+	}
+	for line := 2; ; line++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m, err := csvMetric(record, index)
+		if err != nil {
+			return fmt.Errorf("Invalid metric on line %d: %v", line, err)
+		}
+		if err := add(m); err != nil {
+			return err
+		}
+	}
+}
+
+// csvMetric returns the metric of a CSV record, its data is parsed as an
+// integer, a float or a boolean, and kept as a string otherwise
+func csvMetric(record []string, index map[string]int) (plugin.Metric, error) {
+	var m plugin.Metric
+	field := func(name string) string {
+		if i, ok := index[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	ns, err := splitNamespace(field("namespace"))
+	if err != nil {
+		return m, err
+	}
+	m.Namespace = plugin.NewNamespace(ns...)
+	m.Data = parseCSVData(field("data"))
+	if timestamp := field("timestamp"); timestamp != "" {
+		if m.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			return m, fmt.Errorf("Invalid timestamp '%s' (expected RFC3339)", timestamp)
+		}
+	}
+	if tags := field("tags"); tags != "" {
+		if err := json.Unmarshal([]byte(tags), &m.Tags); err != nil {
+			return m, fmt.Errorf("Invalid tags '%s' (expected a JSON object of strings)", tags)
+		}
+	}
+	if version := field("version"); version != "" {
+		if m.Version, err = strconv.ParseInt(version, 10, 64); err != nil {
+			return m, fmt.Errorf("Invalid version '%s'", version)
+		}
+	}
+	m.Unit = field("unit")
+	m.Description = field("description")
+	return m, nil
+}
+
+// parseCSVData returns the typed value of a CSV data field
+func parseCSVData(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	return value
+}
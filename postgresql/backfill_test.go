@@ -0,0 +1,156 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadJSONMetrics(t *testing.T) {
+	Convey("TestReadJSONMetrics", t, func() {
+		var metrics []plugin.Metric
+		add := func(m plugin.Metric) error {
+			metrics = append(metrics, m)
+			return nil
+		}
+
+		Convey("Arrays and single metrics are read in order", func() {
+			export := `[{"namespace": "/intel/psutil/load/load1", "data": 2, "timestamp": "2017-01-01T10:11:12Z", "tags": {"host": "a"}},
+				{"namespace": [{"Value": "intel"}, {"Value": "mem"}], "data": 0.5, "unit": "B", "version": 3}]
+				{"Namespace": ["cpu", "idle"], "Data": "high"}`
+			So(readJSONMetrics(strings.NewReader(export), add), ShouldBeNil)
+			So(len(metrics), ShouldEqual, 3)
+			So(metrics[0].Namespace.Strings(), ShouldResemble, []string{"intel", "psutil", "load", "load1"})
+			So(metrics[0].Data, ShouldEqual, int64(2))
+			So(metrics[0].Timestamp, ShouldResemble, time.Date(2017, 1, 1, 10, 11, 12, 0, time.UTC))
+			So(metrics[0].Tags, ShouldResemble, map[string]string{"host": "a"})
+			So(metrics[1].Namespace.Strings(), ShouldResemble, []string{"intel", "mem"})
+			So(metrics[1].Data, ShouldEqual, 0.5)
+			So(metrics[1].Unit, ShouldEqual, "B")
+			So(metrics[1].Version, ShouldEqual, 3)
+			So(metrics[2].Namespace.Strings(), ShouldResemble, []string{"cpu", "idle"})
+			So(metrics[2].Data, ShouldEqual, "high")
+		})
+
+		Convey("Invalid values return an error", func() {
+			So(readJSONMetrics(strings.NewReader(`{"namespace": 1, "data": 2}`), add), ShouldNotBeNil)
+			So(readJSONMetrics(strings.NewReader(`{"namespace": "/", "data": 2}`), add), ShouldNotBeNil)
+			So(readJSONMetrics(strings.NewReader(`[{"namespace": "foo"`), add), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestReadCSVMetrics(t *testing.T) {
+	Convey("TestReadCSVMetrics", t, func() {
+		var metrics []plugin.Metric
+		add := func(m plugin.Metric) error {
+			metrics = append(metrics, m)
+			return nil
+		}
+
+		Convey("Columns are read by the header", func() {
+			export := "Namespace,Data,Timestamp,Tags\n" +
+				"/intel/psutil/load/load1,2,2017-01-01T10:11:12Z,\"{\"\"host\"\": \"\"a\"\"}\"\n" +
+				"intel.mem.free,0.5,,\n" +
+				"intel.up,true,,\n"
+			So(readCSVMetrics(strings.NewReader(export), add), ShouldBeNil)
+			So(len(metrics), ShouldEqual, 3)
+			So(metrics[0].Namespace.Strings(), ShouldResemble, []string{"intel", "psutil", "load", "load1"})
+			So(metrics[0].Data, ShouldEqual, int64(2))
+			So(metrics[0].Tags, ShouldResemble, map[string]string{"host": "a"})
+			So(metrics[1].Namespace.Strings(), ShouldResemble, []string{"intel", "mem", "free"})
+			So(metrics[1].Data, ShouldEqual, 0.5)
+			So(metrics[1].Timestamp.IsZero(), ShouldBeTrue)
+			So(metrics[2].Data, ShouldEqual, true)
+		})
+
+		Convey("Missing and unknown columns return an error", func() {
+			So(readCSVMetrics(strings.NewReader("namespace\nfoo\n"), add), ShouldNotBeNil)
+			So(readCSVMetrics(strings.NewReader("namespace,data,host\nfoo,1,a\n"), add), ShouldNotBeNil)
+		})
+
+		Convey("Invalid fields name their line", func() {
+			err := readCSVMetrics(strings.NewReader("namespace,data,timestamp\nfoo,1,yesterday\n"), add)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "line 2")
+		})
+	})
+}
+
+func TestBackfill(t *testing.T) {
+	Convey("TestBackfill", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("Metrics are written through the publish pipeline", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").
+				WithArgs("2017-01-01T10:11:12Z", "foo", "1", "{}", "2017-01-01T10:11:13Z", "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			export := "timestamp,namespace,data\n2017-01-01T10:11:12Z,foo,1\n2017-01-01T10:11:13Z,bar,2\n"
+			written, err := backfill(sp, config, strings.NewReader(export), formatCSV)
+			So(err, ShouldBeNil)
+			So(written, ShouldEqual, 2)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Only the rows inserted are counted", func() {
+			config["error_policy"] = errorPolicySkip
+			config["namespace_exclude"] = "qux"
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "22001"})
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs("2017-01-01T10:11:12Z", "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs("2017-01-01T10:11:13Z", "baz", "too long", "{}").WillReturnError(&pq.Error{Code: "22001"})
+			mock.ExpectExec("^ROLLBACK TO SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			export := "timestamp,namespace,data\n2017-01-01T10:11:12Z,foo,1\n2017-01-01T10:11:13Z,baz,too long\n2017-01-01T10:11:14Z,qux,3\n"
+			written, err := backfill(sp, config, strings.NewReader(export), formatCSV)
+			So(err, ShouldBeNil)
+			So(written, ShouldEqual, 1)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Unknown formats return an error", func() {
+			_, err := backfill(sp, config, strings.NewReader(""), "xml")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,187 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// endpointRetryDelay is how long an endpoint that failed is skipped
+// before it is tried again
+const endpointRetryDelay = 30 * time.Second
+
+// timeNow is replaced in tests
+var timeNow = time.Now
+
+// endpoint is one of the equally writable servers of a balancer
+type endpoint struct {
+	cfg ConnectionConfig
+	db  *sql.DB
+	// downUntil is when a failed endpoint may be tried again
+	downUntil time.Time
+}
+
+// balancer spreads publishes round-robin across the servers listed in
+// hostname, keeping one connection per server and skipping the servers
+// that recently failed
+type balancer struct {
+	endpoints []*endpoint
+	next      int
+	// users counts the publishes still writing through the balancer
+	users sync.WaitGroup
+	// conns counts the publishes still writing through each connection,
+	// so one marked down is closed only after them
+	conns map[*sql.DB]*sync.WaitGroup
+	// used is when a publish last connected through the balancer
+	used time.Time
+}
+
+// newBalancer returns a balancer with one endpoint per host of cfg
+func newBalancer(cfg ConnectionConfig) *balancer {
+	b := &balancer{}
+	for _, target := range endpointConfigs(cfg) {
+		b.endpoints = append(b.endpoints, &endpoint{cfg: target})
+	}
+	return b
+}
+
+// endpointConfigs splits the comma-separated hostname of cfg into one
+// config per host; a host may carry its own port as host:port or
+// [ipv6]:port
+func endpointConfigs(cfg ConnectionConfig) []ConnectionConfig {
+	hosts := splitList(cfg.Hostname, ",")
+	if cfg.SRVService != "" || cfg.URI != "" || len(hosts) == 0 {
+		return []ConnectionConfig{cfg}
+	}
+	var targets []ConnectionConfig
+	for _, host := range hosts {
+		target := cfg
+		target.Hostname = host
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			if port, err := strconv.Atoi(p); err == nil {
+				target.Hostname = h
+				target.Port = port
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// connect returns the connection of the next healthy endpoint in turn,
+// connecting to it if needed; endpoints that are down are only tried
+// when none is healthy
+func (b *balancer) connect(ctx context.Context) (*sql.DB, error) {
+	var err error
+	tried := make([]bool, len(b.endpoints))
+	for _, ignoreDown := range []bool{false, true} {
+		for i := 0; i < len(b.endpoints); i++ {
+			idx := (b.next + i) % len(b.endpoints)
+			ep := b.endpoints[idx]
+			if tried[idx] || (!ignoreDown && timeNow().Before(ep.downUntil)) {
+				continue
+			}
+			tried[idx] = true
+			if ep.db == nil {
+				var db *sql.DB
+				db, err = getPostgreSQLConn(ctx, ep.cfg)
+				if err != nil {
+					if db != nil {
+						db.Close()
+					}
+					ep.downUntil = timeNow().Add(endpointRetryDelay)
+					continue
+				}
+				ep.db = db
+			}
+			ep.downUntil = time.Time{}
+			b.next = (idx + 1) % len(b.endpoints)
+			return ep.db, nil
+		}
+	}
+	return nil, err
+}
+
+// acquire registers a publish writing through db, a connection returned
+// by connect, and returns the func releasing it
+func (b *balancer) acquire(db *sql.DB) func() {
+	if b.conns == nil {
+		b.conns = make(map[*sql.DB]*sync.WaitGroup)
+	}
+	users, ok := b.conns[db]
+	if !ok {
+		users = &sync.WaitGroup{}
+		b.conns[db] = users
+	}
+	users.Add(1)
+	return users.Done
+}
+
+// markDown detaches db from its endpoint, which is skipped for
+// endpointRetryDelay, and closes it once the publishes that acquired it
+// released it; connect no longer returns it, so it gains no new users
+func (b *balancer) markDown(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	detached := false
+	for _, ep := range b.endpoints {
+		if ep.db == db {
+			ep.db = nil
+			ep.downUntil = timeNow().Add(endpointRetryDelay)
+			detached = true
+		}
+	}
+	if !detached {
+		return
+	}
+	users := b.conns[db]
+	delete(b.conns, db)
+	go func() {
+		if users != nil {
+			users.Wait()
+		}
+		db.Close()
+	}()
+}
+
+// retire closes the connections once the publishes still using the
+// balancer are done; no new user may be added after retire is called
+func (b *balancer) retire() {
+	go func() {
+		b.users.Wait()
+		b.close()
+	}()
+}
+
+// close closes the connections of all endpoints
+func (b *balancer) close() {
+	for _, ep := range b.endpoints {
+		if ep.db != nil {
+			ep.db.Close()
+			ep.db = nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEndpointConfigs(t *testing.T) {
+	Convey("TestEndpointConfigs", t, func() {
+		cfg := ConnectionConfig{Hostname: "db1, db2:5433,[fe80::1]:5434,fe80::2", Port: 5432, Username: "postgres"}
+		targets := endpointConfigs(cfg)
+		So(len(targets), ShouldEqual, 4)
+		So(targets[0].Hostname, ShouldEqual, "db1")
+		So(targets[0].Port, ShouldEqual, 5432)
+		So(targets[1].Hostname, ShouldEqual, "db2")
+		So(targets[1].Port, ShouldEqual, 5433)
+		So(targets[2].Hostname, ShouldEqual, "fe80::1")
+		So(targets[2].Port, ShouldEqual, 5434)
+		So(targets[3].Hostname, ShouldEqual, "fe80::2")
+		So(targets[3].Username, ShouldEqual, "postgres")
+
+		cfg.SRVService = "_postgresql._tcp.example.com"
+		So(endpointConfigs(cfg), ShouldResemble, []ConnectionConfig{cfg})
+	})
+}
+
+func TestBalancer(t *testing.T) {
+	Convey("TestBalancer", t, func() {
+		var dbs []*sql.DB
+		b := &balancer{}
+		for i := 0; i < 3; i++ {
+			db, _, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			dbs = append(dbs, db)
+			b.endpoints = append(b.endpoints, &endpoint{db: db})
+		}
+		start := time.Now()
+		timeNow = func() time.Time { return start }
+		defer func() { timeNow = time.Now }()
+
+		Convey("publishes go round-robin", func() {
+			for _, expected := range []*sql.DB{dbs[0], dbs[1], dbs[2], dbs[0]} {
+				db, err := b.connect(context.Background())
+				So(err, ShouldBeNil)
+				So(db, ShouldEqual, expected)
+			}
+		})
+
+		Convey("a server that is down is skipped until the retry delay", func() {
+			b.endpoints[1].cfg = ConnectionConfig{Hostname: "/nonexistent", Port: 5432}
+			b.markDown(dbs[1])
+			So(b.endpoints[1].db, ShouldBeNil)
+
+			for _, expected := range []*sql.DB{dbs[0], dbs[2], dbs[0]} {
+				db, err := b.connect(context.Background())
+				So(err, ShouldBeNil)
+				So(db, ShouldEqual, expected)
+			}
+
+			timeNow = func() time.Time { return start.Add(endpointRetryDelay) }
+			db, err := b.connect(context.Background())
+			So(err, ShouldBeNil)
+			So(db, ShouldEqual, dbs[2])
+			So(b.endpoints[1].downUntil, ShouldResemble, start.Add(2*endpointRetryDelay))
+		})
+
+		Convey("servers that are down are tried when none is healthy", func() {
+			b.endpoints = b.endpoints[:1]
+			b.markDown(dbs[0])
+			b.endpoints[0].cfg = ConnectionConfig{Hostname: "/nonexistent", Port: 5432}
+			_, err := b.connect(context.Background())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMarkDownInUse(t *testing.T) {
+	Convey("TestMarkDownInUse", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg := ConnectionConfig{Hostname: "localhost", Port: 5432, Username: "postgres", Database: "snap_test"}
+		sp := NewPostgreSQLPublisher()
+		sp.servers = map[ConnectionConfig]*balancer{cfg: {endpoints: []*endpoint{{cfg: cfg, db: db}}}}
+		mock.ExpectExec("^SELECT 1$").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		// a writer holds the connection while another publish fails on it
+		acquired := make(chan struct{})
+		markedDown := make(chan struct{})
+		written := make(chan error)
+		go func() {
+			conn, release, err := sp.connect(context.Background(), cfg)
+			if err != nil {
+				written <- err
+				return
+			}
+			close(acquired)
+			<-markedDown
+			_, err = conn.ExecContext(context.Background(), "SELECT 1")
+			release()
+			written <- err
+		}()
+		<-acquired
+		sp.disconnect(db)
+		close(markedDown)
+
+		So(<-written, ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+		// closed once released
+		closed := false
+		for i := 0; i < 100 && !closed; i++ {
+			closed = db.Ping() != nil
+			time.Sleep(time.Millisecond)
+		}
+		So(closed, ShouldBeTrue)
+	})
+}
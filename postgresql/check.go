@@ -0,0 +1,174 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+)
+
+// minServerVersion is the server_version_num of PostgreSQL 9.6, the first
+// release with ALTER TABLE ... ADD COLUMN IF NOT EXISTS
+const minServerVersion = 90600
+
+// checkErrors are the checks of a health check that failed
+type checkErrors []string
+
+func (e checkErrors) Error() string {
+	return fmt.Sprintf("Health check failed: %s", strings.Join(e, "; "))
+}
+
+// Check verifies that the server of config is reachable, that its
+// database exists and that the role can write the table, returning an
+// error describing each failed check
+func Check(config plugin.Config) error {
+	cfg, err := newPublisherConfig(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := publishContext(cfg)
+	defer cancel()
+	db, err := getPostgreSQLConn(ctx, cfg.Connection)
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		return checkErrors{explainConnectError(cfg.Connection, err)}
+	}
+	return healthCheck(ctx, db, cfg.Schema)
+}
+
+// explainConnectError returns what to fix for a connection to the server
+// of cfg failing with err
+func explainConnectError(cfg ConnectionConfig, err error) string {
+	server := fmt.Sprintf("%s:%d", cfg.Hostname, cfg.Port)
+	database := cfg.Database
+	switch {
+	case cfg.URI != "":
+		server, database = "the server of connection_uri", "of connection_uri"
+	case cfg.SRVService != "":
+		server = "the servers of srv_service " + cfg.SRVService
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "28P01", "28000":
+			return fmt.Sprintf("authentication as %s failed (%v), check username and password or the pg_hba.conf of the server", cfg.Username, err)
+		case "3D000":
+			return fmt.Sprintf("database %s does not exist (%v), create it or fix the database option", database, err)
+		case "42501":
+			return fmt.Sprintf("role %s may not connect (%v), grant it CONNECT on the database", cfg.Username, err)
+		}
+	}
+	if isConnectionError(err) {
+		return fmt.Sprintf("%s is not reachable (%v), check hostname and port and that the server accepts TCP connections", server, err)
+	}
+	return fmt.Sprintf("connecting to %s failed: %v", server, err)
+}
+
+// healthCheck verifies that the server of db is PostgreSQL 9.6 or newer and
+// that its role can INSERT into the table of schema, or can create it and
+// its schema when they do not exist; the
+// errors of the queries themselves are returned as they are, so lost
+// connections are retried
+func healthCheck(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	var user string
+	if err := db.QueryRowContext(ctx, "SELECT current_user").Scan(&user); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return err
+	}
+	if version < minServerVersion {
+		return checkErrors{fmt.Sprintf("server version %d is not supported, upgrade to PostgreSQL 9.6 or newer", version)}
+	}
+	table := schema.quotedTable()
+	exists, err := tableExists(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	var failed checkErrors
+	if exists {
+		var insert bool
+		if err := db.QueryRowContext(ctx, "SELECT has_table_privilege($1, 'INSERT')", table).Scan(&insert); err != nil {
+			return err
+		}
+		if !insert {
+			failed = append(failed, fmt.Sprintf("role %s cannot INSERT into %s, run GRANT INSERT ON %s TO %s", user, table, table, pq.QuoteIdentifier(user)))
+		}
+	} else {
+		msg, err := checkCreate(ctx, db, schema, user)
+		if err != nil {
+			return err
+		}
+		if msg != "" {
+			failed = append(failed, msg)
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// checkCreate returns what keeps user from creating the table of schema,
+// or nothing when it can
+func checkCreate(ctx context.Context, db *sql.DB, schema SchemaConfig, user string) (string, error) {
+	var (
+		name   sql.NullString
+		exists bool
+		create bool
+	)
+	if schema.SchemaName == "" {
+		if err := db.QueryRowContext(ctx, "SELECT current_schema()").Scan(&name); err != nil {
+			return "", err
+		}
+		if !name.Valid {
+			return fmt.Sprintf("no schema of the search_path of role %s exists to create %s in, set schema_name", user, schema.TableName), nil
+		}
+	} else {
+		name.String = schema.SchemaName
+		if err := db.QueryRowContext(ctx, "SELECT to_regnamespace($1) IS NOT NULL", pq.QuoteIdentifier(name.String)).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			if err := db.QueryRowContext(ctx, "SELECT has_database_privilege(current_database(), 'CREATE')").Scan(&create); err != nil {
+				return "", err
+			}
+			if !create {
+				return fmt.Sprintf("role %s cannot create schema %s, create it or run GRANT CREATE ON DATABASE to the role", user, name.String), nil
+			}
+			return "", nil
+		}
+	}
+	if err := db.QueryRowContext(ctx, "SELECT has_schema_privilege($1, 'CREATE')", name.String).Scan(&create); err != nil {
+		return "", err
+	}
+	if !create {
+		return fmt.Sprintf("role %s cannot create %s in schema %s, create the table or run GRANT CREATE ON SCHEMA %s TO %s",
+			user, schema.TableName, name.String, pq.QuoteIdentifier(name.String), pq.QuoteIdentifier(user)), nil
+	}
+	return "", nil
+}
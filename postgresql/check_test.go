@@ -0,0 +1,95 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthCheck(t *testing.T) {
+	Convey("TestHealthCheck", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		mock.ExpectQuery("^SELECT current_user$").WillReturnRows(sqlmock.NewRows([]string{"current_user"}).AddRow("snap"))
+
+		Convey("The server must be PostgreSQL 9.6 or newer", func() {
+			mock.ExpectQuery("^SHOW server_version_num$").WillReturnRows(sqlmock.NewRows([]string{"server_version_num"}).AddRow("90424"))
+			err := healthCheck(context.Background(), db, schema)
+			So(err, ShouldHaveSameTypeAs, checkErrors{})
+			So(err.Error(), ShouldContainSubstring, "server version 90424 is not supported")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		mock.ExpectQuery("^SHOW server_version_num$").WillReturnRows(sqlmock.NewRows([]string{"server_version_num"}).AddRow("90600"))
+
+		Convey("An existing table must take inserts", func() {
+			mock.ExpectQuery("^SELECT to_regclass").WithArgs(`"info"`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			mock.ExpectQuery("^SELECT has_table_privilege").WithArgs(`"info"`).WillReturnRows(sqlmock.NewRows([]string{"insert"}).AddRow(false))
+			err := healthCheck(context.Background(), db, schema)
+			So(err, ShouldHaveSameTypeAs, checkErrors{})
+			So(err.Error(), ShouldContainSubstring, `GRANT INSERT ON "info" TO "snap"`)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("A missing table must be creatable in the current schema", func() {
+			mock.ExpectQuery("^SELECT to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			mock.ExpectQuery("^SELECT current_schema\\(\\)$").WillReturnRows(sqlmock.NewRows([]string{"current_schema"}).AddRow("public"))
+			mock.ExpectQuery("^SELECT has_schema_privilege").WithArgs("public").WillReturnRows(sqlmock.NewRows([]string{"create"}).AddRow(true))
+			So(healthCheck(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("A missing schema must be creatable in the database", func() {
+			schema.SchemaName = "snap"
+			mock.ExpectQuery("^SELECT to_regclass").WithArgs(`"snap"."info"`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			mock.ExpectQuery("^SELECT to_regnamespace").WithArgs(`"snap"`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			mock.ExpectQuery("^SELECT has_database_privilege").WillReturnRows(sqlmock.NewRows([]string{"create"}).AddRow(false))
+			err := healthCheck(context.Background(), db, schema)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "cannot create schema snap")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Query errors are returned as they are", func() {
+			lost := errors.New("connection reset")
+			mock.ExpectQuery("^SELECT to_regclass").WillReturnError(lost)
+			So(healthCheck(context.Background(), db, schema), ShouldEqual, lost)
+		})
+	})
+}
+
+func TestExplainConnectError(t *testing.T) {
+	Convey("TestExplainConnectError", t, func() {
+		cfg := ConnectionConfig{Hostname: "db", Port: 5432, Username: "snap", Database: "metrics"}
+		So(explainConnectError(cfg, &pq.Error{Code: "28P01"}), ShouldContainSubstring, "check username and password")
+		So(explainConnectError(cfg, &pq.Error{Code: "3D000"}), ShouldContainSubstring, "database metrics does not exist")
+		So(explainConnectError(cfg, &pq.Error{Code: "08006"}), ShouldContainSubstring, "db:5432 is not reachable")
+	})
+}
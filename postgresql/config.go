@@ -0,0 +1,1305 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHostname = "localhost"
+	defaultPort     = 5432
+	defaultOrdering = orderingRelaxed
+	// defaultBatchSize is the number of rows inserted per statement
+	defaultBatchSize = 1000
+	// defaultSSLMode keeps connections unencrypted, as before SSL was
+	// configurable
+	defaultSSLMode = "disable"
+	// defaultRetryCount keeps the single retry after a lost connection
+	defaultRetryCount        = 1
+	defaultRetryInitialDelay = "100ms"
+	defaultRetryMaxDelay     = "5s"
+	// defaultSpoolMaxSize is the size of the spool directory in megabytes
+	defaultSpoolMaxSize = 100
+	// defaults of the async queue
+	defaultQueueDepth    = 100
+	defaultWorkers       = 2
+	defaultFlushInterval = "1s"
+	// defaultMaxIdleConns matches the default of database/sql
+	defaultMaxIdleConns = 2
+	// defaultTimeFormat keeps the sub-second part of timestamps
+	defaultTimeFormat = "RFC3339Nano"
+	// defaultVerifyDelay is the time batches get to reach the replica
+	defaultVerifyDelay = "1m"
+)
+
+const (
+	// schemaText stores every value as text in value_column
+	schemaText = "text"
+	// schemaTyped stores values in a column of their type
+	schemaTyped = "typed"
+	// schemaWide stores the metrics of one collection time and tags in
+	// one row, with a column per namespace
+	schemaWide = "wide"
+)
+
+const (
+	// serializerStrict rejects the metrics interfaceToString cannot format
+	serializerStrict = "strict"
+	// serializerJSON stores those metrics JSON encoded
+	serializerJSON = "json"
+)
+
+const (
+	// dedupeIgnore keeps the row stored first for a key and time
+	dedupeIgnore = "ignore"
+	// dedupeLatest overwrites the stored row with the latest one
+	dedupeLatest = "latest"
+	// dedupeSum, dedupeMin and dedupeMax aggregate the numeric values of
+	// the stored row and the latest one, and keep the latest of the others
+	dedupeSum = "sum"
+	dedupeMin = "min"
+	dedupeMax = "max"
+)
+
+const (
+	// queueFullBlock makes async publishes wait for room in the queue
+	queueFullBlock = "block"
+	// queueFullDrop drops the metrics of async publishes the queue has no
+	// room for
+	queueFullDrop = "drop"
+)
+
+const (
+	// spoolReplayBefore replays the segments of an earlier run before the
+	// first publish proceeds
+	spoolReplayBefore = "before"
+	// spoolReplayBackground replays them while publishes proceed
+	spoolReplayBackground = "background"
+)
+
+const (
+	// orderingStrict serializes publishes through a single writer
+	orderingStrict = "strict"
+	// orderingRelaxed lets concurrent publishes write in parallel
+	orderingRelaxed = "relaxed"
+)
+
+const (
+	// errorPolicyAbort fails a publish on the first metric that cannot be
+	// written
+	errorPolicyAbort = "abort"
+	// errorPolicySkip writes the other metrics and fails the publish with
+	// the errors of the skipped ones
+	errorPolicySkip = "skip"
+)
+
+const (
+	// bulkModeInsert writes rows with multi-row INSERT statements
+	bulkModeInsert = "insert"
+	// bulkModeCopy streams the rows of a batch with COPY FROM STDIN
+	bulkModeCopy = "copy"
+)
+
+const (
+	// dialectPostgreSQL writes to PostgreSQL
+	dialectPostgreSQL = "postgresql"
+	// dialectCockroachDB adjusts the tables and retries to CockroachDB
+	dialectCockroachDB = "cockroachdb"
+	// dialectAurora reconnects after Amazon Aurora PostgreSQL failovers
+	dialectAurora = "aurora"
+)
+
+// ConnectionConfig holds the options used to reach the PostgreSQL server
+type ConnectionConfig struct {
+	Hostname string
+	Port     int
+	Username string
+	Password string
+	Database string
+	// URI is a postgres:// connection URI, which replaces Hostname, Port,
+	// Username, Password and Database when set
+	URI string
+	// SRVService is the DNS SRV record the server is resolved from,
+	// Hostname and Port are used when empty
+	SRVService string
+	// SSLMode is the lib/pq sslmode, SSLCert and SSLKey the client
+	// certificate and SSLRootCert the CA certificate the server is
+	// verified with
+	SSLMode     string
+	SSLCert     string
+	SSLKey      string
+	SSLRootCert string
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime size the connection
+	// pool of each server, zero meaning no limit as in database/sql
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// StatementTimeout is set as the statement_timeout of the sessions,
+	// so the server cancels slower statements; no timeout when zero
+	StatementTimeout time.Duration
+}
+
+// SchemaConfig holds the options describing where metrics are stored
+type SchemaConfig struct {
+	TableName string
+	// SchemaName is the schema the table is created in, tables are looked
+	// up in the search path when empty
+	SchemaName string
+	// Layout is schemaText, schemaTyped or schemaWide
+	Layout string
+	// ValueSerializer is the name of the valueSerializers entry formatting
+	// the values; with serializerJSON the typed schema gets a value_json
+	// column for the values it encodes
+	ValueSerializer string
+	// TimeBucket is the date_trunc field used to fill the time_bucket
+	// column, the column is not created when empty
+	TimeBucket string
+	// GeneratedColumns are extra column definitions, such as
+	// "key_prefix text GENERATED ALWAYS AS (split_part(key_column, '.', 1)) STORED"
+	GeneratedColumns []string
+	// HashPartitions is the number of hash partitions on key_column,
+	// the table is not partitioned when zero
+	HashPartitions int
+	// WidenColumns changes key_column and value_column to TEXT the first
+	// time a metric does not fit into them
+	WidenColumns bool
+	// TimescaleDB turns the table into a hypertable on time_posted when
+	// it is created, with chunks of ChunkTimeInterval and compression of
+	// the chunks older than CompressAfter when they are set
+	TimescaleDB       bool
+	ChunkTimeInterval string
+	CompressAfter     string
+	// TimePartitioning is partitionDay or partitionMonth to create the
+	// table partitioned by range of time_posted, with one partition per
+	// period; the table is not partitioned by time when empty
+	TimePartitioning string
+	// Dedupe is dedupeIgnore, dedupeLatest, dedupeSum, dedupeMin or
+	// dedupeMax to keep a single row per key_column and time_posted, rows
+	// are not deduplicated when empty
+	Dedupe string
+	// InsertedAt adds an inserted_at column filled by the server with
+	// the time each row is written
+	InsertedAt bool
+	// ArchiveRaw stores the encoded metric of every row in the
+	// raw_payload column, so it can be replayed or parsed again
+	ArchiveRaw bool
+	// Metadata stores the unit, version and description of every metric
+	// in the metadataColumns
+	Metadata bool
+	// Dialect is the database the tables are created in and written to,
+	// one of dialectPostgreSQL, dialectCockroachDB or dialectAurora
+	Dialect string
+	// DeadLetterTable takes the chunks of rows rejected with a data error,
+	// which then no longer fail their batch; disabled when empty
+	DeadLetterTable string
+	// BatchID stores the id of the batch every row was written with in
+	// the batch_id column
+	BatchID bool
+}
+
+// qualify returns name quoted and qualified with the schema name, if any
+func (s SchemaConfig) qualify(name string) string {
+	if s.SchemaName == "" {
+		return pq.QuoteIdentifier(name)
+	}
+	return pq.QuoteIdentifier(s.SchemaName) + "." + pq.QuoteIdentifier(name)
+}
+
+// jsonValues reports whether the table has a value_json column
+func (s SchemaConfig) jsonValues() bool {
+	return s.Layout == schemaTyped && s.ValueSerializer == serializerJSON
+}
+
+// quotedTable returns the qualified and quoted name of the table
+func (s SchemaConfig) quotedTable() string {
+	return s.qualify(s.TableName)
+}
+
+// relation returns the unquoted, qualified name of the table, as
+// PostgreSQL reports it in messages
+func (s SchemaConfig) relation() string {
+	if s.SchemaName == "" {
+		return s.TableName
+	}
+	return s.SchemaName + "." + s.TableName
+}
+
+// stagingTable returns the name of the staging table of table
+func stagingTable(table string) string {
+	return table + "_staging"
+}
+
+// WriteConfig holds the options controlling how batches are written
+type WriteConfig struct {
+	Ordering string
+	// PublishTimeout bounds the time a publish takes to connect and write
+	// its metrics, retries included; no timeout when zero
+	PublishTimeout time.Duration
+	// ErrorPolicy is errorPolicyAbort or errorPolicySkip
+	ErrorPolicy string
+	// DualWriteTable is a second table every metric is also written to,
+	// dual writing is disabled when empty
+	DualWriteTable string
+	// BatchSize is the maximum number of rows inserted per statement,
+	// the statements of a publish share one transaction
+	BatchSize int
+	// BulkMode is bulkModeInsert or bulkModeCopy
+	BulkMode string
+	// Pipeline writes every BatchSize rows of a table in a transaction of
+	// their own while the rest of the publish is converted
+	Pipeline bool
+	// UseMetricTimestamp fills time_posted with the collection time of
+	// each metric instead of the time of the publish
+	UseMetricTimestamp bool
+	// TimeFormat is the layout timestamps are sent to the server in
+	TimeFormat string
+	// SortByTimestamp inserts the metrics of a batch in the order they
+	// were collected
+	SortByTimestamp bool
+	// TableRouting sends metrics to other tables than TableName by their
+	// namespace
+	TableRouting []tableRoute
+}
+
+// NamespaceConfig holds the rules applied to the namespace of every metric
+// before it is written
+type NamespaceConfig struct {
+	// Include keeps only the metrics whose key matches one of the
+	// patterns, all metrics when empty
+	Include []*regexp.Regexp
+	// Exclude drops the metrics whose key matches one of the patterns
+	Exclude []*regexp.Regexp
+	// PrefixStrip removes the first of the prefixes a namespace starts
+	// with from it
+	PrefixStrip [][]string
+	// Rename rewrites the key with the first rule whose pattern matches
+	Rename []namespaceRename
+}
+
+// RetryConfig holds the options of retrying publishes that failed on a
+// transient error
+type RetryConfig struct {
+	// Count is the number of retries, failures are not retried when zero
+	Count int
+	// InitialDelay is the delay before the first retry, doubled for every
+	// further retry up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// SpoolConfig holds the options of keeping batches on disk while the
+// database is unreachable
+type SpoolConfig struct {
+	// Dir is the spool directory, spooling is disabled when empty
+	Dir string
+	// MaxSize is the size in bytes the spooled batches may take
+	MaxSize int64
+	// Compress gzips the batches written to the spool
+	Compress bool
+	// SegmentSize is the size in bytes a segment is sealed at, every
+	// batch gets a segment of its own when zero
+	SegmentSize int64
+	// Replay is spoolReplayBefore or spoolReplayBackground
+	Replay string
+}
+
+// AsyncConfig holds the options of writing metrics in the background
+type AsyncConfig struct {
+	// Enabled queues the metrics of publishes instead of writing them
+	Enabled bool
+	// QueueDepth is the number of batches the queue holds
+	QueueDepth int
+	// Workers is the number of goroutines writing the queued batches
+	Workers int
+	// FlushInterval is the longest time queued metrics wait for more
+	// metrics of their table
+	FlushInterval time.Duration
+	// MaxSize is the approximate size in bytes the rows of the queue may
+	// take, not limited when zero
+	MaxSize int64
+	// DropWhenFull drops batches the queue or the spool has no room for
+	// instead of blocking or failing the publish
+	DropWhenFull bool
+}
+
+// StatsConfig holds the options of reporting the publisher's own metrics
+type StatsConfig struct {
+	// Listen is the address the metrics are served on, they are not
+	// served when empty
+	Listen string
+	// LogInterval is the interval the metrics are logged at, they are
+	// not logged when zero
+	LogInterval time.Duration
+}
+
+// VerifyConfig holds the options of checking that the written batches
+// reached a replica
+type VerifyConfig struct {
+	// ReplicaURI is the postgres:// connection URI of the replica the
+	// batches are counted on, they are not verified when empty
+	ReplicaURI string
+	// Delay is the time a batch is given to replicate before it is counted
+	Delay time.Duration
+}
+
+// LogConfig holds the options of the publisher's logs
+type LogConfig struct {
+	// Level is the level of the messages logged, payloads and configs are
+	// only logged at log.DebugLevel
+	Level log.Level
+	// Task is the name of the task in the fields of the log messages
+	Task string
+}
+
+// MaintenanceConfig holds the options of the jobs run in the background
+type MaintenanceConfig struct {
+	// Schedule is the cron spec the jobs run at, maintenance is disabled
+	// when empty
+	Schedule string
+	// RetentionDays deletes rows older than this many days, nothing is
+	// deleted when zero
+	RetentionDays int
+	// Analyze runs ANALYZE on the table
+	Analyze bool
+}
+
+// publisherConfig groups all config sections used by a single publish
+type publisherConfig struct {
+	Connection  ConnectionConfig
+	Schema      SchemaConfig
+	Write       WriteConfig
+	Namespace   NamespaceConfig
+	Retry       RetryConfig
+	Spool       SpoolConfig
+	Async       AsyncConfig
+	Stats       StatsConfig
+	Verify      VerifyConfig
+	Log         LogConfig
+	Maintenance MaintenanceConfig
+}
+
+// newPublisherConfig extracts the typed config sections from the task config,
+// filling in defaults for optional keys
+func newPublisherConfig(config plugin.Config) (*publisherConfig, error) {
+	var (
+		cfg publisherConfig
+		err error
+	)
+
+	// options missing from the task config fall back to the environment
+	// variables libpq reads, then to the defaults
+	if cfg.Connection.Hostname, err = getStringEnv(config, "hostname", "PGHOST", defaultHostname); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.Port, err = getIntEnv(config, "port", "PGPORT", defaultPort); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.SRVService, err = getString(config, "srv_service", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.URI, err = getString(config, "connection_uri", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.URI != "" {
+		if err := validateConnectionURI(cfg.Connection.URI); err != nil {
+			return nil, err
+		}
+		if cfg.Connection.SRVService != "" {
+			return nil, fmt.Errorf("connection_uri cannot be combined with srv_service")
+		}
+	} else {
+		if cfg.Connection.Username, err = getRequiredStringEnv(config, "username", "PGUSER"); err != nil {
+			return nil, err
+		}
+		if cfg.Connection.Password, err = getPassword(config); err != nil {
+			return nil, err
+		}
+		if cfg.Connection.Database, err = getRequiredStringEnv(config, "database", "PGDATABASE"); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseSSLConfig(config, &cfg.Connection); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.MaxOpenConns, err = getInt(config, "max_open_conns", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Connection.MaxIdleConns, err = getInt(config, "max_idle_conns", defaultMaxIdleConns); err != nil {
+		return nil, err
+	}
+	connMaxLifetime, err := getString(config, "conn_max_lifetime", "")
+	if err != nil {
+		return nil, err
+	}
+	if connMaxLifetime != "" {
+		if cfg.Connection.ConnMaxLifetime, err = time.ParseDuration(connMaxLifetime); err != nil {
+			return nil, fmt.Errorf("Invalid conn_max_lifetime '%s': %v", connMaxLifetime, err)
+		}
+	}
+	if cfg.Connection.MaxOpenConns < 0 || cfg.Connection.MaxIdleConns < 0 || cfg.Connection.ConnMaxLifetime < 0 {
+		return nil, fmt.Errorf("max_open_conns, max_idle_conns and conn_max_lifetime must not be negative")
+	}
+	if cfg.Connection.StatementTimeout, err = getTimeout(config, "statement_timeout"); err != nil {
+		return nil, err
+	}
+	if cfg.Write.PublishTimeout, err = getTimeout(config, "publish_timeout"); err != nil {
+		return nil, err
+	}
+	tableName, err := getRequiredString(config, "table_name")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Schema.TableName, err = parseIdentifier("table_name", tableName); err != nil {
+		return nil, err
+	}
+	schemaName, err := getString(config, "schema_name", "")
+	if err != nil {
+		return nil, err
+	}
+	if schemaName != "" {
+		if cfg.Schema.SchemaName, err = parseIdentifier("schema_name", schemaName); err != nil {
+			return nil, err
+		}
+	}
+	staging, err := getBool(config, "staging", false)
+	if err != nil {
+		return nil, err
+	}
+	if staging {
+		cfg.Schema.TableName = stagingTable(cfg.Schema.TableName)
+	}
+	if cfg.Schema.TimeBucket, err = getString(config, "time_bucket", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.TimeBucket != "" && !isDateTruncField(cfg.Schema.TimeBucket) {
+		return nil, fmt.Errorf("Invalid time_bucket '%s' (expected one of: %s)", cfg.Schema.TimeBucket, strings.Join(dateTruncFields, ", "))
+	}
+	generated, err := getString(config, "generated_columns", "")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Schema.GeneratedColumns = splitList(generated, ";")
+	if cfg.Schema.HashPartitions, err = getInt(config, "hash_partitions", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.HashPartitions < 0 {
+		return nil, fmt.Errorf("Invalid hash_partitions %d (expected 0 or more)", cfg.Schema.HashPartitions)
+	}
+	if cfg.Schema.Layout, err = getString(config, "schema", schemaText); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.Layout != schemaText && cfg.Schema.Layout != schemaTyped && cfg.Schema.Layout != schemaWide {
+		return nil, fmt.Errorf("Invalid schema '%s' (expected '%s', '%s' or '%s')", cfg.Schema.Layout, schemaText, schemaTyped, schemaWide)
+	}
+	if cfg.Schema.ValueSerializer, err = getString(config, "value_serializer", serializerStrict); err != nil {
+		return nil, err
+	}
+	if _, ok := valueSerializers[cfg.Schema.ValueSerializer]; !ok {
+		return nil, fmt.Errorf("Invalid value_serializer '%s' (expected '%s' or '%s')", cfg.Schema.ValueSerializer, serializerStrict, serializerJSON)
+	}
+	if cfg.Schema.WidenColumns, err = getBool(config, "widen_columns", false); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.ArchiveRaw, err = getBool(config, "archive_raw_payload", false); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.InsertedAt, err = getBool(config, "inserted_at_column", false); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.Metadata, err = getBool(config, "store_metadata", false); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.BatchID, err = getBool(config, "batch_id_column", false); err != nil {
+		return nil, err
+	}
+	if cfg.Verify.ReplicaURI, err = getString(config, "verify_replica_uri", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Verify.ReplicaURI != "" {
+		if err := validateConnectionURI(cfg.Verify.ReplicaURI); err != nil {
+			return nil, err
+		}
+		// the rows of a batch are counted by their batch_id
+		if !cfg.Schema.BatchID {
+			return nil, fmt.Errorf("verify_replica_uri requires batch_id_column")
+		}
+	}
+	verifyDelay, err := getString(config, "verify_delay", defaultVerifyDelay)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Verify.Delay, err = time.ParseDuration(verifyDelay); err != nil || cfg.Verify.Delay <= 0 {
+		return nil, fmt.Errorf("Invalid verify_delay '%s' (expected a positive duration such as 1m)", verifyDelay)
+	}
+	if cfg.Schema.Dedupe, err = getString(config, "dedupe", ""); err != nil {
+		return nil, err
+	}
+	switch cfg.Schema.Dedupe {
+	case "", dedupeIgnore, dedupeLatest:
+	case dedupeSum, dedupeMin, dedupeMax:
+		// only the typed schema stores numbers
+		if cfg.Schema.Layout != schemaTyped {
+			return nil, fmt.Errorf("dedupe '%s' requires schema '%s'", cfg.Schema.Dedupe, schemaTyped)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid dedupe '%s' (expected '%s', '%s', '%s', '%s' or '%s')", cfg.Schema.Dedupe,
+			dedupeIgnore, dedupeLatest, dedupeSum, dedupeMin, dedupeMax)
+	}
+	if cfg.Schema.TimescaleDB, err = getBool(config, "timescaledb", false); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.ChunkTimeInterval, err = getString(config, "chunk_time_interval", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.CompressAfter, err = getString(config, "compress_after", ""); err != nil {
+		return nil, err
+	}
+	if !cfg.Schema.TimescaleDB && (cfg.Schema.ChunkTimeInterval != "" || cfg.Schema.CompressAfter != "") {
+		return nil, fmt.Errorf("chunk_time_interval and compress_after require timescaledb")
+	}
+	if cfg.Schema.TimescaleDB && cfg.Schema.HashPartitions > 0 {
+		return nil, fmt.Errorf("timescaledb and hash_partitions cannot be combined")
+	}
+	if cfg.Schema.TimePartitioning, err = getString(config, "time_partitioning", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Schema.TimePartitioning != "" {
+		if _, ok := partitionFormats[cfg.Schema.TimePartitioning]; !ok {
+			return nil, fmt.Errorf("Invalid time_partitioning '%s' (expected '%s' or '%s')", cfg.Schema.TimePartitioning, partitionDay, partitionMonth)
+		}
+		if cfg.Schema.TimescaleDB || cfg.Schema.HashPartitions > 0 {
+			return nil, fmt.Errorf("time_partitioning cannot be combined with timescaledb or hash_partitions")
+		}
+		if _, err := partitionName(cfg.Schema, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Maintenance.Schedule, err = getString(config, "maintenance_schedule", ""); err != nil {
+		return nil, err
+	}
+	if cfg.Maintenance.Schedule != "" {
+		if _, err := cron.Parse(cfg.Maintenance.Schedule); err != nil {
+			return nil, fmt.Errorf("Invalid maintenance_schedule '%s': %v", cfg.Maintenance.Schedule, err)
+		}
+	}
+	if cfg.Maintenance.RetentionDays, err = getInt(config, "retention_days", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Maintenance.RetentionDays < 0 {
+		return nil, fmt.Errorf("Invalid retention_days %d (expected 0 or more)", cfg.Maintenance.RetentionDays)
+	}
+	if cfg.Maintenance.Analyze, err = getBool(config, "maintenance_analyze", false); err != nil {
+		return nil, err
+	}
+	if cfg.Write.Ordering, err = getString(config, "ordering", defaultOrdering); err != nil {
+		return nil, err
+	}
+	if cfg.Write.Ordering != orderingStrict && cfg.Write.Ordering != orderingRelaxed {
+		return nil, fmt.Errorf("Invalid ordering '%s' (expected '%s' or '%s')", cfg.Write.Ordering, orderingStrict, orderingRelaxed)
+	}
+	if cfg.Write.ErrorPolicy, err = getString(config, "error_policy", errorPolicyAbort); err != nil {
+		return nil, err
+	}
+	if cfg.Write.ErrorPolicy != errorPolicyAbort && cfg.Write.ErrorPolicy != errorPolicySkip {
+		return nil, fmt.Errorf("Invalid error_policy '%s' (expected '%s' or '%s')", cfg.Write.ErrorPolicy, errorPolicyAbort, errorPolicySkip)
+	}
+	routing, err := getString(config, "table_routing", "")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Write.TableRouting, err = parseTableRouting(routing); err != nil {
+		return nil, err
+	}
+	if cfg.Retry, err = parseRetryConfig(config); err != nil {
+		return nil, err
+	}
+	if cfg.Spool.Dir, err = getString(config, "spool_dir", ""); err != nil {
+		return nil, err
+	}
+	spoolMaxSize, err := getInt(config, "spool_max_size", defaultSpoolMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if spoolMaxSize <= 0 {
+		return nil, fmt.Errorf("Invalid spool_max_size %d (expected a positive number of megabytes)", spoolMaxSize)
+	}
+	cfg.Spool.MaxSize = int64(spoolMaxSize) << 20
+	if cfg.Spool.Compress, err = getBool(config, "spool_compress", false); err != nil {
+		return nil, err
+	}
+	segmentSize, err := getInt(config, "spool_segment_size", 0)
+	if err != nil {
+		return nil, err
+	}
+	if segmentSize < 0 || segmentSize > spoolMaxSize {
+		return nil, fmt.Errorf("Invalid spool_segment_size %d (expected a number of megabytes up to spool_max_size, or 0)", segmentSize)
+	}
+	cfg.Spool.SegmentSize = int64(segmentSize) << 20
+	if cfg.Spool.Replay, err = getString(config, "spool_replay", spoolReplayBefore); err != nil {
+		return nil, err
+	}
+	if cfg.Spool.Replay != spoolReplayBefore && cfg.Spool.Replay != spoolReplayBackground {
+		return nil, fmt.Errorf("Invalid spool_replay '%s' (expected '%s' or '%s')", cfg.Spool.Replay, spoolReplayBefore, spoolReplayBackground)
+	}
+	if cfg.Namespace, err = parseNamespaceConfig(config); err != nil {
+		return nil, err
+	}
+	if cfg.Async, err = parseAsyncConfig(config); err != nil {
+		return nil, err
+	}
+	if cfg.Async.Enabled && cfg.Async.Workers > 1 && cfg.Write.Ordering == orderingStrict {
+		return nil, fmt.Errorf("ordering '%s' with async requires a single worker", orderingStrict)
+	}
+	if cfg.Stats.Listen, err = getString(config, "stats_listen", ""); err != nil {
+		return nil, err
+	}
+	logInterval, err := getString(config, "stats_log_interval", "")
+	if err != nil {
+		return nil, err
+	}
+	if logInterval != "" {
+		if cfg.Stats.LogInterval, err = time.ParseDuration(logInterval); err != nil || cfg.Stats.LogInterval <= 0 {
+			return nil, fmt.Errorf("Invalid stats_log_interval '%s' (expected a positive duration such as 1m)", logInterval)
+		}
+	}
+	if cfg.Log, err = parseLogConfig(config, cfg.Schema.TableName); err != nil {
+		return nil, err
+	}
+	if cfg.Write.BatchSize, err = getInt(config, "batch_size", defaultBatchSize); err != nil {
+		return nil, err
+	}
+	if cfg.Write.BatchSize < 1 {
+		return nil, fmt.Errorf("Invalid batch_size %d (expected 1 or more)", cfg.Write.BatchSize)
+	}
+	if cfg.Write.Pipeline, err = getBool(config, "pipeline", false); err != nil {
+		return nil, err
+	}
+	// async publishes are written in the background already, and wide
+	// rows would be split across chunks
+	if cfg.Write.Pipeline && (cfg.Async.Enabled || cfg.Schema.Layout == schemaWide) {
+		return nil, fmt.Errorf("pipeline cannot be combined with async or schema '%s'", schemaWide)
+	}
+	if cfg.Write.BulkMode, err = getString(config, "bulk_mode", bulkModeInsert); err != nil {
+		return nil, err
+	}
+	if cfg.Write.BulkMode != bulkModeInsert && cfg.Write.BulkMode != bulkModeCopy {
+		return nil, fmt.Errorf("Invalid bulk_mode '%s' (expected '%s' or '%s')", cfg.Write.BulkMode, bulkModeInsert, bulkModeCopy)
+	}
+	// COPY has no ON CONFLICT clause and takes no expressions
+	if cfg.Write.BulkMode == bulkModeCopy && (cfg.Schema.Dedupe != "" || cfg.Schema.TimeBucket != "") {
+		return nil, fmt.Errorf("bulk_mode '%s' cannot be combined with dedupe or time_bucket", bulkModeCopy)
+	}
+	// the wide schema has no key_column and one row for many metrics
+	if cfg.Schema.Layout == schemaWide && (cfg.Schema.Dedupe != "" || cfg.Schema.HashPartitions > 0 ||
+		cfg.Schema.WidenColumns || cfg.Schema.ArchiveRaw || cfg.Schema.TimeBucket != "" || cfg.Schema.CompressAfter != "" ||
+		cfg.Schema.Metadata || cfg.Schema.BatchID || cfg.Write.BulkMode == bulkModeCopy || cfg.Write.ErrorPolicy == errorPolicySkip) {
+		return nil, fmt.Errorf("schema '%s' cannot be combined with dedupe, hash_partitions, widen_columns, archive_raw_payload, "+
+			"time_bucket, compress_after, store_metadata, batch_id_column, bulk_mode '%s' or error_policy '%s'", schemaWide, bulkModeCopy, errorPolicySkip)
+	}
+	if cfg.Schema.Dialect, err = getString(config, "dialect", dialectPostgreSQL); err != nil {
+		return nil, err
+	}
+	switch cfg.Schema.Dialect {
+	case dialectPostgreSQL:
+	case dialectCockroachDB:
+		// CockroachDB has no extensions, partitions tables its own way
+		// and cannot change column types in a transaction
+		if cfg.Schema.TimescaleDB || cfg.Schema.HashPartitions > 0 || cfg.Schema.TimePartitioning != "" || cfg.Schema.WidenColumns {
+			return nil, fmt.Errorf("dialect '%s' cannot be combined with timescaledb, hash_partitions, time_partitioning or widen_columns", dialectCockroachDB)
+		}
+	case dialectAurora:
+		// Aurora does not offer the timescaledb extension
+		if cfg.Schema.TimescaleDB {
+			return nil, fmt.Errorf("dialect '%s' cannot be combined with timescaledb", dialectAurora)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid dialect '%s' (expected '%s', '%s' or '%s')", cfg.Schema.Dialect, dialectPostgreSQL, dialectCockroachDB, dialectAurora)
+	}
+	if cfg.Write.UseMetricTimestamp, err = getBool(config, "use_metric_timestamp", true); err != nil {
+		return nil, err
+	}
+	timeFormat, err := getString(config, "time_format", defaultTimeFormat)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Write.TimeFormat = timeFormatLayout(timeFormat); cfg.Write.TimeFormat == "" {
+		names := make([]string, len(timeFormats))
+		for i, f := range timeFormats {
+			names[i] = f.name
+		}
+		return nil, fmt.Errorf("Invalid time_format '%s' (expected one of: %s)", timeFormat, strings.Join(names, ", "))
+	}
+	if cfg.Write.SortByTimestamp, err = getBool(config, "sort_by_timestamp", false); err != nil {
+		return nil, err
+	}
+	dualWriteTable, err := getString(config, "dual_write_table", "")
+	if err != nil {
+		return nil, err
+	}
+	if dualWriteTable != "" {
+		if cfg.Write.DualWriteTable, err = parseIdentifier("dual_write_table", dualWriteTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Write.DualWriteTable == cfg.Schema.TableName {
+		return nil, fmt.Errorf("dual_write_table must differ from table_name '%s'", cfg.Schema.TableName)
+	}
+	deadLetterTable, err := getString(config, "dead_letter_table", "")
+	if err != nil {
+		return nil, err
+	}
+	if deadLetterTable != "" {
+		if cfg.Schema.DeadLetterTable, err = parseIdentifier("dead_letter_table", deadLetterTable); err != nil {
+			return nil, err
+		}
+		if cfg.Schema.DeadLetterTable == cfg.Schema.TableName || cfg.Schema.DeadLetterTable == cfg.Write.DualWriteTable {
+			return nil, fmt.Errorf("dead_letter_table must differ from table_name and dual_write_table")
+		}
+		// wide rows hold many metrics, a chunk of them cannot be set aside
+		if cfg.Schema.Layout == schemaWide {
+			return nil, fmt.Errorf("dead_letter_table cannot be combined with schema '%s'", schemaWide)
+		}
+	}
+	return &cfg, nil
+}
+
+// dualWriteSchema returns the schema of the dual write table, which shares
+// all options with the primary table
+func (c *publisherConfig) dualWriteSchema() SchemaConfig {
+	schema := c.Schema
+	schema.TableName = c.Write.DualWriteTable
+	return schema
+}
+
+// maxIdentifierLength is the length PostgreSQL truncates identifiers to
+const maxIdentifierLength = 63
+
+// safeIdentifier matches names that can be used without quoting
+var safeIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseIdentifier returns the table name configured as value. Plain names
+// must be safe identifiers and are folded to lower case as PostgreSQL does;
+// any other name has to be enclosed in double quotes and is used verbatim.
+func parseIdentifier(key, value string) (string, error) {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		quoted := value[1 : len(value)-1]
+		if strings.Contains(strings.Replace(quoted, `""`, "", -1), `"`) {
+			return "", fmt.Errorf("Config option '%s' has an unescaped double quote in %s (use \"\" inside quoted names)", key, value)
+		}
+		name := strings.Replace(quoted, `""`, `"`, -1)
+		return name, validateIdentifier(key, name)
+	}
+	if !safeIdentifier.MatchString(value) {
+		return "", fmt.Errorf("Config option '%s' must contain only letters, digits and underscores, "+
+			"or be enclosed in double quotes to be used verbatim, got '%s'", key, value)
+	}
+	name := strings.ToLower(value)
+	return name, validateIdentifier(key, name)
+}
+
+// validateIdentifier checks that name can be used as a quoted identifier
+func validateIdentifier(key, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("Config option '%s' must not be empty", key)
+	case len(name) > maxIdentifierLength:
+		return fmt.Errorf("Config option '%s' must be at most %d bytes long, got '%s'", key, maxIdentifierLength, name)
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("Config option '%s' must not contain NUL characters", key)
+	}
+	return nil
+}
+
+// dateTruncFields are the precisions accepted by date_trunc
+var dateTruncFields = []string{"microseconds", "milliseconds", "second", "minute", "hour",
+	"day", "week", "month", "quarter", "year", "decade", "century", "millennium"}
+
+func isDateTruncField(field string) bool {
+	for _, f := range dateTruncFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryConfig extracts the retry options, checking that the delays
+// are positive and the initial one does not exceed the maximum
+func parseRetryConfig(config plugin.Config) (RetryConfig, error) {
+	var (
+		retry RetryConfig
+		err   error
+	)
+	if retry.Count, err = getInt(config, "retry_count", defaultRetryCount); err != nil {
+		return retry, err
+	}
+	if retry.Count < 0 {
+		return retry, fmt.Errorf("Invalid retry_count %d (expected 0 or more)", retry.Count)
+	}
+	delays := []struct {
+		key, def string
+		value    *time.Duration
+	}{
+		{"retry_initial_delay", defaultRetryInitialDelay, &retry.InitialDelay},
+		{"retry_max_delay", defaultRetryMaxDelay, &retry.MaxDelay},
+	}
+	for _, d := range delays {
+		value, err := getString(config, d.key, d.def)
+		if err != nil {
+			return retry, err
+		}
+		if *d.value, err = time.ParseDuration(value); err != nil || *d.value <= 0 {
+			return retry, fmt.Errorf("Invalid %s '%s' (expected a positive duration such as 100ms)", d.key, value)
+		}
+	}
+	if retry.InitialDelay > retry.MaxDelay {
+		return retry, fmt.Errorf("Invalid retry_initial_delay %v (expected at most retry_max_delay %v)", retry.InitialDelay, retry.MaxDelay)
+	}
+	return retry, nil
+}
+
+// parseNamespaceConfig parses the namespace filtering and transformation
+// options
+func parseNamespaceConfig(config plugin.Config) (NamespaceConfig, error) {
+	var ns NamespaceConfig
+	for _, option := range []struct {
+		key      string
+		patterns *[]*regexp.Regexp
+	}{
+		{"namespace_include", &ns.Include},
+		{"namespace_exclude", &ns.Exclude},
+	} {
+		value, err := getString(config, option.key, "")
+		if err != nil {
+			return ns, err
+		}
+		if *option.patterns, err = parseNamespacePatterns(option.key, value); err != nil {
+			return ns, err
+		}
+	}
+	prefixes, err := getString(config, "namespace_prefix_strip", "")
+	if err != nil {
+		return ns, err
+	}
+	for _, prefix := range splitList(prefixes, ";") {
+		ns.PrefixStrip = append(ns.PrefixStrip, strings.Split(strings.Trim(prefix, "."), "."))
+	}
+	rename, err := getString(config, "namespace_rename", "")
+	if err != nil {
+		return ns, err
+	}
+	if ns.Rename, err = parseNamespaceRename(rename); err != nil {
+		return ns, err
+	}
+	return ns, nil
+}
+
+// parseLogConfig reads the log options, the task is named after its table
+// unless task_name is set
+func parseLogConfig(config plugin.Config, table string) (LogConfig, error) {
+	var logCfg LogConfig
+	level, err := getString(config, "log_level", "info")
+	if err != nil {
+		return logCfg, err
+	}
+	switch level {
+	case "debug", "info", "warning", "error":
+		logCfg.Level, _ = log.ParseLevel(level)
+	default:
+		return logCfg, fmt.Errorf("Invalid log_level '%s' (expected 'debug', 'info', 'warning' or 'error')", level)
+	}
+	if logCfg.Task, err = getString(config, "task_name", table); err != nil {
+		return logCfg, err
+	}
+	return logCfg, nil
+}
+
+// parseAsyncConfig extracts the options of the async queue
+func parseAsyncConfig(config plugin.Config) (AsyncConfig, error) {
+	var (
+		async AsyncConfig
+		err   error
+	)
+	if async.Enabled, err = getBool(config, "async", false); err != nil {
+		return async, err
+	}
+	if async.QueueDepth, err = getInt(config, "queue_depth", defaultQueueDepth); err != nil {
+		return async, err
+	}
+	if async.QueueDepth <= 0 {
+		return async, fmt.Errorf("Invalid queue_depth %d (expected a positive number)", async.QueueDepth)
+	}
+	if async.Workers, err = getInt(config, "workers", defaultWorkers); err != nil {
+		return async, err
+	}
+	if async.Workers <= 0 {
+		return async, fmt.Errorf("Invalid workers %d (expected a positive number)", async.Workers)
+	}
+	interval, err := getString(config, "flush_interval", defaultFlushInterval)
+	if err != nil {
+		return async, err
+	}
+	if async.FlushInterval, err = time.ParseDuration(interval); err != nil || async.FlushInterval <= 0 {
+		return async, fmt.Errorf("Invalid flush_interval '%s' (expected a positive duration such as 1s)", interval)
+	}
+	maxSize, err := getInt(config, "queue_max_size", 0)
+	if err != nil {
+		return async, err
+	}
+	if maxSize < 0 {
+		return async, fmt.Errorf("Invalid queue_max_size %d (expected a number of megabytes, or 0)", maxSize)
+	}
+	async.MaxSize = int64(maxSize) << 20
+	full, err := getString(config, "queue_full", queueFullBlock)
+	if err != nil {
+		return async, err
+	}
+	if full != queueFullBlock && full != queueFullDrop {
+		return async, fmt.Errorf("Invalid queue_full '%s' (expected '%s' or '%s')", full, queueFullBlock, queueFullDrop)
+	}
+	async.DropWhenFull = full == queueFullDrop
+	return async, nil
+}
+
+// validateConnectionURI checks that uri is a postgres:// URI lib/pq can
+// connect with; the errors leave out the URI, as it may hold a password
+func validateConnectionURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Invalid connection_uri: %v", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("Invalid connection_uri scheme '%s' (expected postgres:// or postgresql://)", u.Scheme)
+	}
+	if u.Opaque != "" {
+		return fmt.Errorf("Invalid connection_uri: expected %s:// followed by the host", u.Scheme)
+	}
+	if _, err := pq.ParseURL(uri); err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("Invalid connection_uri: %v", err)
+	}
+	return nil
+}
+
+// sslModes are the sslmode values supported by lib/pq
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// parseSSLConfig fills in the SSL options of cfg, checking that the mode
+// is known and that the certificate files exist
+func parseSSLConfig(config plugin.Config, cfg *ConnectionConfig) error {
+	var err error
+	if cfg.SSLMode, err = getStringEnv(config, "sslmode", "PGSSLMODE", defaultSSLMode); err != nil {
+		return err
+	}
+	known := false
+	for _, mode := range sslModes {
+		known = known || mode == cfg.SSLMode
+	}
+	if !known {
+		return fmt.Errorf("Invalid sslmode '%s' (expected one of: %s)", cfg.SSLMode, strings.Join(sslModes, ", "))
+	}
+	files := []struct {
+		key   string
+		value *string
+	}{
+		{"sslcert", &cfg.SSLCert},
+		{"sslkey", &cfg.SSLKey},
+		{"sslrootcert", &cfg.SSLRootCert},
+	}
+	for _, f := range files {
+		if *f.value, err = getString(config, f.key, ""); err != nil {
+			return err
+		}
+		if *f.value == "" {
+			continue
+		}
+		if _, err := os.Stat(*f.value); err != nil {
+			return fmt.Errorf("Invalid %s: %v", f.key, err)
+		}
+	}
+	if (cfg.SSLCert == "") != (cfg.SSLKey == "") {
+		return fmt.Errorf("sslcert and sslkey must be set together")
+	}
+	if cfg.SSLMode == "disable" && (cfg.SSLCert != "" || cfg.SSLRootCert != "") {
+		return fmt.Errorf("sslcert, sslkey and sslrootcert require sslmode other than 'disable'")
+	}
+	return nil
+}
+
+// timeFormats are the timestamp layouts accepted by time_format, all of
+// which PostgreSQL parses as timestamp with time zone
+var timeFormats = []struct{ name, layout string }{
+	{"RFC3339", time.RFC3339},
+	{"RFC3339Milli", "2006-01-02T15:04:05.000Z07:00"},
+	{"RFC3339Micro", "2006-01-02T15:04:05.000000Z07:00"},
+	{"RFC3339Nano", time.RFC3339Nano},
+}
+
+// timeFormatLayout returns the layout of the named time format, or "" for
+// an unknown name
+func timeFormatLayout(name string) string {
+	for _, f := range timeFormats {
+		if f.name == name {
+			return f.layout
+		}
+	}
+	return ""
+}
+
+// splitList splits a separated config value, dropping empty entries
+func splitList(value, sep string) []string {
+	var list []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// configCache keeps the processed config of each task config, so a task
+// config is only extracted and validated again when it changes; the
+// configs no publish used for idleTimeout are dropped
+type configCache struct {
+	mutex   sync.Mutex
+	configs map[string]*cachedConfig
+}
+
+// cachedConfig is a processed config and when a publish last used it
+type cachedConfig struct {
+	config *publisherConfig
+	used   time.Time
+}
+
+// get returns the processed config for the given task config
+func (c *configCache) get(config plugin.Config) (*publisherConfig, error) {
+	key := cacheKey(config)
+	now := timeNow()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, cached := range c.configs {
+		if now.Sub(cached.used) > idleTimeout {
+			delete(c.configs, k)
+		}
+	}
+	if cached, ok := c.configs[key]; ok {
+		cached.used = now
+		return cached.config, nil
+	}
+	cfg, err := newPublisherConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if c.configs == nil {
+		c.configs = make(map[string]*cachedConfig)
+	}
+	c.configs[key] = &cachedConfig{config: cfg, used: now}
+	return cfg, nil
+}
+
+// cacheKey returns the options of config with their types in key order,
+// equal for equal task configs
+func cacheKey(config plugin.Config) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var key bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&key, "%q=%T:%#v;", k, config[k], config[k])
+	}
+	return key.String()
+}
+
+// getenv is replaced in tests
+var getenv = os.Getenv
+
+// getStringEnv returns the option key, or the environment variable env
+// when the option is absent, or def when both are
+func getStringEnv(config plugin.Config, key, env, def string) (string, error) {
+	if _, ok := config[key]; !ok {
+		if value := getenv(env); value != "" {
+			return value, nil
+		}
+	}
+	return getString(config, key, def)
+}
+
+// getRequiredStringEnv is getStringEnv for options without default
+func getRequiredStringEnv(config plugin.Config, key, env string) (string, error) {
+	if _, ok := config[key]; !ok && getenv(env) == "" {
+		return "", fmt.Errorf("Missing required config option '%s' (or environment variable %s)", key, env)
+	}
+	return getStringEnv(config, key, env, "")
+}
+
+// getTimeout returns the duration of the timeout option name, zero when
+// unset
+func getTimeout(config plugin.Config, name string) (time.Duration, error) {
+	value, err := getString(config, name, "")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid %s '%s' (expected a positive duration such as 10s)", name, value)
+	}
+	return timeout, nil
+}
+
+// getIntEnv is getStringEnv for integer options
+func getIntEnv(config plugin.Config, key, env string, def int) (int, error) {
+	if _, ok := config[key]; !ok {
+		if value := getenv(env); value != "" {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid %s '%s' (expected an integer)", env, value)
+			}
+			return i, nil
+		}
+	}
+	return getInt(config, key, def)
+}
+
+// getPassword returns the password option, or the contents of the file
+// named by password_file, or the PGPASSWORD environment variable, in this
+// order; an empty password option is a valid password
+func getPassword(config plugin.Config) (string, error) {
+	if _, ok := config["password"]; ok {
+		return getString(config, "password", "")
+	}
+	file, err := getString(config, "password_file", "")
+	if err != nil {
+		return "", err
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Error reading password_file: %v", err)
+		}
+		// secrets are often mounted with a trailing newline
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if value := getenv("PGPASSWORD"); value != "" {
+		return value, nil
+	}
+	return "", fmt.Errorf("Missing required config option 'password' (or password_file, or environment variable PGPASSWORD)")
+}
+
+func getRequiredString(config plugin.Config, key string) (string, error) {
+	if _, ok := config[key]; !ok {
+		return "", fmt.Errorf("Missing required config option '%s'", key)
+	}
+	return getString(config, key, "")
+}
+
+func getString(config plugin.Config, key string, def string) (string, error) {
+	str, err := config.GetString(key)
+	if err == plugin.ErrConfigNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Config option '%s' must be a string, got %T", key, config[key])
+	}
+	return str, nil
+}
+
+func getInt(config plugin.Config, key string, def int) (int, error) {
+	i, err := config.GetInt(key)
+	if err == plugin.ErrConfigNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Config option '%s' must be an integer, got %T", key, config[key])
+	}
+	return int(i), nil
+}
+
+func getBool(config plugin.Config, key string, def bool) (bool, error) {
+	b, err := config.GetBool(key)
+	if err == plugin.ErrConfigNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Config option '%s' must be a bool, got %T", key, config[key])
+	}
+	return b, nil
+}
+
+// LoadConfigFile reads a JSON object of config options, as found in the
+// config section of a task manifest, from path
+func LoadConfigFile(path string) (plugin.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Error decoding config file %s: %v", path, err)
+	}
+
+	config := make(plugin.Config, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			config[key] = v
+		case bool:
+			config[key] = v
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				config[key] = i
+			} else if f, err := v.Float64(); err == nil {
+				config[key] = f
+			} else {
+				return nil, fmt.Errorf("Invalid number for config option '%s': %v", key, err)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported value for config option '%s': %v", key, value)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,259 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// connect returns a connection to the next server in turn for the given
+// options, keeping the servers of each options apart so tasks of other
+// options do not replace each other's connections; release must be called
+// once the publish is done with the connection, so the connections marked
+// down or closed as idle meanwhile are closed only after in-flight writes
+// drain
+func (s *PostgreSQLPublisher) connect(ctx context.Context, cfg ConnectionConfig) (db *sql.DB, release func(), err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	servers := s.servers[cfg]
+	if servers == nil {
+		servers = newBalancer(cfg)
+		if s.servers == nil {
+			s.servers = make(map[ConnectionConfig]*balancer)
+		}
+		s.servers[cfg] = servers
+	}
+	servers.used = timeNow()
+	db, err = servers.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	servers.users.Add(1)
+	done := servers.acquire(db)
+	return db, func() {
+		done()
+		servers.users.Done()
+	}, nil
+}
+
+// disconnect drops db if it is still in use, so its server is skipped for
+// a while and connected again, resolving it anew, when its turn comes back
+func (s *PostgreSQLPublisher) disconnect(db *sql.DB) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, servers := range s.servers {
+		servers.markDown(db)
+	}
+}
+
+// isConnectionError reports whether err means the connection to the server
+// is lost rather than that a statement failed
+func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		// connection exceptions and operator intervention (server
+		// shutdown), but for the statements cancelled by statement_timeout
+		if pqErr.Code == "57014" {
+			return false
+		}
+		return pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57"
+	}
+	return false
+}
+
+// lookupSRV and lookupHost are replaced in tests
+var (
+	lookupSRV  = net.LookupSRV
+	lookupHost = net.LookupHost
+)
+
+func getPostgreSQLConn(ctx context.Context, cfg ConnectionConfig) (*sql.DB, error) {
+	if cfg.URI != "" {
+		return openConn(ctx, cfg)
+	}
+	if cfg.SRVService != "" {
+		return getSRVConn(ctx, cfg)
+	}
+	// verify-full checks the server certificate against the host name,
+	// so the host must not be replaced with its addresses
+	if cfg.SSLMode == "verify-full" {
+		return openConn(ctx, cfg)
+	}
+	if addrs := resolveHost(cfg.Hostname); len(addrs) > 1 {
+		return getMultiAddrConn(ctx, cfg, addrs)
+	}
+	return openConn(ctx, cfg)
+}
+
+// resolveHost returns the addresses of a host name, or nothing for IP
+// literals, unix socket directories and names that do not resolve, which
+// are left to lib/pq
+func resolveHost(host string) []string {
+	if host == "" || strings.HasPrefix(host, "/") || net.ParseIP(hostAddress(host)) != nil {
+		return nil
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
+
+// getMultiAddrConn connects to the first of the addresses a host name
+// resolves to that answers, so one unreachable address does not fail
+// the connection
+func getMultiAddrConn(ctx context.Context, cfg ConnectionConfig, addrs []string) (*sql.DB, error) {
+	var err error
+	for _, addr := range addrs {
+		target := cfg
+		target.Hostname = addr
+
+		var db *sql.DB
+		db, err = openConn(ctx, target)
+		if err == nil {
+			return db, nil
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+	return nil, err
+}
+
+// openConn opens a connection to the server of cfg and pings it to make
+// sure it works
+func openConn(ctx context.Context, cfg ConnectionConfig) (*sql.DB, error) {
+	logger := ctxLogger(ctx)
+	db, err := sql.Open("postgres", connectionString(cfg))
+	if err != nil {
+		logger.Error(err)
+		return db, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	err = db.PingContext(ctx)
+	if err != nil {
+		logger.Error(err)
+		return db, err
+	}
+	return db, err
+}
+
+// getSRVConn resolves the SRV record of cfg and connects to the first
+// target that answers, in the priority and weight order of the record
+func getSRVConn(ctx context.Context, cfg ConnectionConfig) (*sql.DB, error) {
+	_, addrs, err := lookupSRV("", "", cfg.SRVService)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving SRV record %s: %v", cfg.SRVService, err)
+	}
+	for _, addr := range addrs {
+		target := cfg
+		target.SRVService = ""
+		target.Hostname = strings.TrimSuffix(addr.Target, ".")
+		target.Port = int(addr.Port)
+
+		var db *sql.DB
+		db, err = getPostgreSQLConn(ctx, target)
+		if err == nil {
+			return db, nil
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+	return nil, err
+}
+
+// connectionString returns the lib/pq keyword/value connection string for
+// cfg, with every value quoted so spaces and quotes survive
+func connectionString(cfg ConnectionConfig) string {
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = defaultSSLMode
+	}
+	params := []struct{ key, value string }{
+		{"host", hostAddress(cfg.Hostname)},
+		{"port", fmt.Sprintf("%d", cfg.Port)},
+		{"user", cfg.Username},
+		{"password", cfg.Password},
+		{"dbname", cfg.Database},
+	}
+	if cfg.URI != "" {
+		params = nil
+	}
+	params = append(params, []struct{ key, value string }{
+		{"sslmode", sslMode},
+		{"sslcert", cfg.SSLCert},
+		{"sslkey", cfg.SSLKey},
+		{"sslrootcert", cfg.SSLRootCert},
+	}...)
+	var conn []string
+	for _, p := range params {
+		// unset certificate options are left out
+		if p.value == "" && strings.HasPrefix(p.key, "ssl") {
+			continue
+		}
+		conn = append(conn, fmt.Sprintf("%s=%s", p.key, quoteConnValue(p.value)))
+	}
+	if cfg.StatementTimeout > 0 {
+		// sent to the server as a run-time parameter of the session
+		conn = append(conn, fmt.Sprintf("statement_timeout=%s", quoteConnValue(fmt.Sprintf("%d", cfg.StatementTimeout/time.Millisecond))))
+	}
+	if cfg.URI != "" {
+		// lib/pq keeps the last of repeated keywords, so the options of
+		// the URI take precedence; the URI was validated with the config
+		uri, _ := pq.ParseURL(cfg.URI)
+		conn = append(conn, uri)
+	}
+	return strings.Join(conn, " ")
+}
+
+// hostAddress strips the brackets of IPv6 literals such as [fe80::1],
+// as lib/pq adds them itself when dialing
+func hostAddress(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		literal := host[1 : len(host)-1]
+		// the zone of link-local addresses is not part of the IP
+		if ip := net.ParseIP(strings.SplitN(literal, "%", 2)[0]); ip != nil {
+			return literal
+		}
+	}
+	return host
+}
+
+func quoteConnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
@@ -0,0 +1,91 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// writeRows writes rows into the table of schema with COPY in
+// bulk_mode copy and with multi-row inserts otherwise; a failed COPY is
+// retried with inserts, which also create a missing table and widen
+// columns, unless the connection was lost, the publish timed out or the
+// spooled batch was already written
+func writeRows(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row, cfg WriteConfig) error {
+	if cfg.BulkMode == bulkModeCopy {
+		err := copyRows(ctx, db, schema, rows)
+		if err == nil || err == errReplayed || isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+		ctxLogger(ctx).Errorf("COPY into %s failed, falling back to INSERT: %v", schema.TableName, err)
+	}
+	return insertRows(ctx, db, schema, rows, cfg.BatchSize)
+}
+
+// copyRows streams rows into the table with COPY FROM STDIN in one
+// transaction, which is rolled back when the copy fails
+func copyRows(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, copyQuery(schema))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range rows {
+		values := r.values(schema)
+		if schema.ArchiveRaw {
+			values = append(values, r.raw)
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// the rows are buffered, the server only checks them once the copy
+	// is ended by an Exec without values
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return commit(ctx, tx)
+}
+
+// copyQuery returns the COPY statement streaming rows into the table
+func copyQuery(schema SchemaConfig) string {
+	columns := rowColumns(schema)
+	if schema.ArchiveRaw {
+		columns += ", raw_payload"
+	}
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN", schema.quotedTable(), columns)
+}
@@ -0,0 +1,90 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCopyQuery(t *testing.T) {
+	Convey("TestCopyQuery", t, func() {
+		So(copyQuery(SchemaConfig{TableName: "info"}), ShouldEqual,
+			`COPY "info" (time_posted, key_column, value_column, tags) FROM STDIN`)
+		So(copyQuery(SchemaConfig{SchemaName: "snap", TableName: "info", Layout: schemaTyped, ArchiveRaw: true}), ShouldEqual,
+			`COPY "snap"."info" (time_posted, key_column, value_int, value_float, value_string, value_bool, tags, raw_payload) FROM STDIN`)
+	})
+}
+
+func TestWriteRowsCopy(t *testing.T) {
+	Convey("TestWriteRowsCopy", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		cfg := WriteConfig{BulkMode: bulkModeCopy, BatchSize: defaultBatchSize}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		rows := []row{
+			{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}"},
+			{timePosted: "2017-01-01T10:11:12Z", key: "bar", value: "2", tags: `{"host":"a"}`},
+		}
+
+		Convey("Rows are streamed with COPY in one transaction", func() {
+			mock.ExpectBegin()
+			stmt := mock.ExpectPrepare("^COPY \"info\" \\(.+\\) FROM STDIN$")
+			stmt.ExpectExec().WithArgs("2017-01-01T10:11:12Z", "foo", "1", "{}").WillReturnResult(driver.ResultNoRows)
+			stmt.ExpectExec().WithArgs("2017-01-01T10:11:12Z", "bar", "2", `{"host":"a"}`).WillReturnResult(driver.ResultNoRows)
+			stmt.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 2))
+			stmt.WillBeClosed()
+			mock.ExpectCommit()
+			So(writeRows(context.Background(), db, schema, rows, cfg), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Rows are inserted when the copy fails", func() {
+			mock.ExpectBegin()
+			stmt := mock.ExpectPrepare("^COPY \"info\" \\(.+\\) FROM STDIN$")
+			stmt.ExpectExec().WillReturnResult(driver.ResultNoRows)
+			stmt.ExpectExec().WillReturnResult(driver.ResultNoRows)
+			stmt.ExpectExec().WithArgs().WillReturnError(errors.New("COPY is not supported"))
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").
+				WithArgs("2017-01-01T10:11:12Z", "foo", "1", "{}", "2017-01-01T10:11:12Z", "bar", "2", `{"host":"a"}`).WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			So(writeRows(context.Background(), db, schema, rows, cfg), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Lost connections are not retried with inserts", func() {
+			mock.ExpectBegin()
+			mock.ExpectPrepare("^COPY \"info\" \\(.+\\) FROM STDIN$").WillReturnError(driver.ErrBadConn)
+			mock.ExpectRollback()
+			So(writeRows(context.Background(), db, schema, rows, cfg), ShouldEqual, driver.ErrBadConn)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
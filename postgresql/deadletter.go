@@ -0,0 +1,146 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// deadLetterParams is the number of parameters of a dead letter row
+const deadLetterParams = 6
+
+// createDeadLetterTable creates the dead letter table of schema, which
+// keeps the rejected rows as text with the table they were meant for and
+// the error they were rejected with
+func createDeadLetterTable(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (failed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(), "+
+		"table_name TEXT NOT NULL, time_posted TEXT, key_column TEXT, value_column TEXT, tags TEXT, error TEXT)",
+		schema.qualify(schema.DeadLetterTable))
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// insertChunk inserts rows within a savepoint of tx; when they are
+// rejected with a data error, the chunk is rolled back to the savepoint
+// and its rows are inserted one at a time, each within a savepoint of its
+// own, and only the rows rejected are written to the dead letter table, so
+// the rest of the batch commits. Values too long for columns that are
+// widened fail the chunk as usual
+func insertChunk(ctx context.Context, tx *sql.Tx, schema SchemaConfig, rows []row) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT insert_chunk"); err != nil {
+		return err
+	}
+	query, args := insertQuery(schema, rows...)
+	_, err := tx.ExecContext(ctx, query, args...)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT insert_chunk")
+		return err
+	}
+	if !isDeadLetterError(schema, err) {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT insert_chunk"); err != nil {
+		return err
+	}
+	rejected, causes := rows, []error{err}
+	if len(rows) > 1 {
+		if rejected, causes, err = insertEachRow(ctx, tx, schema, rows); err != nil {
+			return err
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	if err := deadLetter(ctx, tx, schema, rejected, causes); err != nil {
+		return err
+	}
+	ctxLogger(ctx).Errorf("Wrote %d metrics rejected by %s to %s: %v", len(rejected), schema.TableName, schema.DeadLetterTable, causes[0])
+	return nil
+}
+
+// insertEachRow inserts rows one at a time within tx, rolling back to a
+// savepoint for every row rejected with a data error; it returns the rows
+// rejected and their errors
+func insertEachRow(ctx context.Context, tx *sql.Tx, schema SchemaConfig, rows []row) ([]row, []error, error) {
+	var (
+		rejected []row
+		causes   []error
+	)
+	for _, r := range rows {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT insert_row"); err != nil {
+			return nil, nil, err
+		}
+		query, args := insertQuery(schema, r)
+		_, err := tx.ExecContext(ctx, query, args...)
+		if err == nil {
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT insert_row"); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if !isDeadLetterError(schema, err) {
+			return nil, nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT insert_row"); err != nil {
+			return nil, nil, err
+		}
+		rejected = append(rejected, r)
+		causes = append(causes, err)
+	}
+	return rejected, causes, nil
+}
+
+// isDeadLetterError reports whether err rejects rows that go to the dead
+// letter table of schema
+func isDeadLetterError(schema SchemaConfig, err error) bool {
+	return isDataError(err) && !(schema.WidenColumns && isValueTooLong(err))
+}
+
+// deadLetter writes rows to the dead letter table, each with the error it
+// was rejected with, or the first one for all rows when causes has one
+func deadLetter(ctx context.Context, tx *sql.Tx, schema SchemaConfig, rows []row, causes []error) error {
+	batchSize := maxQueryParams / deadLetterParams
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		values := make([]string, end-start)
+		args := make([]interface{}, 0, (end-start)*deadLetterParams)
+		for i, r := range rows[start:end] {
+			n := i * deadLetterParams
+			cause := causes[0]
+			if len(causes) == len(rows) {
+				cause = causes[start+i]
+			}
+			values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6)
+			args = append(args, schema.relation(), r.timePosted, r.key, r.value, r.tags, cause.Error())
+		}
+		query := fmt.Sprintf("INSERT INTO %s (table_name, time_posted, key_column, value_column, tags, error) VALUES %s",
+			schema.qualify(schema.DeadLetterTable), strings.Join(values, ", "))
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeadLetter(t *testing.T) {
+	Convey("TestDeadLetter", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["dead_letter_table"] = "info_rejected"
+		config["batch_size"] = int64(1)
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 2},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("A rejected chunk is rolled back to its savepoint and dead-lettered", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnError(&pq.Error{Code: "22P02", Message: "invalid input syntax"})
+			mock.ExpectExec("ROLLBACK TO SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info_rejected\" (.+)$").WithArgs("info", sqlmock.AnyArg(), "foo", "1", "{}", "pq: invalid input syntax").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("RELEASE SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Only the rejected rows of a chunk are dead-lettered", func() {
+			config["batch_size"] = int64(3)
+			metrics := append(metrics, plugin.Metric{Namespace: plugin.NewNamespace("baz"), Timestamp: time.Now(), Data: 3})
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "22P02", Message: "invalid input syntax"})
+			mock.ExpectExec("ROLLBACK TO SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("RELEASE SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnError(&pq.Error{Code: "23514", Message: "check violation"})
+			mock.ExpectExec("ROLLBACK TO SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "baz", "3", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("RELEASE SAVEPOINT insert_row").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info_rejected\" (.+)$").WithArgs("info", sqlmock.AnyArg(), "bar", "2", "{}", "pq: check violation").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Other errors fail the batch", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SAVEPOINT insert_chunk").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "42501", Message: "permission denied"})
+			mock.ExpectRollback()
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
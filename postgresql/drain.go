@@ -0,0 +1,128 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"errors"
+)
+
+// errDraining is returned for publishes arriving after Drain was called
+var errDraining = errors.New("Publisher is draining, batch not accepted")
+
+// begin registers a publish as in flight, or refuses it once the
+// publisher is draining; every successful begin must be paired with
+// s.inflight.Done()
+func (s *PostgreSQLPublisher) begin() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return errDraining
+	}
+	s.inflight.Add(1)
+	return nil
+}
+
+// Drain stops accepting publishes and the replica verifications still
+// waiting, waits for the publishes in flight to finish writing, flushes the
+// async queues and closes the connections, including the one to the replica
+// of verify_replica_uri, so the plugin can exit for an upgrade or restart
+// without dropping batches
+func (s *PostgreSQLPublisher) Drain() {
+	s.mutex.Lock()
+	s.draining = true
+	// no verification is scheduled once draining is set
+	for timer := range s.verifyTimers {
+		timer.Stop()
+	}
+	s.verifyTimers = nil
+	s.mutex.Unlock()
+
+	s.inflight.Wait()
+
+	// no publish is left to enqueue, and the workers take s.mutex
+	s.mutex.Lock()
+	queues := s.queues
+	s.queues = nil
+	s.mutex.Unlock()
+	for _, q := range queues {
+		q.close()
+	}
+
+	// verifications check draining first, this waits out a running one
+	s.verifyMutex.Lock()
+	s.closeReplica()
+	s.verifyMutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, prepared := range s.prepared {
+		if prepared.maintenance != nil {
+			prepared.maintenance.stop()
+			prepared.maintenance = nil
+		}
+	}
+	for _, servers := range s.servers {
+		servers.close()
+	}
+	s.servers = nil
+	for _, r := range s.reporters {
+		r.close()
+	}
+	s.reporters = nil
+}
+
+// closeIdle closes the connections, maintenance, async queues and stats
+// reporters of the options no publish used for idleTimeout, so the tasks
+// that stopped publishing do not keep them; it is called by publishes,
+// which keep Drain waiting for the queues being flushed
+func (s *PostgreSQLPublisher) closeIdle() {
+	now := timeNow()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for opts, servers := range s.servers {
+		if now.Sub(servers.used) > idleTimeout {
+			servers.retire()
+			delete(s.servers, opts)
+		}
+	}
+	for cfg, prepared := range s.prepared {
+		if now.Sub(prepared.used) > idleTimeout {
+			if prepared.maintenance != nil {
+				prepared.maintenance.stop()
+			}
+			delete(s.prepared, cfg)
+		}
+	}
+	for opts, q := range s.queues {
+		if now.Sub(q.used) > idleTimeout {
+			// flushed in the background, Drain waits for it as for a
+			// publish in flight
+			s.inflight.Add(1)
+			go s.closeQueue(q)
+			delete(s.queues, opts)
+		}
+	}
+	for opts, r := range s.reporters {
+		if now.Sub(r.used) > idleTimeout {
+			r.close()
+			delete(s.reporters, opts)
+		}
+	}
+}
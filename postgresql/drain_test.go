@@ -0,0 +1,114 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrain(t *testing.T) {
+	Convey("TestDrain", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg := ConnectionConfig{Hostname: "localhost", Port: 5432, Username: "postgres", Database: "snap_test"}
+		sp := NewPostgreSQLPublisher()
+		sp.servers = map[ConnectionConfig]*balancer{cfg: {endpoints: []*endpoint{{cfg: cfg, db: db}}}}
+
+		So(sp.begin(), ShouldBeNil)
+		_, release, err := sp.connect(context.Background(), cfg)
+		So(err, ShouldBeNil)
+
+		drained := make(chan struct{})
+		go func() {
+			sp.Drain()
+			close(drained)
+		}()
+
+		Convey("new publishes are refused while in-flight ones finish", func() {
+			for {
+				if err := sp.begin(); err != nil {
+					So(err, ShouldEqual, errDraining)
+					break
+				}
+				sp.inflight.Done()
+				time.Sleep(time.Millisecond)
+			}
+			select {
+			case <-drained:
+				t.Fatal("Drain returned with a publish in flight")
+			default:
+			}
+
+			mock.ExpectClose()
+			release()
+			sp.inflight.Done()
+			<-drained
+			So(sp.servers, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestConnectKeepsServersOfEachOptions(t *testing.T) {
+	Convey("TestConnectKeepsServersOfEachOptions", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg := ConnectionConfig{Hostname: "localhost", Port: 5432, Username: "postgres", Database: "snap_test"}
+		sp := NewPostgreSQLPublisher()
+		servers := &balancer{endpoints: []*endpoint{{cfg: cfg, db: db}}}
+		sp.servers = map[ConnectionConfig]*balancer{cfg: servers}
+
+		_, release, err := sp.connect(context.Background(), cfg)
+		So(err, ShouldBeNil)
+
+		// the other options point at an unreachable server
+		sp.connect(context.Background(), ConnectionConfig{Hostname: "/nonexistent", Port: 5432})
+		So(sp.servers, ShouldHaveLength, 2)
+		So(sp.servers[cfg], ShouldEqual, servers)
+		conn, again, err := sp.connect(context.Background(), cfg)
+		So(err, ShouldBeNil)
+		So(conn, ShouldEqual, db)
+		again()
+
+		Convey("servers unused for idleTimeout are closed once released", func() {
+			defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+			now := time.Now().Add(idleTimeout + time.Second)
+			timeNow = func() time.Time { return now }
+			sp.closeIdle()
+			So(sp.servers, ShouldBeEmpty)
+			So(servers.endpoints[0].db, ShouldEqual, db)
+
+			mock.ExpectClose()
+			release()
+			for i := 0; i < 100 && mock.ExpectationsWereMet() != nil; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
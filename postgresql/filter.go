@@ -0,0 +1,144 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namespaceRename replaces the matches of pattern in a key with template
+type namespaceRename struct {
+	pattern  *regexp.Regexp
+	template string
+}
+
+// parseNamespacePatterns parses a semicolon separated list of patterns
+// matched against the key of a metric, the namespace joined with dots. A
+// pattern enclosed in slashes is a regular expression, others are globs in
+// which * and ? match within one namespace element.
+func parseNamespacePatterns(option, value string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, item := range splitList(value, ";") {
+		expr := globToRegexp(item)
+		if len(item) > 1 && strings.HasPrefix(item, "/") && strings.HasSuffix(item, "/") {
+			expr = item[1 : len(item)-1]
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s pattern '%s': %v", option, item, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// globToRegexp returns the anchored regular expression of a glob matching
+// keys
+func globToRegexp(glob string) string {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(`[^.]*`)
+		case '?':
+			expr.WriteString(`[^.]`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// parseNamespaceRename parses the namespace_rename option, a semicolon
+// separated list of pattern=replacement rules tried in order; the
+// replacement may refer to the groups of the regular expression pattern
+// as $1 or ${name}
+func parseNamespaceRename(value string) ([]namespaceRename, error) {
+	var rules []namespaceRename
+	for _, rule := range splitList(value, ";") {
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid namespace_rename rule '%s' (expected pattern=replacement)", rule)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(rule[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace_rename pattern '%s': %v", rule[:i], err)
+		}
+		rules = append(rules, namespaceRename{pattern: pattern, template: strings.TrimSpace(rule[i+1:])})
+	}
+	return rules, nil
+}
+
+// keep reports whether the metric with key passes the include and exclude
+// patterns
+func (c NamespaceConfig) keep(key string) bool {
+	if len(c.Include) > 0 && !matchAny(c.Include, key) {
+		return false
+	}
+	return !matchAny(c.Exclude, key)
+}
+
+func matchAny(patterns []*regexp.Regexp, key string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// transforms reports whether transform changes namespaces
+func (c NamespaceConfig) transforms() bool {
+	return len(c.PrefixStrip) > 0 || len(c.Rename) > 0
+}
+
+// transform strips the first matching prefix from ns and applies the
+// first matching rename rule to the key of the result, returning the
+// namespace the metric is written with; a namespace is never stripped to
+// nothing
+func (c NamespaceConfig) transform(ns []string) []string {
+	for _, prefix := range c.PrefixStrip {
+		if len(ns) > len(prefix) && hasPrefix(ns, prefix) {
+			ns = ns[len(prefix):]
+			break
+		}
+	}
+	for _, rule := range c.Rename {
+		key := strings.Join(ns, ".")
+		if rule.pattern.MatchString(key) {
+			return strings.Split(rule.pattern.ReplaceAllString(key, rule.template), ".")
+		}
+	}
+	return ns
+}
+
+func hasPrefix(ns, prefix []string) bool {
+	for i, elem := range prefix {
+		if ns[i] != elem {
+			return false
+		}
+	}
+	return true
+}
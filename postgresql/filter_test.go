@@ -0,0 +1,108 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNamespaceConfig(t *testing.T) {
+	Convey("TestNamespaceConfig", t, func() {
+		config := make(plugin.Config)
+		config["namespace_include"] = "intel.psutil.*.*; /^intel\\.procfs\\.(cpu|mem)\\./"
+		config["namespace_exclude"] = "intel.psutil.load.load15"
+		config["namespace_prefix_strip"] = "intel.psutil; intel."
+		config["namespace_rename"] = "^procfs\\.cpu\\.(.+)$=cpu.$1"
+		ns, err := parseNamespaceConfig(config)
+		So(err, ShouldBeNil)
+
+		Convey("Globs match within namespace elements, regular expressions anywhere", func() {
+			So(ns.keep("intel.psutil.load.load1"), ShouldBeTrue)
+			So(ns.keep("intel.psutil.load"), ShouldBeFalse)
+			So(ns.keep("intel.psutil.load.load1.extra"), ShouldBeFalse)
+			So(ns.keep("intel.procfs.cpu.0.user"), ShouldBeTrue)
+			So(ns.keep("intel.procfs.disk.sda"), ShouldBeFalse)
+		})
+
+		Convey("Excluded metrics are dropped", func() {
+			So(ns.keep("intel.psutil.load.load15"), ShouldBeFalse)
+		})
+
+		Convey("Prefixes are stripped and keys renamed", func() {
+			So(ns.transforms(), ShouldBeTrue)
+			So(ns.transform([]string{"intel", "psutil", "load", "load1"}), ShouldResemble, []string{"load", "load1"})
+			So(ns.transform([]string{"intel", "procfs", "cpu", "0"}), ShouldResemble, []string{"cpu", "0"})
+			So(ns.transform([]string{"intel", "psutil"}), ShouldResemble, []string{"psutil"})
+			So(ns.transform([]string{"intel"}), ShouldResemble, []string{"intel"})
+			So(ns.transform([]string{"other"}), ShouldResemble, []string{"other"})
+		})
+
+		Convey("All metrics are kept without rules", func() {
+			ns, err := parseNamespaceConfig(make(plugin.Config))
+			So(err, ShouldBeNil)
+			So(ns.keep("anything"), ShouldBeTrue)
+			So(ns.transforms(), ShouldBeFalse)
+		})
+
+		Convey("Invalid rules return an error", func() {
+			config["namespace_exclude"] = "/(/"
+			_, err := parseNamespaceConfig(config)
+			So(err, ShouldNotBeNil)
+
+			config["namespace_exclude"] = ""
+			config["namespace_rename"] = "no replacement"
+			_, err = parseNamespaceConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPublishNamespaceFilter(t *testing.T) {
+	Convey("TestPublishNamespaceFilter", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["namespace_exclude"] = "intel.psutil.load.*"
+		config["namespace_prefix_strip"] = "intel.psutil"
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("intel", "psutil", "load", "load1"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("intel", "psutil", "vm", "free"), Timestamp: time.Now(), Data: 2},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "vm.free", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		So(sp.Publish(metrics, config), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+		So(sp.stats.filtered, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,134 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	log "github.com/sirupsen/logrus"
+)
+
+// redacted replaces credentials in logged configs
+const redacted = "xxxxx"
+
+// newLogger returns a logger at log.InfoLevel, for the messages that are
+// not about a task
+func newLogger() *log.Logger {
+	logger := log.New()
+	logger.Level = log.InfoLevel
+	return logger
+}
+
+// loggers are the loggers of the task configs, by their options, so tasks
+// with different log_level values do not override each other
+var (
+	loggers      = make(map[LogConfig]*log.Logger)
+	loggersMutex sync.Mutex
+)
+
+// logger returns the logger of the task of l, at its level and with the
+// fields identifying the task
+func (l LogConfig) logger() *log.Entry {
+	loggersMutex.Lock()
+	logger, ok := loggers[l]
+	if !ok {
+		logger = log.New()
+		logger.Level = l.Level
+		loggers[l] = logger
+	}
+	loggersMutex.Unlock()
+	return logger.WithFields(l.fields())
+}
+
+// fields returns the log fields identifying the task of cfg
+func (l LogConfig) fields() log.Fields {
+	return log.Fields{"task": l.Task}
+}
+
+// logConfigKey is the context key of the LogConfig of the task a context
+// writes for
+type logConfigKey struct{}
+
+// withLogConfig returns ctx logging with the logger of the task of l
+func withLogConfig(ctx context.Context, l LogConfig) context.Context {
+	return context.WithValue(ctx, logConfigKey{}, l)
+}
+
+// ctxLogger returns the logger of the task ctx writes for, or a logger at
+// log.InfoLevel when it writes for none
+func ctxLogger(ctx context.Context) *log.Entry {
+	if l, ok := ctx.Value(logConfigKey{}).(LogConfig); ok {
+		return l.logger()
+	}
+	return log.NewEntry(newLogger())
+}
+
+// uriOptions are the config options holding connection URIs
+var uriOptions = []string{"connection_uri", "verify_replica_uri"}
+
+// redactConfig returns a copy of config safe to log, with the password
+// and the passwords of the uriOptions replaced
+func redactConfig(config plugin.Config) plugin.Config {
+	safe := make(plugin.Config, len(config))
+	for key, value := range config {
+		safe[key] = value
+	}
+	if password, ok := safe["password"].(string); ok && password != "" {
+		safe["password"] = redacted
+	}
+	for _, key := range uriOptions {
+		if uri, ok := safe[key].(string); ok {
+			safe[key] = redactURI(uri)
+		}
+	}
+	return safe
+}
+
+// dsnPassword matches the password of a key/value connection string,
+// quoted or not
+var dsnPassword = regexp.MustCompile(`(^|\s)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactURI returns uri with its passwords replaced, in the user info and
+// the query string of a URL or in a key/value connection string, or
+// replaces all of it when it cannot be parsed
+func redactURI(uri string) string {
+	if !strings.Contains(uri, "://") {
+		return dsnPassword.ReplaceAllString(uri, "${1}${2}"+redacted)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+	}
+	if query := u.Query(); query.Get("password") != "" {
+		query.Set("password", redacted)
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,92 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/robfig/cron"
+)
+
+// maintenance runs the configured maintenance jobs of a table on a cron
+// schedule, so they are kept out of the publish path
+type maintenance struct {
+	cron *cron.Cron
+	// running is set while a round of jobs is in progress
+	running int32
+	// dropPartitions is the retention job of time partitioned tables
+	dropPartitions func(db *sql.DB) error
+}
+
+func startMaintenance(db *sql.DB, schema SchemaConfig, cfg MaintenanceConfig) (*maintenance, error) {
+	m := &maintenance{cron: cron.New()}
+	queries := maintenanceQueries(schema, cfg)
+	if schema.TimePartitioning != "" && cfg.RetentionDays > 0 {
+		m.dropPartitions = func(db *sql.DB) error {
+			return dropExpiredPartitions(db, schema, cfg.RetentionDays)
+		}
+	}
+	if err := m.cron.AddFunc(cfg.Schedule, func() { m.run(db, queries) }); err != nil {
+		return nil, err
+	}
+	m.cron.Start()
+	return m, nil
+}
+
+func (m *maintenance) stop() {
+	m.cron.Stop()
+}
+
+// run executes one round of jobs, skipping it while the previous round
+// is still running
+func (m *maintenance) run(db *sql.DB, queries []string) {
+	if !atomic.CompareAndSwapInt32(&m.running, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.running, 0)
+
+	logger := newLogger()
+	if m.dropPartitions != nil {
+		if err := m.dropPartitions(db); err != nil {
+			logger.Errorf("Dropping expired partitions failed: %v", err)
+		}
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			logger.Errorf("Maintenance query '%s' failed: %v", query, err)
+		}
+	}
+}
+
+// maintenanceQueries returns the statements of the jobs enabled in cfg
+func maintenanceQueries(schema SchemaConfig, cfg MaintenanceConfig) []string {
+	var queries []string
+	table := schema.quotedTable()
+	// time partitioned tables drop whole partitions instead
+	if cfg.RetentionDays > 0 && schema.TimePartitioning == "" {
+		queries = append(queries, fmt.Sprintf("DELETE FROM %s WHERE time_posted < now() - interval '%d days'", table, cfg.RetentionDays))
+	}
+	if cfg.Analyze {
+		queries = append(queries, fmt.Sprintf("ANALYZE %s", table))
+	}
+	return queries
+}
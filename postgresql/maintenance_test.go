@@ -0,0 +1,81 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMaintenance(t *testing.T) {
+	Convey("TestMaintenance", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+
+		Convey("No jobs are enabled by default", func() {
+			So(maintenanceQueries(schema, MaintenanceConfig{}), ShouldBeEmpty)
+		})
+
+		Convey("Retention and analyze jobs are run in order", func() {
+			cfg := MaintenanceConfig{Schedule: "@daily", RetentionDays: 7, Analyze: true}
+			queries := maintenanceQueries(schema, cfg)
+			So(queries, ShouldResemble, []string{
+				"DELETE FROM \"info\" WHERE time_posted < now() - interval '7 days'",
+				"ANALYZE \"info\"",
+			})
+
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			mock.ExpectExec("^DELETE FROM \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 10))
+			mock.ExpectExec("^ANALYZE \"info\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			m, err := startMaintenance(db, schema, cfg)
+			So(err, ShouldBeNil)
+			m.stop()
+			m.run(db, queries)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Time partitioned tables drop partitions instead of deleting rows", func() {
+			schema.TimePartitioning = partitionDay
+			cfg := MaintenanceConfig{Schedule: "@daily", RetentionDays: 7, Analyze: true}
+			So(maintenanceQueries(schema, cfg), ShouldResemble, []string{"ANALYZE \"info\""})
+
+			db, _, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			m, err := startMaintenance(db, schema, cfg)
+			So(err, ShouldBeNil)
+			m.stop()
+			So(m.dropPartitions, ShouldNotBeNil)
+		})
+
+		Convey("Invalid schedule returns an error", func() {
+			db, _, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			m, err := startMaintenance(db, schema, MaintenanceConfig{Schedule: "every day"})
+			So(m, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
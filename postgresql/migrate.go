@@ -0,0 +1,229 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+)
+
+// legacyIntPattern and legacyFloatPattern match the value_column of the
+// text schema holding an integer that fits value_int, or another number
+// as formatted by interfaceToString
+const (
+	legacyIntPattern   = `^-?[0-9]{1,18}$`
+	legacyFloatPattern = `^([-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?|NaN|[-+]Inf)$`
+)
+
+// legacyValues are the expressions filling the typed columns, in the order
+// of typedColumns, from the value_column of a row o of the text schema;
+// rows written with the typed schema keep their values
+var legacyValues = []string{
+	"COALESCE(o.value_int, CASE WHEN o.value_column ~ '" + legacyIntPattern + "' THEN o.value_column::bigint END)",
+	"COALESCE(o.value_float, CASE WHEN o.value_column !~ '" + legacyIntPattern + "' AND o.value_column ~ '" + legacyFloatPattern +
+		"' THEN replace(o.value_column, 'Inf', 'Infinity')::double precision END)",
+	"COALESCE(o.value_string, CASE WHEN NOT (o.value_column ~ '" + legacyIntPattern + "' OR o.value_column ~ '" + legacyFloatPattern +
+		"' OR o.value_column IN ('true', 'false')) THEN o.value_column END)",
+	"COALESCE(o.value_bool, CASE WHEN o.value_column IN ('true', 'false') THEN o.value_column::boolean END)",
+}
+
+// execer runs statements on a database or in a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Migrate moves the rows table_name holds in the legacy text schema to
+// dual_write_table in the typed schema, online, while the task writes both
+// tables with schema 'typed' and dual_write_table: the rows missing from
+// dual_write_table are copied batchSize at a time, converting their
+// value_column into the typed columns, and progress is called with the
+// rows copied so far after every batch. With finalize, the rows written
+// meanwhile are then copied with both tables locked against writes and
+// the two tables swap their names and indexes in the same transaction, so
+// table_name holds the typed rows. The number of rows copied is returned
+func Migrate(config plugin.Config, batchSize int, finalize bool, progress func(int64)) (int64, error) {
+	cfg, err := newPublisherConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.Schema.Layout != schemaTyped || cfg.Write.DualWriteTable == "" {
+		return 0, fmt.Errorf("migrate requires schema '%s' and dual_write_table", schemaTyped)
+	}
+	// the partitions of the new table are only created by publishes
+	if cfg.Schema.TimePartitioning != "" {
+		return 0, fmt.Errorf("migrate cannot be combined with time_partitioning")
+	}
+	if batchSize < 1 {
+		return 0, fmt.Errorf("Invalid batch size %d (expected 1 or more)", batchSize)
+	}
+	// a migration takes as long as the table is large, publish_timeout
+	// does not apply
+	ctx := context.Background()
+	db, err := getPostgreSQLConn(ctx, cfg.Connection)
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return migrateTable(ctx, db, cfg.Schema, cfg.dualWriteSchema(), batchSize, finalize, progress)
+}
+
+// migrateTable copies the rows of live missing from target, batchSize at
+// a time, and with finalize swaps the tables, as described for Migrate
+func migrateTable(ctx context.Context, db *sql.DB, live, target SchemaConfig, batchSize int, finalize bool, progress func(int64)) (int64, error) {
+	// the legacy table gets the typed columns the copy reads
+	if err := upgradeTable(ctx, db, live); err != nil {
+		return 0, err
+	}
+	if _, err := createTable(ctx, db, target); err != nil {
+		return 0, err
+	}
+	// later rows are dual written, or copied by the finalize
+	var last int64
+	if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(max(id), 0) FROM %s", live.quotedTable())).Scan(&last); err != nil {
+		return 0, err
+	}
+	var copied, from int64
+	for from < last {
+		var to sql.NullInt64
+		query := fmt.Sprintf("SELECT max(id) FROM (SELECT id FROM %s WHERE id > $1 AND id <= $2 ORDER BY id LIMIT $3) batch", live.quotedTable())
+		if err := db.QueryRowContext(ctx, query, from, last, batchSize).Scan(&to); err != nil {
+			return copied, err
+		}
+		if !to.Valid {
+			break
+		}
+		n, err := copyLegacyRows(ctx, db, live, target, from, to.Int64)
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+		from = to.Int64
+		progress(copied)
+	}
+	if !finalize {
+		return copied, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return copied, err
+	}
+	// publishes wait for the swap, and then write to the swapped tables
+	query := fmt.Sprintf("LOCK TABLE %s, %s IN SHARE ROW EXCLUSIVE MODE", live.quotedTable(), target.quotedTable())
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		tx.Rollback()
+		return copied, err
+	}
+	n, err := copyLegacyRows(ctx, tx, live, target, last, math.MaxInt64)
+	if err != nil {
+		tx.Rollback()
+		return copied, err
+	}
+	copied += n
+	for _, query := range swapQueries(live, target) {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			tx.Rollback()
+			return copied, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return copied, err
+	}
+	progress(copied)
+	return copied, nil
+}
+
+// copyLegacyRows copies the rows of live with an id in (from, to] that
+// target does not hold yet, by key, time and tags, and returns the number
+// copied
+func copyLegacyRows(ctx context.Context, db execer, live, target SchemaConfig, from, to int64) (int64, error) {
+	columns := "time_posted, key_column, value_int, value_float, value_string, value_bool, tags"
+	values := "o.time_posted, o.key_column, " + legacyValues[0] + ", " + legacyValues[1] + ", " + legacyValues[2] + ", " + legacyValues[3] + ", o.tags"
+	for _, column := range migratedColumns(target) {
+		columns += ", " + column
+		values += ", o." + column
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s o WHERE o.id > $1 AND o.id <= $2 AND NOT EXISTS "+
+		"(SELECT 1 FROM %s n WHERE n.key_column = o.key_column AND n.time_posted = o.time_posted AND n.tags IS NOT DISTINCT FROM o.tags)",
+		target.quotedTable(), columns, values, live.quotedTable(), target.quotedTable())
+	// rows the legacy table holds twice
+	if target.Dedupe != "" {
+		query += " ON CONFLICT DO NOTHING"
+	}
+	result, err := db.ExecContext(ctx, query, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// migratedColumns returns the optional columns of schema copied as they
+// are; upgradeTable added them to the legacy table
+func migratedColumns(schema SchemaConfig) []string {
+	var columns []string
+	if schema.jsonValues() {
+		columns = append(columns, "value_json")
+	}
+	if schema.Metadata {
+		columns = append(columns, "unit", "metric_version", "description")
+	}
+	if schema.BatchID {
+		columns = append(columns, "batch_id")
+	}
+	if schema.TimeBucket != "" {
+		columns = append(columns, "time_bucket")
+	}
+	if schema.InsertedAt {
+		columns = append(columns, "inserted_at")
+	}
+	if schema.ArchiveRaw {
+		columns = append(columns, "raw_payload")
+	}
+	return columns
+}
+
+// swapQueries returns the statements swapping the names of the tables of
+// a and b, and of their indexes
+func swapQueries(a, b SchemaConfig) []string {
+	swap := suffixedName(a.TableName, "_swap")
+	queries := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", a.quotedTable(), pq.QuoteIdentifier(swap)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", b.quotedTable(), pq.QuoteIdentifier(a.TableName)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", a.qualify(swap), pq.QuoteIdentifier(b.TableName)),
+	}
+	// CockroachDB names indexes per table, they cannot collide
+	if a.Dialect == dialectCockroachDB {
+		return queries
+	}
+	for _, kind := range indexKinds {
+		queries = append(queries,
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", a.qualify(indexName(a.TableName, kind)), pq.QuoteIdentifier(indexName(swap, kind))),
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", a.qualify(indexName(b.TableName, kind)), pq.QuoteIdentifier(indexName(a.TableName, kind))),
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", a.qualify(indexName(swap, kind)), pq.QuoteIdentifier(indexName(b.TableName, kind))))
+	}
+	return queries
+}
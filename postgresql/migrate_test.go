@@ -0,0 +1,106 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMigrate(t *testing.T) {
+	Convey("TestMigrate", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		live := SchemaConfig{TableName: "info", Layout: schemaTyped}
+		target := SchemaConfig{TableName: "info_typed", Layout: schemaTyped}
+		var progress []int64
+		report := func(copied int64) { progress = append(progress, copied) }
+
+		expectTagsUpgrade(mock)
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS value_int (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info_typed\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_typed_key_index\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_typed_tags_index\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("^SELECT COALESCE\\(max\\(id\\), 0\\) FROM \"info\"$").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(5))
+		batchEnd := "^SELECT max\\(id\\) FROM \\(SELECT id FROM \"info\" WHERE id > \\$1 AND id <= \\$2 ORDER BY id LIMIT \\$3\\) batch$"
+		copyRows := "^INSERT INTO \"info_typed\" \\(time_posted, key_column, value_int, value_float, value_string, value_bool, tags\\) " +
+			"SELECT o.time_posted, o.key_column, COALESCE\\(o.value_int, (.+), o.tags FROM \"info\" o WHERE o.id > \\$1 AND o.id <= \\$2 AND NOT EXISTS (.+)$"
+		mock.ExpectQuery(batchEnd).WithArgs(0, 5, 3).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(3))
+		mock.ExpectExec(copyRows).WithArgs(0, 3).WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectQuery(batchEnd).WithArgs(3, 5, 3).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(5))
+		// a row was dual written already
+		mock.ExpectExec(copyRows).WithArgs(3, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		Convey("copies the rows batch by batch", func() {
+			copied, err := migrateTable(context.Background(), db, live, target, 3, false, report)
+			So(err, ShouldBeNil)
+			So(copied, ShouldEqual, 4)
+			So(progress, ShouldResemble, []int64{3, 4})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("copies the rows written meanwhile and swaps the tables when finalizing", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^LOCK TABLE \"info\", \"info_typed\" IN SHARE ROW EXCLUSIVE MODE$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(copyRows).WithArgs(5, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec("^ALTER TABLE \"info\" RENAME TO \"info_swap\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info_typed\" RENAME TO \"info\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info_swap\" RENAME TO \"info_typed\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			for _, kind := range indexKinds {
+				mock.ExpectExec("^ALTER INDEX IF EXISTS \"info_" + kind + "_index\" RENAME TO \"info_swap_" + kind + "_index\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("^ALTER INDEX IF EXISTS \"info_typed_" + kind + "_index\" RENAME TO \"info_" + kind + "_index\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("^ALTER INDEX IF EXISTS \"info_swap_" + kind + "_index\" RENAME TO \"info_typed_" + kind + "_index\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectCommit()
+			copied, err := migrateTable(context.Background(), db, live, target, 3, true, report)
+			So(err, ShouldBeNil)
+			So(copied, ShouldEqual, 6)
+			So(progress, ShouldResemble, []int64{3, 4, 6})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLegacyPatterns(t *testing.T) {
+	Convey("TestLegacyPatterns", t, func() {
+		ints := regexp.MustCompile(legacyIntPattern)
+		floats := regexp.MustCompile(legacyFloatPattern)
+		for _, data := range []interface{}{-42, int64(123456789012345678)} {
+			value, _ := interfaceToString(data)
+			So(ints.MatchString(value), ShouldBeTrue)
+		}
+		for _, data := range []interface{}{1.5, -2.25e-7, 1e21, math.NaN(), math.Inf(1), math.Inf(-1), uint64(math.MaxUint64)} {
+			value, _ := interfaceToString(data)
+			So(ints.MatchString(value), ShouldBeFalse)
+			So(floats.MatchString(value), ShouldBeTrue)
+		}
+		for _, value := range []string{"true", "abc", "1.2.3", "[1 2]", ""} {
+			So(floats.MatchString(value), ShouldBeFalse)
+		}
+	})
+}
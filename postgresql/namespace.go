@@ -0,0 +1,78 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"container/list"
+	"sync"
+)
+
+// namespaceCacheSize is the number of joined namespaces kept by the publisher
+const namespaceCacheSize = 4096
+
+// namespaceCache is a small LRU cache of joined namespaces, so metrics
+// that are published on every interval do not allocate a new key each time
+type namespaceCache struct {
+	mutex   sync.Mutex
+	size    int
+	buf     []byte
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newNamespaceCache(size int) *namespaceCache {
+	return &namespaceCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// join returns the namespace joined with dots, as sliceToNamespace does
+func (c *namespaceCache) join(ns []string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.buf = appendNamespace(c.buf[:0], ns)
+	// lookup with string(c.buf) does not allocate
+	if e, ok := c.entries[string(c.buf)]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(string)
+	}
+
+	key := string(c.buf)
+	c.entries[key] = c.lru.PushFront(key)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+	return key
+}
+
+func appendNamespace(buf []byte, ns []string) []byte {
+	for i, elem := range ns {
+		if i > 0 {
+			buf = append(buf, '.')
+		}
+		buf = append(buf, elem...)
+	}
+	return buf
+}
@@ -0,0 +1,60 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNamespaceCache(t *testing.T) {
+	Convey("TestNamespaceCache", t, func() {
+		cache := newNamespaceCache(2)
+
+		Convey("Joined namespaces match sliceToNamespace", func() {
+			ns := []string{"intel", "os", "vmstat"}
+			So(cache.join(ns), ShouldEqual, sliceToNamespace(ns))
+			So(cache.join(ns), ShouldEqual, "intel.os.vmstat")
+			So(cache.lru.Len(), ShouldEqual, 1)
+		})
+
+		Convey("Least recently used namespaces are evicted", func() {
+			cache.join([]string{"a"})
+			cache.join([]string{"b"})
+			cache.join([]string{"a"})
+			cache.join([]string{"c"})
+			So(cache.lru.Len(), ShouldEqual, 2)
+			So(cache.entries, ShouldContainKey, "a")
+			So(cache.entries, ShouldContainKey, "c")
+			So(cache.entries, ShouldNotContainKey, "b")
+		})
+	})
+}
+
+func BenchmarkNamespaceCache(b *testing.B) {
+	cache := newNamespaceCache(namespaceCacheSize)
+	ns := []string{"intel", "psutil", "load", "load1"}
+	for i := 0; i < b.N; i++ {
+		cache.join(ns)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	partitionDay   = "day"
+	partitionMonth = "month"
+)
+
+// partitionFormats are the suffixes of the partition names, which also
+// give the start of the period each partition holds
+var partitionFormats = map[string]string{
+	partitionDay:   "20060102",
+	partitionMonth: "200601",
+}
+
+// partitionStart returns the start of the period holding t, in UTC
+func partitionStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == partitionMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// partitionEnd returns the end of the period starting at start
+func partitionEnd(period string, start time.Time) time.Time {
+	if period == partitionMonth {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// partitionName returns the name of the partition of schema holding t,
+// failing when PostgreSQL would truncate it
+func partitionName(schema SchemaConfig, t time.Time) (string, error) {
+	name := schema.TableName + "_" + partitionStart(schema.TimePartitioning, t).Format(partitionFormats[schema.TimePartitioning])
+	if len(name) > maxIdentifierLength {
+		return "", fmt.Errorf("Table name %s is too long for time_partitioning, partition names must be at most %d bytes long", schema.TableName, maxIdentifierLength)
+	}
+	return name, nil
+}
+
+// partitionQuery returns the statement creating the partition of schema
+// holding t
+func partitionQuery(schema SchemaConfig, t time.Time) (string, error) {
+	name, err := partitionName(schema, t)
+	if err != nil {
+		return "", err
+	}
+	start := partitionStart(schema.TimePartitioning, t)
+	end := partitionEnd(schema.TimePartitioning, start)
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		schema.qualify(name), schema.quotedTable(),
+		start.Format(time.RFC3339), end.Format(time.RFC3339)), nil
+}
+
+// preparePartitions creates the partitions of schema the rows go to, each
+// once for every prepared table; timePosted of the rows is in layout. The rows are
+// parsed before s.mutex is taken, so publishes only wait on each other
+// for the partitions to create
+func (s *PostgreSQLPublisher) preparePartitions(ctx context.Context, db *sql.DB, prepared *preparedTable, schema SchemaConfig, rows []row, layout string) error {
+	if schema.TimePartitioning == "" {
+		return nil
+	}
+	var (
+		names []string
+		times = make(map[string]time.Time)
+	)
+	for _, r := range rows {
+		t, err := time.Parse(layout, r.timePosted)
+		if err != nil {
+			return err
+		}
+		name, err := partitionName(schema, t)
+		if err != nil {
+			return err
+		}
+		if _, ok := times[name]; !ok {
+			names = append(names, name)
+			times[name] = t
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range names {
+		if prepared.partitions[name] {
+			continue
+		}
+		query, err := partitionQuery(schema, times[name])
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+		if prepared.partitions == nil {
+			prepared.partitions = make(map[string]bool)
+		}
+		prepared.partitions[name] = true
+	}
+	return nil
+}
+
+// dropExpiredPartitions drops the partitions of schema whose period ended
+// more than retentionDays ago
+func dropExpiredPartitions(db *sql.DB, schema SchemaConfig, retentionDays int) error {
+	logger := newLogger()
+	rows, err := db.Query("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass",
+		schema.quotedTable())
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cutoff := timeNow().AddDate(0, 0, -retentionDays)
+	prefix := schema.TableName + "_"
+	for _, name := range names {
+		// partitions not named by this publisher are left alone
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		start, err := time.Parse(partitionFormats[schema.TimePartitioning], name[len(prefix):])
+		if err != nil || partitionEnd(schema.TimePartitioning, start).After(cutoff) {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", schema.qualify(name))); err != nil {
+			return err
+		}
+		logger.Infof("Dropped expired partition %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTimePartitions(t *testing.T) {
+	Convey("TestTimePartitions", t, func() {
+		schema := SchemaConfig{TableName: "info", TimePartitioning: partitionDay}
+		at := time.Date(2017, 1, 31, 23, 30, 0, 0, time.FixedZone("CET", 3600))
+
+		Convey("Partitions hold a day or a month in UTC", func() {
+			query, err := partitionQuery(schema, at)
+			So(err, ShouldBeNil)
+			So(query, ShouldEqual, "CREATE TABLE IF NOT EXISTS \"info_20170131\" PARTITION OF \"info\" "+
+				"FOR VALUES FROM ('2017-01-31T00:00:00Z') TO ('2017-02-01T00:00:00Z')")
+
+			schema.TimePartitioning = partitionMonth
+			query, err = partitionQuery(schema, at)
+			So(err, ShouldBeNil)
+			So(query, ShouldEqual, "CREATE TABLE IF NOT EXISTS \"info_201701\" PARTITION OF \"info\" "+
+				"FOR VALUES FROM ('2017-01-01T00:00:00Z') TO ('2017-02-01T00:00:00Z')")
+		})
+
+		Convey("Partition names must not be truncated", func() {
+			schema.TableName = strings.Repeat("x", 60)
+			_, err := partitionName(schema, at)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The parent table is partitioned by range of time_posted", func() {
+			So(tableColumns(schema), ShouldContainSubstring, "PRIMARY KEY (id, time_posted)")
+		})
+
+		Convey("Missing partitions are created once", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			sp := NewPostgreSQLPublisher()
+			prepared := &preparedTable{}
+			rows := []row{
+				{timePosted: "2017-01-31T22:30:00Z"},
+				{timePosted: "2017-02-01T00:30:00Z"},
+				{timePosted: "2017-01-31T23:30:00Z"},
+			}
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info_20170131\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info_20170201\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(sp.preparePartitions(context.Background(), db, prepared, schema, rows, time.RFC3339), ShouldBeNil)
+			So(sp.preparePartitions(context.Background(), db, prepared, schema, rows, time.RFC3339), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Expired partitions are dropped", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			timeNow = func() time.Time { return time.Date(2017, 2, 10, 12, 0, 0, 0, time.UTC) }
+			defer func() { timeNow = time.Now }()
+
+			mock.ExpectQuery("^SELECT c.relname FROM pg_inherits (.+)$").WithArgs(`"info"`).
+				WillReturnRows(sqlmock.NewRows([]string{"relname"}).
+					AddRow("info_20170201").AddRow("info_20170202").AddRow("info_20170203").AddRow("info_archive"))
+			mock.ExpectExec("^DROP TABLE IF EXISTS \"info_20170201\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^DROP TABLE IF EXISTS \"info_20170202\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(dropExpiredPartitions(db, schema, 7), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
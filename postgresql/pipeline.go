@@ -0,0 +1,96 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import "context"
+
+// pipeline writes the chunks of a publish in the background while the
+// publish converts its remaining metrics
+type pipeline struct {
+	chunks chan tableBatch
+	// failed is closed when a chunk could not be written, done once the
+	// writer returned
+	failed chan struct{}
+	done   chan struct{}
+
+	// err and skipped are set by the writer and read after done
+	err     error
+	skipped metricErrors
+}
+
+// startPipeline starts the writer of the chunks of a publish with cfg; a
+// chunk is converted while the previous one is inserted
+func (s *PostgreSQLPublisher) startPipeline(ctx context.Context, cfg *publisherConfig) *pipeline {
+	p := &pipeline{
+		chunks: make(chan tableBatch, 1),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		for chunk := range p.chunks {
+			if p.err != nil {
+				continue
+			}
+			err := s.writeBatches(ctx, cfg, []tableBatch{chunk})
+			if errs, ok := err.(metricErrors); ok {
+				p.skipped = append(p.skipped, errs...)
+			} else if err != nil {
+				p.err = err
+				close(p.failed)
+			}
+		}
+	}()
+	return p
+}
+
+// send hands the batches holding size rows or more to the writer and
+// returns the others; ok is false once a chunk failed
+func (p *pipeline) send(batches []tableBatch, size int) (rest []tableBatch, ok bool) {
+	rest = batches[:0]
+	for _, batch := range batches {
+		if len(batch.rows) < size {
+			rest = append(rest, batch)
+			continue
+		}
+		select {
+		case p.chunks <- batch:
+		case <-p.failed:
+			return rest, false
+		}
+	}
+	return rest, true
+}
+
+// finish hands the remaining batches to the writer, waits until all
+// chunks were written and returns the error of the chunk that failed, or
+// the metrics skipped by error_policy=skip as metricErrors
+func (p *pipeline) finish(batches []tableBatch) error {
+	p.send(batches, 0)
+	close(p.chunks)
+	<-p.done
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.skipped) > 0 {
+		return p.skipped
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPipeline(t *testing.T) {
+	Convey("TestPipeline", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["pipeline"] = true
+		config["batch_size"] = int64(2)
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 2},
+			{Namespace: plugin.NewNamespace("baz"), Timestamp: time.Now(), Data: 3},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("Every batch_size metrics are written in a transaction of their own", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "baz", "3", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("A failed chunk fails the publish and stops the writer", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(errors.New("permission denied"))
+			mock.ExpectRollback()
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+
+	Convey("pipeline cannot be combined with async", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["pipeline"] = true
+		config["async"] = true
+		_, err := newPublisherConfig(config)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -20,178 +20,789 @@ limitations under the License.
 package postgresql
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"database/sql"
 
-	"github.com/intelsdi-x/snap/control/plugin"
-	"github.com/intelsdi-x/snap/control/plugin/cpolicy"
-	"github.com/intelsdi-x/snap/core/ctypes"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
 	// Import of postgresql library
 	_ "github.com/lib/pq"
 )
 
 const (
-	name         = "postgresql"
-	version      = 9
-	pluginType   = plugin.PublisherPluginType
-	tableColumns = "(id SERIAL PRIMARY KEY, time_posted timestamp with time zone, key_column VARCHAR(200), value_column VARCHAR(200))"
-	timeFormat   = time.RFC3339
+	// Name of the plugin
+	Name = "postgresql"
+	// Version of the plugin
+	Version = 10
 )
 
 // PostgreSQLPublisher struct
 type PostgreSQLPublisher struct {
+	// servers keeps the connections of each connection options open
+	// between publishes, until no publish used them for idleTimeout
+	mutex   sync.Mutex
+	servers map[ConnectionConfig]*balancer
+	configs configCache
+	// prepared holds the table set up for each config
+	prepared map[*publisherConfig]*preparedTable
+
+	// writeMutex makes publishes a single writer in strict ordering
+	writeMutex sync.Mutex
+
+	namespaces *namespaceCache
+
+	// spoolMutex keeps concurrent publishes from draining the same batch
+	spoolMutex sync.Mutex
+	// replays holds the replay of each spool directory, closed once it
+	// finished
+	replays map[string]chan struct{}
+
+	// queues take the batches of async publishes, one for each async
+	// options
+	queues map[AsyncConfig]*asyncQueue
+
+	stats     *stats
+	reporters map[StatsConfig]*statsReporter
+
+	// verifyMutex serializes the replica verifications and guards the
+	// connection to the replica of replicaURI
+	verifyMutex sync.Mutex
+	replica     *sql.DB
+	replicaURI  string
+	// verifyTimers are the verifications waiting for their delay, guarded
+	// by mutex and stopped by Drain
+	verifyTimers map[*time.Timer]struct{}
+
+	// draining is set by Drain; inflight counts the publishes in progress
+	// and the async queues being closed
+	draining bool
+	inflight sync.WaitGroup
+}
+
+// idleTimeout is how long the connections, prepared tables, async queues
+// and stats reporters of options no publish used are kept
+var idleTimeout = 10 * time.Minute
+
+// preparedTable is the state of a config whose table is set up
+type preparedTable struct {
+	// routed holds the tables prepared for table_routing
+	routed map[string]bool
+	// partitions holds the time partitions created
+	partitions  map[string]bool
+	maintenance *maintenance
+	used        time.Time
 }
 
 // NewPostgreSQLPublisher return new PostgreSQL instance
 func NewPostgreSQLPublisher() *PostgreSQLPublisher {
-	return &PostgreSQLPublisher{}
+	return &PostgreSQLPublisher{
+		namespaces: newNamespaceCache(namespaceCacheSize),
+		stats:      newStats(),
+	}
 }
 
 // Publish sends data to PostgreSQL server
-func (s *PostgreSQLPublisher) Publish(contentType string, content []byte, config map[string]ctypes.ConfigValue) error {
-	logger := log.New()
-	logger.Println("Publishing started")
-	var metrics []plugin.MetricType
-
-	switch contentType {
-	case plugin.SnapGOBContentType:
-		dec := gob.NewDecoder(bytes.NewBuffer(content))
-		if err := dec.Decode(&metrics); err != nil {
-			logger.Printf("Error decoding: error=%v content=%v", err, content)
-			return err
-		}
-	default:
-		logger.Printf("Error unknown content type '%v'", contentType)
-		return fmt.Errorf("Unknown content type '%s'", contentType)
+func (s *PostgreSQLPublisher) Publish(metrics []plugin.Metric, config plugin.Config) error {
+	if err := s.begin(); err != nil {
+		newLogger().Error(err)
+		return err
+	}
+	defer s.inflight.Done()
+	s.stats.publish()
+
+	cfg, err := s.configs.get(config)
+	if err != nil {
+		newLogger().Error(err)
+		s.stats.fail(failureConfig)
+		return err
+	}
+	s.closeIdle()
+	logger := cfg.Log.logger()
+	// payloads are large and configs hold credentials
+	logger.WithField("config", redactConfig(config)).Debugf("Publishing %v", metrics)
+	// a stats endpoint that cannot listen does not fail the publish
+	if err := s.reportStats(cfg.Stats); err != nil {
+		logger.Error(err)
+	}
+	ctx, cancel := publishContext(cfg)
+	defer cancel()
+	s.warmUp(ctx, cfg)
+	s.replaySpool(ctx, cfg)
+
+	if cfg.Write.Ordering == orderingStrict {
+		s.writeMutex.Lock()
+		defer s.writeMutex.Unlock()
 	}
 
-	logger.Printf("publishing %v to %v", metrics, config)
+	if cfg.Write.SortByTimestamp {
+		sort.Stable(byTimestamp(metrics))
+	}
 
-	tableName := config["table_name"].(ctypes.ConfigValueStr).Value
+	nowTime := time.Now().Format(cfg.Write.TimeFormat)
+	var (
+		batches  []tableBatch
+		skipped  metricErrors
+		filtered int
+		pipe     *pipeline
+	)
+	if cfg.Write.Pipeline {
+		pipe = s.startPipeline(ctx, cfg)
+	}
+	for _, m := range metrics {
+		ns := m.Namespace.Strings()
+		r := row{timePosted: nowTime, key: s.namespaces.join(ns), data: m.Data}
+		if !cfg.Namespace.keep(r.key) {
+			filtered++
+			continue
+		}
+		if cfg.Namespace.transforms() {
+			ns = cfg.Namespace.transform(ns)
+			r.key = s.namespaces.join(ns)
+		}
+		table, err := s.fillRow(cfg, m, ns, &r)
+		if err != nil {
+			logger.Error(err)
+			if cfg.Write.ErrorPolicy != errorPolicySkip {
+				if pipe != nil {
+					pipe.finish(nil)
+				}
+				return err
+			}
+			skipped = append(skipped, metricError{key: r.key, err: err})
+			s.stats.fail(failureData)
+			continue
+		}
+		batches = appendToBatch(batches, table, r)
+		if pipe != nil {
+			var ok bool
+			if batches, ok = pipe.send(batches, cfg.Write.BatchSize); !ok {
+				break
+			}
+		}
+	}
+	if filtered > 0 {
+		logger.Infof("Filtered out %d of %d metrics by namespace", filtered, len(metrics))
+		s.stats.filter(filtered)
+	}
 
-	// Open connection and ping to make sure it works
-	db, err := getPostgreSQLConn(config)
+	switch {
+	case cfg.Async.Enabled:
+		s.enqueue(cfg, batches)
+	case pipe != nil:
+		err = pipe.finish(batches)
+	default:
+		err = s.writeBatches(ctx, cfg, batches)
+	}
 	if err != nil {
-		logger.Printf("Error: %v", err)
+		errs, ok := err.(metricErrors)
+		if !ok {
+			return err
+		}
+		skipped = append(skipped, errs...)
+	}
+	if len(skipped) > 0 {
+		return skipped
+	}
+	return nil
+}
+
+// warmUp connects to the database and prepares the table the first time
+// cfg is seen, before any metric is converted, so a misconfiguration is
+// reported at once and the first batch does not wait for the connection;
+// failures are only logged, the write retries or spools as usual
+func (s *PostgreSQLPublisher) warmUp(ctx context.Context, cfg *publisherConfig) {
+	s.mutex.Lock()
+	_, prepared := s.prepared[cfg]
+	s.mutex.Unlock()
+	if prepared {
+		return
+	}
+	err := s.attempt(ctx, cfg, func(db *sql.DB) error {
+		_, err := s.prepareTable(ctx, db, cfg)
 		return err
+	})
+	if err != nil {
+		cfg.Log.logger().Errorf("Warm-up failed: %v", err)
 	}
+}
 
-	defer db.Close()
+// fillRow fills the value, tags, raw payload and metadata of the row of
+// m and returns the table it goes to, routed by the namespace ns it is
+// written with
+func (s *PostgreSQLPublisher) fillRow(cfg *publisherConfig, m plugin.Metric, ns []string, r *row) (string, error) {
+	var err error
+	if cfg.Write.UseMetricTimestamp && !m.Timestamp.IsZero() {
+		r.timePosted = m.Timestamp.Format(cfg.Write.TimeFormat)
+	}
+	if r.value, r.json, err = valueSerializers[cfg.Schema.ValueSerializer](m.Data); err != nil {
+		return "", err
+	}
+	if r.tags, err = tagsToJSON(m.Tags); err != nil {
+		return "", err
+	}
+	if cfg.Schema.ArchiveRaw {
+		if r.raw, err = encodeRaw(m); err != nil {
+			return "", err
+		}
+	}
+	if cfg.Schema.Metadata {
+		r.unit, r.version, r.description = m.Unit, m.Version, m.Description
+	}
+	return routeTable(cfg.Write.TableRouting, ns, r.key, cfg.Schema.TableName)
+}
 
-	nowTime := time.Now().Format(timeFormat)
-	var key, value string
-	for _, m := range metrics {
-		key = sliceToNamespace(m.Namespace().Strings())
-		value, err = interfaceToString(m.Data())
+// writeBatches writes the batches of a publish, spooling those failing on
+// a transient error when a spool is configured, and drains the spool once
+// all were written; the metrics skipped by error_policy=skip are returned
+// as metricErrors
+func (s *PostgreSQLPublisher) writeBatches(ctx context.Context, cfg *publisherConfig, batches []tableBatch) error {
+	spooled := false
+	var skipped metricErrors
+	for _, batch := range batches {
+		start := time.Now()
+		err := s.write(ctx, cfg, batch.table, batch.rows)
+		logger := cfg.Log.logger().WithFields(log.Fields{
+			"table":    batch.table,
+			"rows":     len(batch.rows),
+			"duration": time.Since(start),
+		})
 		if err == nil {
-			query := fmt.Sprintf("INSERT INTO %s (id, time_posted, key_column, value_column) VALUES (DEFAULT, '%s', '%s', '%s')", tableName, nowTime, key, value)
-			_, err := db.Exec(query)
-			if err != nil {
-				errMsg := fmt.Sprintf("pq: relation \"%s\" does not exist", tableName)
-				if err.Error() == errMsg {
-					_, err = createTable(db, tableName)
-					if err != nil {
-						logger.Printf("Error: %v", err)
-						return err
-					}
+			logger.Info("Published")
+			continue
+		}
+		if errs, ok := err.(metricErrors); ok {
+			skipped = append(skipped, errs...)
+			continue
+		}
+		// batches the database could not take are kept on disk until
+		// it is reachable again
+		if cfg.Spool.Dir != "" && isTransient(err) {
+			serr := newSpool(cfg.Spool).write(batch.table, batch.rows)
+			if serr == nil {
+				logger.Warnf("%v, spooled %d metrics to %s", err, len(batch.rows), cfg.Spool.Dir)
+				s.stats.spool()
+				spooled = true
+				continue
+			}
+			if _, full := serr.(spoolFullError); full && cfg.Async.DropWhenFull {
+				logger.Warnf("%v, %v, dropped %d metrics", err, serr, len(batch.rows))
+				s.stats.drop(len(batch.rows))
+				spooled = true
+				continue
+			}
+			logger.Error(serr)
+		}
+		logger.Error(err)
+		s.stats.fail(failureCategory(err))
+		return err
+	}
+	if cfg.Spool.Dir != "" && !spooled {
+		s.drainSpool(ctx, cfg)
+	}
+	if len(skipped) > 0 {
+		return skipped
+	}
+	return nil
+}
 
-				}
-				logger.Printf("Error: %v", err)
+// publishContext returns the context the connections and statements of a
+// publish run in, logging with the logger of the task of cfg and cancelled
+// after the publish_timeout of cfg if set
+func publishContext(cfg *publisherConfig) (context.Context, context.CancelFunc) {
+	ctx := withLogConfig(context.Background(), cfg.Log)
+	if cfg.Write.PublishTimeout > 0 {
+		return context.WithTimeout(ctx, cfg.Write.PublishTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// tableBatch holds the rows of a publish going to one table
+type tableBatch struct {
+	table string
+	rows  []row
+}
+
+// appendToBatch appends r to the batch of table, keeping the batches in
+// the order their first metric was published
+func appendToBatch(batches []tableBatch, table string, r row) []tableBatch {
+	for i := range batches {
+		if batches[i].table == table {
+			batches[i].rows = append(batches[i].rows, r)
+			return batches
+		}
+	}
+	return append(batches, tableBatch{table: table, rows: []row{r}})
+}
+
+// write inserts rows into table, created with the schema options of cfg
+// if missing, retrying on transient errors; rows of table_name are also
+// written to the dual write table. With error_policy=skip the rows
+// rejected with a data error are skipped and returned as metricErrors
+func (s *PostgreSQLPublisher) write(ctx context.Context, cfg *publisherConfig, table string, rows []row) error {
+	schema := cfg.Schema
+	schema.TableName = table
+	var batchID string
+	if schema.BatchID {
+		// rows of a drained batch get the id of their new write
+		batchID = newBatchID()
+		for i := range rows {
+			rows[i].batch = batchID
+		}
+	}
+	start := time.Now()
+	var skipped metricErrors
+	err := s.withRetry(ctx, cfg, func(db *sql.DB) error {
+		skipped = nil
+		prepared, err := s.prepareTable(ctx, db, cfg)
+		if err != nil {
+			return err
+		}
+		if table != cfg.Schema.TableName {
+			if err := s.prepareRoute(ctx, db, prepared, schema); err != nil {
 				return err
 			}
-		} else {
-			logger.Printf("Error: %v", err)
+		}
+		if err := s.preparePartitions(ctx, db, prepared, schema, rows, cfg.Write.TimeFormat); err != nil {
 			return err
 		}
+		written := rows
+		if err := writeRows(ctx, db, schema, rows, cfg.Write); err != nil {
+			if cfg.Write.ErrorPolicy != errorPolicySkip || !isDataError(err) {
+				return err
+			}
+			if written, skipped, err = insertEach(ctx, db, schema, rows); err != nil {
+				return err
+			}
+		}
+		// failures of the dual write are only logged
+		if cfg.Write.DualWriteTable != "" && table == cfg.Schema.TableName {
+			dual := cfg.dualWriteSchema()
+			err := s.preparePartitions(ctx, db, prepared, dual, written, cfg.Write.TimeFormat)
+			if err == nil {
+				err = writeRows(withoutCommitHook(ctx), db, dual, written, cfg.Write)
+			}
+			if err != nil {
+				cfg.Log.logger().Errorf("Dual write to %s failed: %v", cfg.Write.DualWriteTable, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.stats.write(len(rows)-len(skipped), time.Since(start))
+	if cfg.Verify.ReplicaURI != "" {
+		s.verifyLater(cfg, schema, batchID)
+	}
+	if len(skipped) > 0 {
+		logger := cfg.Log.logger()
+		for _, me := range skipped {
+			logger.Errorf("Skipped metric %s: %v", me.key, me.err)
+			s.stats.fail(failureData)
+		}
+		return skipped
 	}
 	return nil
 }
 
-// Meta returns plugin meta data info
-func Meta() *plugin.PluginMeta {
-	return plugin.NewPluginMeta(name, version, pluginType, []string{plugin.SnapGOBContentType}, []string{plugin.SnapGOBContentType})
+// byTimestamp sorts metrics by their collection timestamps
+type byTimestamp []plugin.Metric
+
+func (m byTimestamp) Len() int           { return len(m) }
+func (m byTimestamp) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byTimestamp) Less(i, j int) bool { return m[i].Timestamp.Before(m[j].Timestamp) }
+
+// tagsToJSON returns the JSON object of tags, empty when there are none
+func tagsToJSON(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(tags)
+	return string(b), err
 }
 
-func getPostgreSQLConn(config map[string]ctypes.ConfigValue) (*sql.DB, error) {
-	logger := log.New()
-	hostName := config["hostname"].(ctypes.ConfigValueStr).Value
-	port := config["port"].(ctypes.ConfigValueInt).Value
-	username := config["username"].(ctypes.ConfigValueStr).Value
-	password := config["password"].(ctypes.ConfigValueStr).Value
-	database := config["database"].(ctypes.ConfigValueStr).Value
-	conn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", hostName, port, username, password, database)
-	db, err := sql.Open("postgres", conn)
-	if err != nil {
-		logger.Printf("Error: %v", err)
-		return db, err
+// encodeRaw encodes m as a JSON batch of its own, so an archived row can
+// be replayed or parsed again
+func encodeRaw(m plugin.Metric) ([]byte, error) {
+	return json.Marshal([]plugin.Metric{m})
+}
+
+// prepareTable checks that the table can be written, adds the columns
+// enabled in cfg to an existing table and schedules its maintenance, once
+// per config, and returns the state of the table of cfg
+func (s *PostgreSQLPublisher) prepareTable(ctx context.Context, db *sql.DB, cfg *publisherConfig) (*preparedTable, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if prepared := s.prepared[cfg]; prepared != nil {
+		prepared.used = timeNow()
+		return prepared, nil
 	}
-	err = db.Ping()
-	if err != nil {
-		logger.Printf("Error: %v", err)
-		return db, err
+	if err := healthCheck(ctx, db, cfg.Schema); err != nil {
+		return nil, err
+	}
+	if err := createSchema(ctx, db, cfg.Schema); err != nil {
+		return nil, err
+	}
+	if err := upgradeTable(ctx, db, cfg.Schema); err != nil {
+		return nil, err
+	}
+	if cfg.Write.DualWriteTable != "" {
+		if err := upgradeTable(ctx, db, cfg.dualWriteSchema()); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Spool.Dir != "" {
+		if err := createSequenceTable(ctx, db, cfg.Schema); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Schema.DeadLetterTable != "" {
+		if err := createDeadLetterTable(ctx, db, cfg.Schema); err != nil {
+			return nil, err
+		}
+	}
+	prepared := &preparedTable{used: timeNow()}
+	if cfg.Maintenance.Schedule != "" {
+		m, err := startMaintenance(db, cfg.Schema, cfg.Maintenance)
+		if err != nil {
+			return nil, err
+		}
+		prepared.maintenance = m
+	}
+	if s.prepared == nil {
+		s.prepared = make(map[*publisherConfig]*preparedTable)
 	}
-	return db, err
+	s.prepared[cfg] = prepared
+	return prepared, nil
 }
 
-func createTable(db *sql.DB, tableName string) (bool, error) {
-	logger := log.New()
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", tableName, tableColumns)
-	_, err := db.Exec(query)
-	if err != nil {
-		logger.Printf("Error: %v", err)
-		return false, err
+// prepareRoute creates or upgrades a table metrics are routed to, once for
+// each prepared table
+func (s *PostgreSQLPublisher) prepareRoute(ctx context.Context, db *sql.DB, prepared *preparedTable, schema SchemaConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if prepared.routed[schema.TableName] {
+		return nil
 	}
-	query = fmt.Sprintf("CREATE INDEX key_index on %s (key_column)", tableName)
-	_, err = db.Exec(query)
-	if err != nil {
-		logger.Printf("Error: %v", err)
-		return false, err
+	if err := upgradeTable(ctx, db, schema); err != nil {
+		return err
 	}
-	return true, err
+	if _, err := createTable(ctx, db, schema); err != nil {
+		return err
+	}
+	if prepared.routed == nil {
+		prepared.routed = make(map[string]bool)
+	}
+	prepared.routed[schema.TableName] = true
+	return nil
 }
 
 // GetConfigPolicy returns a config policy
-func (s *PostgreSQLPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
-	cp := cpolicy.New()
-	config := cpolicy.NewPolicyNode()
+func (s *PostgreSQLPublisher) GetConfigPolicy() (plugin.ConfigPolicy, error) {
+	policy := plugin.NewConfigPolicy()
+	configKey := []string{""}
+
+	// the connection options have no defaults in the policy, so options
+	// left out of the task config can fall back to PG* variables
+
+	// username to login to the PostgreSQL server, PGUSER when not set
+	handleErr(policy.AddNewStringRule(configKey, "username", false))
+
+	// password to login to the PostgreSQL server; password_file or PGPASSWORD
+	// is used when not set
+	handleErr(policy.AddNewStringRule(configKey, "password", false))
+
+	// file holding the password, e.g. on a secrets mount, used when password
+	// is not set
+	handleErr(policy.AddNewStringRule(configKey, "password_file", false))
+
+	// the postgresql database that data will be pushed to, PGDATABASE when not
+	// set
+	handleErr(policy.AddNewStringRule(configKey, "database", false))
+
+	// schema the tables are created and written in, created if missing; named
+	// as table_name, the search path is used when not set
+	handleErr(policy.AddNewStringRule(configKey, "schema_name", false))
+
+	// the postgresql table within the database where information will be
+	// stored
+	handleErr(policy.AddNewStringRule(configKey, "table_name", true))
+
+	// the postgresql server ip or domain name, or a comma-separated list of
+	// host[:port] that publishes are spread across round-robin; PGHOST or
+	// localhost when not set
+	handleErr(policy.AddNewStringRule(configKey, "hostname", false))
+
+	// the postgresql server port number, PGPORT or 5432 when not set
+	handleErr(policy.AddNewIntRule(configKey, "port", false))
+
+	// postgres:// connection URI, e.g. from a secret store, replacing
+	// hostname, port, username, password and database
+	handleErr(policy.AddNewStringRule(configKey, "connection_uri", false))
+
+	// DNS SRV record (e.g. _postgresql._tcp.example.com) the server is
+	// resolved from, instead of hostname and port
+	handleErr(policy.AddNewStringRule(configKey, "srv_service", false))
+
+	// either 'strict' to write publishes one at a time in the order they
+	// arrive, or 'relaxed' to let them write in parallel
+	handleErr(policy.AddNewStringRule(configKey, "ordering", false, plugin.SetDefaultString(defaultOrdering)))
+
+	// either 'abort' to fail a publish on the first metric that cannot be
+	// written, or 'skip' to write the others and fail with the errors of the
+	// skipped ones
+	handleErr(policy.AddNewStringRule(configKey, "error_policy", false, plugin.SetDefaultString(errorPolicyAbort)))
+
+	// fill time_posted with the collection time of each metric; when false the
+	// time of the publish is used
+	handleErr(policy.AddNewBoolRule(configKey, "use_metric_timestamp", false, plugin.SetDefaultBool(true)))
+
+	// add an inserted_at column holding the time each row was written
+	handleErr(policy.AddNewBoolRule(configKey, "inserted_at_column", false, plugin.SetDefaultBool(false)))
+
+	// database the tables are created in: 'postgresql', 'cockroachdb' or
+	// 'aurora' for Amazon Aurora PostgreSQL
+	handleErr(policy.AddNewStringRule(configKey, "dialect", false, plugin.SetDefaultString(dialectPostgreSQL)))
+
+	// add unit, metric_version and description columns holding the metadata
+	// of each metric
+	handleErr(policy.AddNewBoolRule(configKey, "store_metadata", false, plugin.SetDefaultBool(false)))
+
+	// add a batch_id column holding the id of the batch each row was
+	// written with
+	handleErr(policy.AddNewBoolRule(configKey, "batch_id_column", false, plugin.SetDefaultBool(false)))
+
+	// postgres:// connection URI of a replica the rows of every batch are
+	// counted on after verify_delay, to detect rows lost by replication
+	handleErr(policy.AddNewStringRule(configKey, "verify_replica_uri", false))
+
+	// time (e.g. 1m) a batch is given to reach the replica before it is
+	// counted there
+	handleErr(policy.AddNewStringRule(configKey, "verify_delay", false, plugin.SetDefaultString(defaultVerifyDelay)))
+
+	// number of times a publish failing on a transient error (lost connection,
+	// serialization failure, deadlock) is retried
+	handleErr(policy.AddNewIntRule(configKey, "retry_count", false, plugin.SetDefaultInt(defaultRetryCount)))
+
+	// delay (e.g. 100ms) before the first retry, doubled for every further
+	// retry
+	handleErr(policy.AddNewStringRule(configKey, "retry_initial_delay", false, plugin.SetDefaultString(defaultRetryInitialDelay)))
+
+	// upper bound (e.g. 5s) of the delay between retries
+	handleErr(policy.AddNewStringRule(configKey, "retry_max_delay", false, plugin.SetDefaultString(defaultRetryMaxDelay)))
+
+	// directory batches are kept in while PostgreSQL is unreachable, written
+	// on the next successful publish; spooling is disabled when empty
+	handleErr(policy.AddNewStringRule(configKey, "spool_dir", false, plugin.SetDefaultString("")))
+
+	// maximum size of the spool directory in megabytes; publishes fail when it
+	// is full
+	handleErr(policy.AddNewIntRule(configKey, "spool_max_size", false, plugin.SetDefaultInt(defaultSpoolMaxSize)))
+
+	// gzip the batches written to the spool
+	handleErr(policy.AddNewBoolRule(configKey, "spool_compress", false, plugin.SetDefaultBool(false)))
+
+	// size in megabytes spool segments are sealed and a new one started at;
+	// every batch gets a segment of its own when 0
+	handleErr(policy.AddNewIntRule(configKey, "spool_segment_size", false, plugin.SetDefaultInt(0)))
+
+	// when the segments an earlier run left in the spool are replayed:
+	// 'before' the first publish proceeds, or in the 'background'
+	handleErr(policy.AddNewStringRule(configKey, "spool_replay", false, plugin.SetDefaultString(spoolReplayBefore)))
+
+	// semicolon separated pattern=table rules sending the metrics whose
+	// namespace matches pattern to table, which may contain {namespace[N]}
+	// placeholders
+	handleErr(policy.AddNewStringRule(configKey, "table_routing", false, plugin.SetDefaultString("")))
+
+	// return from publishes once their metrics are queued and write them in
+	// the background
+	handleErr(policy.AddNewBoolRule(configKey, "async", false, plugin.SetDefaultBool(false)))
+
+	// number of batches the async queue holds
+	handleErr(policy.AddNewIntRule(configKey, "queue_depth", false, plugin.SetDefaultInt(defaultQueueDepth)))
+
+	// number of background writers of the async queue
+	handleErr(policy.AddNewIntRule(configKey, "workers", false, plugin.SetDefaultInt(defaultWorkers)))
+
+	// longest time (e.g. 1s) queued metrics wait before they are written; they
+	// are written sooner once batch_size metrics are queued
+	handleErr(policy.AddNewStringRule(configKey, "flush_interval", false, plugin.SetDefaultString(defaultFlushInterval)))
+
+	// megabytes the rows of the async queue may take; not limited when 0
+	handleErr(policy.AddNewIntRule(configKey, "queue_max_size", false, plugin.SetDefaultInt(0)))
+
+	// what publishes do when the async queue is full: 'block' until there is
+	// room, or 'drop' the metrics; 'drop' also drops batches the full spool
+	// cannot take
+	handleErr(policy.AddNewStringRule(configKey, "queue_full", false, plugin.SetDefaultString(queueFullBlock)))
+
+	// address (e.g. :9187) the publisher serves its own metrics on at /metrics
+	// in the Prometheus text format
+	handleErr(policy.AddNewStringRule(configKey, "stats_listen", false))
+
+	// interval (e.g. 1m) the publisher logs its own metrics at
+	handleErr(policy.AddNewStringRule(configKey, "stats_log_interval", false))
+
+	// level of the messages logged: 'debug', 'info', 'warning' or 'error';
+	// metrics and the config, with credentials redacted, are only logged at
+	// 'debug'
+	handleErr(policy.AddNewStringRule(configKey, "log_level", false, plugin.SetDefaultString("info")))
+
+	// name of the task in the log fields, the table name when unset
+	handleErr(policy.AddNewStringRule(configKey, "task_name", false))
+
+	// maximum number of metrics inserted per statement; all metrics of a
+	// publish are written in one transaction
+	handleErr(policy.AddNewIntRule(configKey, "batch_size", false, plugin.SetDefaultInt(defaultBatchSize)))
+
+	// write every batch_size metrics of a table in a transaction of their
+	// own while the rest of the publish is converted
+	handleErr(policy.AddNewBoolRule(configKey, "pipeline", false, plugin.SetDefaultBool(false)))
 
-	username, err := cpolicy.NewStringRule("username", true)
-	handleErr(err)
-	username.Description = "Username to login to the PostgreSQL server"
+	// semicolon separated globs, or regular expressions enclosed in slashes,
+	// matched against the key; only the matching metrics are written
+	handleErr(policy.AddNewStringRule(configKey, "namespace_include", false))
 
-	password, err := cpolicy.NewStringRule("password", true)
-	handleErr(err)
-	password.Description = "Password to login to the PostgreSQL server"
+	// semicolon separated patterns like namespace_include; the matching
+	// metrics are not written
+	handleErr(policy.AddNewStringRule(configKey, "namespace_exclude", false))
 
-	database, err := cpolicy.NewStringRule("database", true)
-	handleErr(err)
-	database.Description = "The postgresql database that data will be pushed to"
+	// semicolon separated namespace prefixes, e.g. 'intel.psutil', removed
+	// from the namespaces starting with them
+	handleErr(policy.AddNewStringRule(configKey, "namespace_prefix_strip", false))
 
-	tableName, err := cpolicy.NewStringRule("table_name", true)
-	handleErr(err)
-	tableName.Description = "The postgresql table within the database where information will be stored"
+	// semicolon separated pattern=replacement rules rewriting the key with
+	// the first rule whose regular expression matches
+	handleErr(policy.AddNewStringRule(configKey, "namespace_rename", false))
 
-	hostName, err := cpolicy.NewStringRule("hostname", true, "localhost")
-	handleErr(err)
-	tableName.Description = "The postgresql server ip or domain name"
+	// either 'insert' to write rows with multi-row inserts, or 'copy' to
+	// stream them with COPY FROM STDIN, falling back to inserts when it fails
+	handleErr(policy.AddNewStringRule(configKey, "bulk_mode", false, plugin.SetDefaultString(bulkModeInsert)))
 
-	port, err := cpolicy.NewIntegerRule("port", true, 5432)
-	handleErr(err)
-	port.Description = "The postgresql server port number"
+	// format timestamps are sent in: RFC3339, RFC3339Milli, RFC3339Micro or
+	// RFC3339Nano
+	handleErr(policy.AddNewStringRule(configKey, "time_format", false, plugin.SetDefaultString(defaultTimeFormat)))
 
-	config.Add(username, password, database, tableName, hostName, port)
+	// SSL mode of the connection: disable, require, verify-ca or verify-full;
+	// PGSSLMODE or disable when not set
+	handleErr(policy.AddNewStringRule(configKey, "sslmode", false))
 
-	cp.Add([]string{""}, config)
-	return cp, nil
+	// path of the client certificate, together with sslkey
+	handleErr(policy.AddNewStringRule(configKey, "sslcert", false))
 
+	// path of the client certificate key, together with sslcert
+	handleErr(policy.AddNewStringRule(configKey, "sslkey", false))
+
+	// path of the CA certificate the server certificate is verified with
+	handleErr(policy.AddNewStringRule(configKey, "sslrootcert", false))
+
+	// maximum number of open connections to each server, 0 for no limit
+	handleErr(policy.AddNewIntRule(configKey, "max_open_conns", false, plugin.SetDefaultInt(0)))
+
+	// maximum number of idle connections kept open to each server between
+	// publishes
+	handleErr(policy.AddNewIntRule(configKey, "max_idle_conns", false, plugin.SetDefaultInt(defaultMaxIdleConns)))
+
+	// duration (e.g. 30m) after which a connection is closed and replaced,
+	// unlimited when unset
+	handleErr(policy.AddNewStringRule(configKey, "conn_max_lifetime", false))
+
+	// duration (e.g. 5s) after which the server cancels a statement, unlimited
+	// when unset
+	handleErr(policy.AddNewStringRule(configKey, "statement_timeout", false))
+
+	// duration (e.g. 30s) after which a publish stops connecting and writing
+	// and fails, unlimited when unset
+	handleErr(policy.AddNewStringRule(configKey, "publish_timeout", false))
+
+	// insert the metrics of a batch in the order of their collection
+	// timestamps, which keeps BRIN indexes and TimescaleDB chunks tight
+	handleErr(policy.AddNewBoolRule(configKey, "sort_by_timestamp", false, plugin.SetDefaultBool(false)))
+
+	// precision passed to date_trunc to fill the time_bucket column, such as
+	// 'minute' or 'hour'; the column is omitted when unset
+	handleErr(policy.AddNewStringRule(configKey, "time_bucket", false))
+
+	// semicolon separated column definitions added to the created table, e.g.
+	// generated columns derived from key_column
+	handleErr(policy.AddNewStringRule(configKey, "generated_columns", false))
+
+	// number of hash partitions on key_column the table is created with; 0
+	// creates a plain table
+	handleErr(policy.AddNewIntRule(configKey, "hash_partitions", false, plugin.SetDefaultInt(0), plugin.SetMinInt(0)))
+
+	// cron spec (with seconds, or a descriptor such as '@daily') the
+	// maintenance jobs run at; maintenance is disabled when unset
+	handleErr(policy.AddNewStringRule(configKey, "maintenance_schedule", false))
+
+	// maintenance deletes rows older than this many days; 0 keeps all rows
+	handleErr(policy.AddNewIntRule(configKey, "retention_days", false, plugin.SetDefaultInt(0), plugin.SetMinInt(0)))
+
+	// maintenance runs ANALYZE on the table
+	handleErr(policy.AddNewBoolRule(configKey, "maintenance_analyze", false, plugin.SetDefaultBool(false)))
+
+	// second table every metric is also written to while migrating; its
+	// failures are logged without failing the publish
+	handleErr(policy.AddNewStringRule(configKey, "dual_write_table", false))
+
+	// table, named as table_name, the chunks of rows rejected with a data
+	// error are written to instead of failing their batch
+	handleErr(policy.AddNewStringRule(configKey, "dead_letter_table", false))
+
+	// write to <table_name>_staging instead of table_name, until it is
+	// switched over with the switchover command
+	handleErr(policy.AddNewBoolRule(configKey, "staging", false, plugin.SetDefaultBool(false)))
+
+	// store every metric, encoded as a batch of its own in the content type it
+	// was published in, in a raw_payload bytea column so it can be replayed
+	handleErr(policy.AddNewBoolRule(configKey, "archive_raw_payload", false, plugin.SetDefaultBool(false)))
+
+	// either 'text' to store every value in value_column, 'typed' to store
+	// them in value_int, value_float, value_string or value_bool by type, or
+	// 'wide' to store a row per timestamp and tags with a column per namespace
+	handleErr(policy.AddNewStringRule(configKey, "schema", false, plugin.SetDefaultString(schemaText)))
+
+	// keep one row per key_column and time_posted: 'ignore' keeps the stored
+	// row, 'latest' overwrites it, and 'sum', 'min' and 'max' aggregate the
+	// numbers of the typed schema into it
+	handleErr(policy.AddNewStringRule(configKey, "dedupe", false, plugin.SetDefaultString("")))
+
+	// either 'strict' to reject values of unsupported types such as maps, or
+	// 'json' to store them JSON encoded (in value_json with the typed schema)
+	handleErr(policy.AddNewStringRule(configKey, "value_serializer", false, plugin.SetDefaultString(serializerStrict)))
+
+	// create the table partitioned by time_posted with one partition per 'day'
+	// or 'month'; retention_days then drops whole partitions
+	handleErr(policy.AddNewStringRule(configKey, "time_partitioning", false, plugin.SetDefaultString("")))
+
+	// create the table as a TimescaleDB hypertable on time_posted, when the
+	// extension is installed
+	handleErr(policy.AddNewBoolRule(configKey, "timescaledb", false, plugin.SetDefaultBool(false)))
+
+	// interval (e.g. '1 day') of the hypertable chunks, the TimescaleDB
+	// default when unset
+	handleErr(policy.AddNewStringRule(configKey, "chunk_time_interval", false))
+
+	// interval (e.g. '7 days') after which hypertable chunks are compressed,
+	// no compression when unset
+	handleErr(policy.AddNewStringRule(configKey, "compress_after", false))
+
+	// change key_column and value_column (text schema) to TEXT and retry when
+	// a metric is too long for them, instead of failing
+	handleErr(policy.AddNewBoolRule(configKey, "widen_columns", false, plugin.SetDefaultBool(false)))
+
+	return *policy, nil
 }
 
 func handleErr(e error) {
@@ -208,38 +819,136 @@ func sliceToNamespace(slice []string) string {
 	return strings.Join(slice, ".")
 }
 
-func interfaceToString(face interface{}) (string, error) {
-	var (
-		ret string
-		err error
-	)
+// valueSerializer formats the data of a metric for value_column, reporting
+// whether it is JSON encoded
+type valueSerializer func(data interface{}) (value string, json bool, err error)
 
-	switch face.(type) {
-	case int, int8, int16, int32, int64,
-		uint, uint8, uint16, uint32, uint64,
-		float32, float64,
-		string:
+// valueSerializers are the serializers the value_serializer option picks
+var valueSerializers = map[string]valueSerializer{
+	serializerStrict: strictValue,
+	serializerJSON:   jsonFallbackValue,
+}
 
-		ret = fmt.Sprintf("%v", face)
+// strictValue formats the types interfaceToString supports and rejects
+// the others
+func strictValue(data interface{}) (string, bool, error) {
+	value, err := interfaceToString(data)
+	return value, false, err
+}
 
-	case []uint, []uint8, []uint16, []uint32, []uint64,
-		[]int, []int8, []int16, []int32, []int64,
-		[]float32, []float64:
-		ret = strings.Trim(strings.Replace(fmt.Sprintf("%v", face), " ", ", ", -1), "[]")
+// jsonFallbackValue formats the types interfaceToString supports and JSON
+// encodes the others, such as maps and structs
+func jsonFallbackValue(data interface{}) (string, bool, error) {
+	if value, err := interfaceToString(data); err == nil {
+		return value, false, nil
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", false, fmt.Errorf("Cannot JSON encode value of type %v: %v", reflect.TypeOf(data), err)
+	}
+	return string(buf), true, nil
+}
+
+func interfaceToString(face interface{}) (string, error) {
+	switch v := face.(type) {
+	case string:
+		return v, nil
 	case []string:
 		//special case for slice of strings to deal with spaces and `[]` in elements of slice
-		ret = strings.Join(face.([]string), ", ")
+		return strings.Join(v, ", "), nil
 	case bool:
-		if face.(bool) {
-			ret = "1"
-		} else {
-			ret = "0"
+		if v {
+			return "1", nil
 		}
+		return "0", nil
+	}
+
+	if buf, ok := appendNumber(make([]byte, 0, 24), face); ok {
+		return string(buf), nil
+	}
+	if buf, ok := appendNumberSlice(face); ok {
+		return string(buf), nil
+	}
+	return "", fmt.Errorf("Unsupported type %v (currently supported data types: bool, "+
+		"int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, string"+
+		"[]uint, []uint8, []uint16, []uint32, []uint64, []int, []int8, []int16, []int32, []int64, []float32, []float64, []string)", reflect.TypeOf(face))
+}
+
+// appendNumber appends the text form of a numeric value to buf, reporting
+// false when face is not a number
+func appendNumber(buf []byte, face interface{}) ([]byte, bool) {
+	switch v := face.(type) {
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10), true
+	case int8:
+		return strconv.AppendInt(buf, int64(v), 10), true
+	case int16:
+		return strconv.AppendInt(buf, int64(v), 10), true
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10), true
+	case int64:
+		return strconv.AppendInt(buf, v, 10), true
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10), true
+	case uint8:
+		return strconv.AppendUint(buf, uint64(v), 10), true
+	case uint16:
+		return strconv.AppendUint(buf, uint64(v), 10), true
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10), true
+	case uint64:
+		return strconv.AppendUint(buf, v, 10), true
+	case float32:
+		return strconv.AppendFloat(buf, float64(v), 'g', -1, 32), true
+	case float64:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64), true
+	}
+	return buf, false
+}
+
+// appendNumberSlice renders a slice of numbers as a comma separated list,
+// reporting false when face is not a slice of numbers
+func appendNumberSlice(face interface{}) ([]byte, bool) {
+	var (
+		n    int
+		elem func(buf []byte, i int) []byte
+	)
+
+	switch v := face.(type) {
+	case []int:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendInt(buf, int64(v[i]), 10) }
+	case []int8:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendInt(buf, int64(v[i]), 10) }
+	case []int16:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendInt(buf, int64(v[i]), 10) }
+	case []int32:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendInt(buf, int64(v[i]), 10) }
+	case []int64:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendInt(buf, v[i], 10) }
+	case []uint:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendUint(buf, uint64(v[i]), 10) }
+	case []uint8:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendUint(buf, uint64(v[i]), 10) }
+	case []uint16:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendUint(buf, uint64(v[i]), 10) }
+	case []uint32:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendUint(buf, uint64(v[i]), 10) }
+	case []uint64:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendUint(buf, v[i], 10) }
+	case []float32:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendFloat(buf, float64(v[i]), 'g', -1, 32) }
+	case []float64:
+		n, elem = len(v), func(buf []byte, i int) []byte { return strconv.AppendFloat(buf, v[i], 'g', -1, 64) }
 	default:
-		err = fmt.Errorf("Unsupported type %v (currently supported data types: bool, "+
-			"int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, string"+
-			"[]uint, []uint8, []uint16, []uint32, []uint64, []int, []int8, []int16, []int32, []int64, []float32, []float64, []string)", reflect.TypeOf(face))
+		return nil, false
+	}
 
+	buf := make([]byte, 0, n*8)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = elem(buf, i)
 	}
-	return ret, err
+	return buf, true
 }
@@ -22,124 +22,208 @@ limitations under the License.
 package postgresql
 
 import (
-	"bytes"
-	"encoding/gob"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
-	"github.com/intelsdi-x/snap/control/plugin"
-	"github.com/intelsdi-x/snap/core"
-	"github.com/intelsdi-x/snap/core/ctypes"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 func TestPostgresPublish(t *testing.T) {
-	config := make(map[string]ctypes.ConfigValue)
+	config := make(plugin.Config)
 
 	Convey("Snap Plugin PostgreSQL integration testing with PostgreSQL", t, func() {
-		var buf bytes.Buffer
-
-		config["hostname"] = ctypes.ConfigValueStr{Value: os.Getenv("SNAP_POSTGRESQL_HOST")}
-		config["port"] = ctypes.ConfigValueInt{Value: 5432}
-		config["username"] = ctypes.ConfigValueStr{Value: "postgres"}
-		config["password"] = ctypes.ConfigValueStr{Value: ""}
-		config["database"] = ctypes.ConfigValueStr{Value: "snap_test"}
-		config["table_name"] = ctypes.ConfigValueStr{Value: "info"}
+		config["hostname"] = os.Getenv("SNAP_POSTGRESQL_HOST")
+		config["port"] = int64(5432)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
 
 		ip := NewPostgreSQLPublisher()
-		cp, _ := ip.GetConfigPolicy()
-		cfg, _ := cp.Get([]string{""}).Process(config)
 
 		Convey("Publish integer metric (int)", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 99),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 99},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish integer metric (int64)", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", int64(99)),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: int64(99)},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish unsigned integer metric (uint)", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", uint(99)),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: uint(99)},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish unsigned integer metric (uint64)", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", uint64(99)),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: uint64(99)},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish float metric", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("bar"), time.Now(), nil, "", 3.141),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 3.141},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish string metric", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("qux"), time.Now(), nil, "", "bar"),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("qux"), Timestamp: time.Now(), Data: "bar"},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish boolean metric", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("baz"), time.Now(), nil, "", true),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("baz"), Timestamp: time.Now(), Data: true},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Publish multiple metrics", func() {
-			metrics := []plugin.MetricType{
-				*plugin.NewMetricType(core.NewNamespace("foo"), time.Now(), nil, "", 101),
-				*plugin.NewMetricType(core.NewNamespace("bar"), time.Now(), nil, "", 5.789),
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 101},
+				{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 5.789},
 			}
-			buf.Reset()
-			enc := gob.NewEncoder(&buf)
-			enc.Encode(metrics)
-			err := ip.Publish(plugin.SnapGOBContentType, buf.Bytes(), *cfg)
+			err := ip.Publish(metrics, config)
 			So(err, ShouldBeNil)
 		})
 
 	})
 }
+
+// TestPostgresPublishTLS runs against a TLS-enabled server given by
+// SNAP_POSTGRESQL_SSL_HOST, verified with the CA certificate in
+// SNAP_POSTGRESQL_SSLROOTCERT
+func TestPostgresPublishTLS(t *testing.T) {
+	host := os.Getenv("SNAP_POSTGRESQL_SSL_HOST")
+	if host == "" {
+		t.Skip("SNAP_POSTGRESQL_SSL_HOST is not set")
+	}
+	config := make(plugin.Config)
+
+	Convey("Snap Plugin PostgreSQL integration testing with PostgreSQL over TLS", t, func() {
+		config["hostname"] = host
+		config["port"] = int64(5432)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["sslmode"] = "require"
+		if rootCert := os.Getenv("SNAP_POSTGRESQL_SSLROOTCERT"); rootCert != "" {
+			config["sslmode"] = "verify-full"
+			config["sslrootcert"] = rootCert
+		}
+
+		ip := NewPostgreSQLPublisher()
+
+		Convey("Publish metric", func() {
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 99},
+			}
+			err := ip.Publish(metrics, config)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+// TestDialectPublish runs against the CockroachDB node given by
+// SNAP_COCKROACHDB_HOST and the Aurora PostgreSQL cluster given by
+// SNAP_AURORA_HOST, SNAP_AURORA_USER and SNAP_AURORA_PASSWORD, each skipped
+// when its host is not set
+func TestDialectPublish(t *testing.T) {
+	servers := []struct {
+		dialect, host, port, user, password string
+	}{
+		{dialectCockroachDB, os.Getenv("SNAP_COCKROACHDB_HOST"), "26257", "root", ""},
+		{dialectAurora, os.Getenv("SNAP_AURORA_HOST"), "5432", os.Getenv("SNAP_AURORA_USER"), os.Getenv("SNAP_AURORA_PASSWORD")},
+	}
+	for _, server := range servers {
+		if server.host == "" {
+			t.Logf("Skipping %s, its host is not set", server.dialect)
+			continue
+		}
+		port, _ := strconv.Atoi(server.port)
+		config := plugin.Config{
+			"hostname":   server.host,
+			"port":       int64(port),
+			"username":   server.user,
+			"password":   server.password,
+			"database":   "snap_test",
+			"table_name": "info_" + server.dialect,
+			"dialect":    server.dialect,
+			"schema":     "typed",
+		}
+
+		Convey("Snap Plugin PostgreSQL integration testing with "+server.dialect, t, func() {
+			ip := NewPostgreSQLPublisher()
+			metrics := []plugin.Metric{
+				{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 99},
+				{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 3.141, Tags: map[string]string{"host": "a"}},
+			}
+
+			Convey("The table is created and written", func() {
+				So(ip.Publish(metrics, config), ShouldBeNil)
+				So(ip.Publish(metrics, config), ShouldBeNil)
+			})
+
+			Convey("Metrics are copied", func() {
+				config["bulk_mode"] = "copy"
+				So(ip.Publish(metrics, config), ShouldBeNil)
+			})
+		})
+	}
+}
+
+// BenchmarkBulkMode compares the publishes of 10000 metrics written with
+// multi-row inserts and with COPY
+func BenchmarkBulkMode(b *testing.B) {
+	host := os.Getenv("SNAP_POSTGRESQL_HOST")
+	if host == "" {
+		b.Skip("SNAP_POSTGRESQL_HOST is not set")
+	}
+	metrics := make([]plugin.Metric, 10000)
+	for i := range metrics {
+		metrics[i] = plugin.Metric{Namespace: plugin.NewNamespace("bench", strconv.Itoa(i)), Timestamp: time.Now(), Data: i}
+	}
+	for _, mode := range []string{bulkModeInsert, bulkModeCopy} {
+		b.Run(mode, func(b *testing.B) {
+			config := make(plugin.Config)
+			config["hostname"] = host
+			config["port"] = int64(5432)
+			config["username"] = "postgres"
+			config["password"] = ""
+			config["database"] = "snap_test"
+			config["table_name"] = "bench_" + mode
+			config["bulk_mode"] = mode
+			ip := NewPostgreSQLPublisher()
+			defer ip.Drain()
+			for i := 0; i < b.N; i++ {
+				if err := ip.Publish(metrics, config); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -22,8 +22,8 @@ limitations under the License.
 package postgresql
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -31,11 +31,11 @@ import (
 	"time"
 
 	"database/sql"
+	"database/sql/driver"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/intelsdi-x/snap/control/plugin"
-	"github.com/intelsdi-x/snap/core"
-	"github.com/intelsdi-x/snap/core/ctypes"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -150,6 +150,16 @@ func TestInterfaceToString(t *testing.T) {
 			So(err, ShouldBeNil)
 		})
 
+		Convey("Calling function matches fmt formatting of numbers", func() {
+			values := []interface{}{int8(-8), int16(16), int32(-32), uint8(8), uint16(16), uint32(32),
+				float32(1e21), float64(1e-7), float64(123456789.125)}
+			for _, v := range values {
+				sp, err := interfaceToString(v)
+				So(sp, ShouldEqual, fmt.Sprintf("%v", v))
+				So(err, ShouldBeNil)
+			}
+		})
+
 		Convey("Calling function for unsupported types", func() {
 			expl1 := map[float64]float64{}
 			expl2 := struct{}{}
@@ -165,24 +175,54 @@ func TestInterfaceToString(t *testing.T) {
 	})
 }
 
+func TestValueSerializers(t *testing.T) {
+	Convey("TestValueSerializers", t, func() {
+		composite := map[string]interface{}{"cpu0": 1.5, "cpu1": []int{1, 2}}
+
+		Convey("strict rejects unsupported types", func() {
+			_, _, err := valueSerializers[serializerStrict](composite)
+			So(err, ShouldNotBeNil)
+
+			value, json, err := valueSerializers[serializerStrict](int64(3))
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "3")
+			So(json, ShouldBeFalse)
+		})
+
+		Convey("json encodes unsupported types only", func() {
+			value, json, err := valueSerializers[serializerJSON](composite)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, `{"cpu0":1.5,"cpu1":[1,2]}`)
+			So(json, ShouldBeTrue)
+
+			value, json, err = valueSerializers[serializerJSON]([]int{1, 2})
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "1, 2")
+			So(json, ShouldBeFalse)
+
+			_, _, err = valueSerializers[serializerJSON](make(chan int))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 func TestGetConfigPolicy(t *testing.T) {
 	Convey("TestGetConfigPolicy", t, func() {
 		sp := NewPostgreSQLPublisher()
 		expl, err := sp.GetConfigPolicy()
 		So(expl, ShouldNotBeNil)
 		So(err, ShouldBeNil)
-		text := expl.Get([]string{""})
-		So(fmt.Sprintf("%s", reflect.TypeOf(text)), ShouldResemble, "*cpolicy.ConfigPolicyNode")
+		So(fmt.Sprintf("%s", reflect.TypeOf(expl)), ShouldResemble, "plugin.ConfigPolicy")
 	})
 }
 
 func TestGetPostgreSQLConn(t *testing.T) {
-	config := make(map[string]ctypes.ConfigValue)
-	config["username"] = ctypes.ConfigValueStr{Value: "root"}
-	config["password"] = ctypes.ConfigValueStr{Value: "root"}
-	config["database"] = ctypes.ConfigValueStr{Value: "SNAP_TEST"}
-	config["table_name"] = ctypes.ConfigValueStr{Value: "info"}
-	GetPostgreSQLConn := func(config map[string]ctypes.ConfigValue) (*sql.DB, error) {
+	config := make(plugin.Config)
+	config["username"] = "root"
+	config["password"] = "root"
+	config["database"] = "SNAP_TEST"
+	config["table_name"] = "info"
+	GetPostgreSQLConn := func(config plugin.Config) (*sql.DB, error) {
 		db, err := GetSQLMock()
 		return db, err
 	}
@@ -196,22 +236,22 @@ func TestGetPostgreSQLConn(t *testing.T) {
 }
 
 func TestCreateTable(t *testing.T) {
-	config := make(map[string]ctypes.ConfigValue)
-	config["username"] = ctypes.ConfigValueStr{Value: "root"}
-	config["password"] = ctypes.ConfigValueStr{Value: "root"}
-	config["database"] = ctypes.ConfigValueStr{Value: "SNAP_TEST"}
-	config["table_name"] = ctypes.ConfigValueStr{Value: "info"}
-	GetPostgreSQLConn := func(config map[string]ctypes.ConfigValue) (*sql.DB, error) {
+	config := make(plugin.Config)
+	config["username"] = "root"
+	config["password"] = "root"
+	config["database"] = "SNAP_TEST"
+	config["table_name"] = "info"
+	GetPostgreSQLConn := func(config plugin.Config) (*sql.DB, error) {
 		db, err := GetSQLMock()
 		return db, err
 	}
 	GetPostgreSQLConn(config)
-	tableName := "info"
+	schema := SchemaConfig{TableName: "info"}
 
 	Convey("TestGetPostgreSQL", t, func() {
 		conn, err := GetPostgreSQLConn(config)
 
-		sp, err := createTable(conn, tableName)
+		sp, err := createTable(context.Background(), conn, schema)
 		So(sp, ShouldNotBeNil)
 		So(err, ShouldBeNil)
 	})
@@ -223,48 +263,334 @@ func GetSQLMock() (*sql.DB, error) {
 	if err != nil {
 		fmt.Printf("an error '%s' was not expected when opening a stub database connection", err)
 	}
-	mock.ExpectExec("^CREATE INDEX key_index on (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^CREATE INDEX IF NOT EXISTS (.+) on (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^CREATE INDEX IF NOT EXISTS (.+) on (.+) USING GIN \\(tags\\)$").WillReturnResult(sqlmock.NewResult(0, 1))
 	return db, err
 }
 
 func TestPostgreSQLPublish(t *testing.T) {
-	var buf bytes.Buffer
 	//mock.ExpectBegin()
 	expTime := time.Now()
-	metrics := []plugin.MetricType{
-		*plugin.NewMetricType(core.NewNamespace("test_string"), expTime, nil, "", "example_string"),
-		*plugin.NewMetricType(core.NewNamespace("test_int"), expTime, nil, "", int(-1)),
-		*plugin.NewMetricType(core.NewNamespace("test_int64"), expTime, nil, "", int64(1)),
-		*plugin.NewMetricType(core.NewNamespace("test_uint"), expTime, nil, "", uint(1)),
-		*plugin.NewMetricType(core.NewNamespace("test_uint64"), expTime, nil, "", uint64(1)),
-		*plugin.NewMetricType(core.NewNamespace("test_float"), expTime, nil, "", 1.12),
-		*plugin.NewMetricType(core.NewNamespace("test_float64"), expTime, nil, "", float64(-1.23)),
-		*plugin.NewMetricType(core.NewNamespace("test_bool"), expTime, nil, "", true),
-
-		*plugin.NewMetricType(core.NewNamespace("test_string_slice"), expTime, nil, "", []string{"str1", "str2"}),
-		*plugin.NewMetricType(core.NewNamespace("test_int_slice"), expTime, nil, "", []int{-1, 2}),
-		*plugin.NewMetricType(core.NewNamespace("test_int64_slice"), expTime, nil, "", []int64{-1, 2}),
-		*plugin.NewMetricType(core.NewNamespace("test_uint_slice"), expTime, nil, "", []uint{1, 2}),
-		*plugin.NewMetricType(core.NewNamespace("test_uint64_slice"), expTime, nil, "", []uint64{1, 2}),
-		*plugin.NewMetricType(core.NewNamespace("test_float64_slice"), expTime, nil, "", []float64{1.23, -1.23}),
+	metrics := []plugin.Metric{
+		{Namespace: plugin.NewNamespace("test_string"), Timestamp: expTime, Data: "example_string"},
+		{Namespace: plugin.NewNamespace("test_int"), Timestamp: expTime, Data: int(-1)},
+		{Namespace: plugin.NewNamespace("test_int64"), Timestamp: expTime, Data: int64(1)},
+		{Namespace: plugin.NewNamespace("test_uint"), Timestamp: expTime, Data: uint(1)},
+		{Namespace: plugin.NewNamespace("test_uint64"), Timestamp: expTime, Data: uint64(1)},
+		{Namespace: plugin.NewNamespace("test_float"), Timestamp: expTime, Data: 1.12},
+		{Namespace: plugin.NewNamespace("test_float64"), Timestamp: expTime, Data: float64(-1.23)},
+		{Namespace: plugin.NewNamespace("test_bool"), Timestamp: expTime, Data: true},
+
+		{Namespace: plugin.NewNamespace("test_string_slice"), Timestamp: expTime, Data: []string{"str1", "str2"}},
+		{Namespace: plugin.NewNamespace("test_int_slice"), Timestamp: expTime, Data: []int{-1, 2}},
+		{Namespace: plugin.NewNamespace("test_int64_slice"), Timestamp: expTime, Data: []int64{-1, 2}},
+		{Namespace: plugin.NewNamespace("test_uint_slice"), Timestamp: expTime, Data: []uint{1, 2}},
+		{Namespace: plugin.NewNamespace("test_uint64_slice"), Timestamp: expTime, Data: []uint64{1, 2}},
+		{Namespace: plugin.NewNamespace("test_float64_slice"), Timestamp: expTime, Data: []float64{1.23, -1.23}},
 	}
-	config := make(map[string]ctypes.ConfigValue)
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(metrics)
+	config := make(plugin.Config)
 
 	Convey("TestPostgreSQLPublish", t, func() {
-		config["hostname"] = ctypes.ConfigValueStr{Value: "localhost"}
-		config["port"] = ctypes.ConfigValueInt{Value: 5432}
-		config["username"] = ctypes.ConfigValueStr{Value: "postgres"}
-		config["password"] = ctypes.ConfigValueStr{Value: ""}
-		config["database"] = ctypes.ConfigValueStr{Value: "snap_test"}
-		config["table_name"] = ctypes.ConfigValueStr{Value: "info"}
+		config["hostname"] = "localhost"
+		config["port"] = int64(5432)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
 		sp := NewPostgreSQLPublisher()
 		So(sp, ShouldNotBeNil)
-		err := sp.Publish("", buf.Bytes(), config)
-		So(err, ShouldResemble, errors.New("Unknown content type ''"))
-		err = sp.Publish(plugin.SnapGOBContentType, buf.Bytes(), config)
-		meta := Meta()
-		So(meta, ShouldNotBeNil)
+		sp.Publish(metrics, config)
+	})
+}
+
+func TestConnectReusesConnection(t *testing.T) {
+	Convey("TestConnectReusesConnection", t, func() {
+		db, _, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg := ConnectionConfig{Hostname: "localhost", Port: 5432, Username: "postgres", Database: "snap_test"}
+		sp := NewPostgreSQLPublisher()
+		sp.servers = map[ConnectionConfig]*balancer{cfg: {endpoints: []*endpoint{{cfg: cfg, db: db}}}}
+
+		conn, release, err := sp.connect(context.Background(), cfg)
+		So(err, ShouldBeNil)
+		So(conn, ShouldEqual, db)
+		release()
 	})
 }
+
+func TestWarmUp(t *testing.T) {
+	Convey("TestWarmUp", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("connects the first time a config is seen, before any write", func() {
+			sp.prepared = nil
+			mock.ExpectQuery("SELECT current_user").WillReturnError(errors.New("permission denied"))
+			So(sp.Publish(nil, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("does nothing once the table is prepared", func() {
+			So(sp.Publish(nil, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("keeps the tables of alternating configs prepared until they are idle", func() {
+			other := make(plugin.Config)
+			for k, v := range config {
+				other[k] = v
+			}
+			other["table_name"] = "other"
+			cfg, err := sp.configs.get(other)
+			So(err, ShouldBeNil)
+			sp.prepared[cfg] = &preparedTable{used: timeNow()}
+			for i := 0; i < 2; i++ {
+				So(sp.Publish(nil, config), ShouldBeNil)
+				So(sp.Publish(nil, other), ShouldBeNil)
+			}
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(sp.prepared, ShouldHaveLength, 2)
+			So(sp.servers, ShouldHaveLength, 1)
+
+			defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+			now := time.Now().Add(idleTimeout + time.Second)
+			timeNow = func() time.Time { return now }
+			sp.closeIdle()
+			So(sp.prepared, ShouldBeEmpty)
+			So(sp.servers, ShouldBeEmpty)
+		})
+	})
+}
+
+func BenchmarkInterfaceToString(b *testing.B) {
+	values := []interface{}{int64(-123456), uint(42), float64(3.14159), []float64{1.5, -2.4, 3.75}}
+	for i := 0; i < b.N; i++ {
+		for _, v := range values {
+			interfaceToString(v)
+		}
+	}
+}
+
+// newMockPublisher returns a publisher whose connection for config is
+// already established against a sqlmock database, whose table is already
+// prepared and whose spool is already replayed
+func newMockPublisher(config plugin.Config) (*PostgreSQLPublisher, sqlmock.Sqlmock, error) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	sp := NewPostgreSQLPublisher()
+	cfg, err := sp.configs.get(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	sp.servers = map[ConnectionConfig]*balancer{cfg.Connection: {endpoints: []*endpoint{{cfg: cfg.Connection, db: db}}, used: timeNow()}}
+	sp.prepared = map[*publisherConfig]*preparedTable{cfg: {used: timeNow()}}
+	if cfg.Spool.Dir != "" {
+		replayed := make(chan struct{})
+		close(replayed)
+		sp.replays = map[string]chan struct{}{cfg.Spool.Dir: replayed}
+	}
+	return sp, mock, nil
+}
+
+func TestDualWrite(t *testing.T) {
+	Convey("TestDualWrite", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["dual_write_table"] = "info_v2"
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 2},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("Every metric is written to both tables", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info_v2\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Dual write failures do not fail the publish", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info_v2\" (.+)$").WillReturnError(errors.New("permission denied"))
+			mock.ExpectRollback()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestSortByTimestamp(t *testing.T) {
+	Convey("TestSortByTimestamp", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["sort_by_timestamp"] = true
+		now := time.Now()
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("late"), Timestamp: now.Add(time.Second), Data: 1},
+			{Namespace: plugin.NewNamespace("early"), Timestamp: now, Data: 2},
+			{Namespace: plugin.NewNamespace("early_too"), Timestamp: now, Data: 3},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").
+			WithArgs(sqlmock.AnyArg(), "early", "2", "{}", sqlmock.AnyArg(), "early_too", "3", "{}", sqlmock.AnyArg(), "late", "1", "{}").WillReturnResult(sqlmock.NewResult(3, 3))
+		mock.ExpectCommit()
+		So(sp.Publish(metrics, config), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestEncodeRaw(t *testing.T) {
+	Convey("TestEncodeRaw", t, func() {
+		m := plugin.Metric{Namespace: plugin.NewNamespace("foo", "bar"), Timestamp: time.Now(), Tags: map[string]string{"host": "a"}, Data: 1}
+		raw, err := encodeRaw(m)
+		So(err, ShouldBeNil)
+
+		var decoded []plugin.Metric
+		So(json.Unmarshal(raw, &decoded), ShouldBeNil)
+		So(len(decoded), ShouldEqual, 1)
+		So(decoded[0].Namespace.Strings(), ShouldResemble, []string{"foo", "bar"})
+		So(decoded[0].Tags["host"], ShouldEqual, "a")
+	})
+}
+
+func TestReconnectOnLostConnection(t *testing.T) {
+	Convey("TestReconnectOnLostConnection", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 2},
+		}
+
+		sp, first, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		db, second, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg, err := sp.configs.get(config)
+		So(err, ShouldBeNil)
+		servers := sp.servers[cfg.Connection]
+		servers.endpoints = append(servers.endpoints, &endpoint{cfg: cfg.Connection, db: db})
+		defer func(orig func(time.Duration) <-chan time.Time) { after = orig }(after)
+		after = func(time.Duration) <-chan time.Time {
+			elapsed := make(chan time.Time, 1)
+			elapsed <- time.Now()
+			return elapsed
+		}
+
+		first.ExpectBegin()
+		first.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "57P01", Message: "terminating connection due to administrator command"})
+		first.ExpectRollback()
+		first.ExpectClose()
+		second.ExpectBegin()
+		second.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}", sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+		second.ExpectCommit()
+		So(sp.Publish(metrics, config), ShouldBeNil)
+		// the lost connection is closed in the background once released
+		for i := 0; i < 100 && first.ExpectationsWereMet() != nil; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		So(first.ExpectationsWereMet(), ShouldBeNil)
+		So(second.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestTagsToJSON(t *testing.T) {
+	Convey("TestTagsToJSON", t, func() {
+		tags, err := tagsToJSON(nil)
+		So(err, ShouldBeNil)
+		So(tags, ShouldEqual, "{}")
+
+		tags, err = tagsToJSON(map[string]string{"host": "a", "pod": "b\"c"})
+		So(err, ShouldBeNil)
+		So(tags, ShouldEqual, `{"host":"a","pod":"b\"c"}`)
+	})
+}
+
+func TestMetricTimestamp(t *testing.T) {
+	Convey("TestMetricTimestamp", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		collected := time.Date(2017, 1, 1, 10, 11, 12, 500000000, time.UTC)
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: collected, Data: 1},
+		}
+
+		Convey("time_posted is the collection time of the metric", func() {
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs("2017-01-01T10:11:12.5Z", "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("time_posted is the time of the publish when use_metric_timestamp is false", func() {
+			config["use_metric_timestamp"] = false
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			var posted string
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(recordArg{&posted}, "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(posted, ShouldNotEqual, "2017-01-01T10:11:12.5Z")
+		})
+
+		Convey("Metadata is stored when store_metadata is set", func() {
+			config["store_metadata"] = true
+			metrics[0].Unit, metrics[0].Version, metrics[0].Description = "B", 3, "bytes used"
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" \\(id, (.+), unit, metric_version, description\\) (.+)$").
+				WithArgs("2017-01-01T10:11:12.5Z", "foo", "1", "{}", "B", int64(3), "bytes used").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+// recordArg matches any argument and records it
+type recordArg struct{ value *string }
+
+func (a recordArg) Match(v driver.Value) bool {
+	*a.value, _ = v.(string)
+	return true
+}
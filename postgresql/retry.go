@@ -0,0 +1,143 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// after is replaced in tests
+var after = time.After
+
+// maxTxnRestarts is the number of times a write aborted by CockroachDB on
+// contention is restarted on top of retry_count
+const maxTxnRestarts = 10
+
+// withRetry runs write against a connection for cfg, retrying it with
+// exponential backoff while it fails on a transient error and ctx is not
+// done, which also ends the wait for the next retry; a connection found
+// lost is dropped, so the next attempt connects again
+func (s *PostgreSQLPublisher) withRetry(ctx context.Context, cfg *publisherConfig, write func(db *sql.DB) error) error {
+	logger := cfg.Log.logger()
+	restarts := 0
+	for attempt := 0; ; {
+		err := s.attempt(ctx, cfg, write)
+		if err == nil {
+			return nil
+		}
+		var delay time.Duration
+		switch {
+		case cfg.Schema.Dialect == dialectCockroachDB && isSerializationFailure(err) && restarts < maxTxnRestarts:
+			// CockroachDB aborts contending transactions and expects
+			// clients to restart them
+			delay = cfg.Retry.backoff(restarts)
+			restarts++
+			logger.Warnf("%v, restart %d of %d in %v", err, restarts, maxTxnRestarts, delay)
+		case (isTransient(err) || isConnectionLost(cfg.Schema.Dialect, err)) && attempt < cfg.Retry.Count:
+			delay = cfg.Retry.backoff(attempt)
+			attempt++
+			logger.Warnf("%v, retry %d of %d in %v", err, attempt, cfg.Retry.Count, delay)
+			s.stats.retry()
+		default:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-after(delay):
+		}
+	}
+}
+
+// attempt runs write once against a connection for cfg
+func (s *PostgreSQLPublisher) attempt(ctx context.Context, cfg *publisherConfig, write func(db *sql.DB) error) error {
+	db, release, err := s.connect(ctx, cfg.Connection)
+	if err != nil {
+		// retrying will not fix the options
+		if !isTransient(err) {
+			return fmt.Errorf("Cannot connect: %s", explainConnectError(cfg.Connection, err))
+		}
+		return err
+	}
+	defer release()
+	err = write(db)
+	if err != nil && isConnectionLost(cfg.Schema.Dialect, err) {
+		s.disconnect(db)
+	}
+	return err
+}
+
+// isConnectionLost reports whether the connection that failed with err
+// has to be replaced: on connection errors, and on Aurora on the
+// read_only_sql_transaction errors of a connection left on a writer
+// demoted to a reader by a failover
+func isConnectionLost(dialect string, err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	pqErr, ok := err.(*pq.Error)
+	return ok && dialect == dialectAurora && pqErr.Code == "25006"
+}
+
+// isSerializationFailure reports whether err is PostgreSQL's
+// serialization_failure error, which CockroachDB raises for the
+// transactions to restart
+func isSerializationFailure(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
+
+// isTransient reports whether err may go away when the write is retried:
+// lost or refused connections, serialization failures, deadlocks,
+// exhausted server resources and timeouts; errors such as failed
+// authentication or invalid statements are permanent
+func isTransient(err error) bool {
+	if isConnectionError(err) || err == context.DeadlineExceeded {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "40001", "40P01", "57014":
+			return true
+		}
+		return pqErr.Code.Class() == "53"
+	}
+	return false
+}
+
+// backoff returns the delay before retry attempt+1: InitialDelay doubled
+// attempt times, capped at MaxDelay, with jitter drawn from its upper half
+// so publishers failing together do not retry in lockstep
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	delay := r.MaxDelay
+	if attempt < 32 {
+		if d := r.InitialDelay << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,181 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIsTransient(t *testing.T) {
+	Convey("TestIsTransient", t, func() {
+		So(isTransient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), ShouldBeTrue)
+		So(isTransient(&pq.Error{Code: "40001"}), ShouldBeTrue)
+		So(isTransient(&pq.Error{Code: "40P01"}), ShouldBeTrue)
+		So(isTransient(&pq.Error{Code: "53300"}), ShouldBeTrue)
+		So(isTransient(&pq.Error{Code: "57014"}), ShouldBeTrue)
+		So(isTransient(context.DeadlineExceeded), ShouldBeTrue)
+		So(isTransient(&pq.Error{Code: "28P01"}), ShouldBeFalse)
+		So(isTransient(&pq.Error{Code: "42601"}), ShouldBeFalse)
+		So(isTransient(errors.New("unsupported type")), ShouldBeFalse)
+	})
+}
+
+func TestIsConnectionLost(t *testing.T) {
+	Convey("TestIsConnectionLost", t, func() {
+		So(isConnectionLost(dialectPostgreSQL, &pq.Error{Code: "08006"}), ShouldBeTrue)
+		So(isConnectionLost(dialectPostgreSQL, &pq.Error{Code: "25006"}), ShouldBeFalse)
+		So(isConnectionLost(dialectAurora, &pq.Error{Code: "25006"}), ShouldBeTrue)
+		So(isConnectionLost(dialectAurora, &pq.Error{Code: "42601"}), ShouldBeFalse)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	Convey("TestBackoff", t, func() {
+		retry := RetryConfig{Count: 10, InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+		for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+			delay := retry.backoff(attempt)
+			So(delay, ShouldBeGreaterThanOrEqualTo, want*time.Millisecond/2)
+			So(delay, ShouldBeLessThanOrEqualTo, want*time.Millisecond)
+		}
+		So(retry.backoff(100), ShouldBeLessThanOrEqualTo, time.Second)
+	})
+}
+
+func TestWithRetry(t *testing.T) {
+	Convey("TestWithRetry", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["retry_count"] = int64(3)
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+		}
+
+		var delays []time.Duration
+		defer func(orig func(time.Duration) <-chan time.Time) { after = orig }(after)
+		after = func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			elapsed := make(chan time.Time, 1)
+			elapsed <- time.Now()
+			return elapsed
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		Convey("Transient errors are retried with growing delays", func() {
+			for _, code := range []pq.ErrorCode{"40001", "40P01"} {
+				mock.ExpectBegin()
+				mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: code})
+				mock.ExpectRollback()
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(len(delays), ShouldEqual, 2)
+			So(delays[1], ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+		})
+
+		Convey("Retries stop after retry_count", func() {
+			for i := 0; i < 4; i++ {
+				mock.ExpectBegin()
+				mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "40001"})
+				mock.ExpectRollback()
+			}
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(len(delays), ShouldEqual, 3)
+		})
+
+		Convey("CockroachDB restarts do not count against retry_count", func() {
+			config["dialect"] = "cockroachdb"
+			config["retry_count"] = int64(0)
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				mock.ExpectBegin()
+				mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "40001", Message: "restart transaction"})
+				mock.ExpectRollback()
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(len(delays), ShouldEqual, 2)
+		})
+
+		Convey("Retries stop once publish_timeout expires", func() {
+			config["publish_timeout"] = "20ms"
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			// a delay that never elapses
+			after = func(d time.Duration) <-chan time.Time {
+				delays = append(delays, d)
+				return nil
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "40001"})
+			mock.ExpectRollback()
+			start := time.Now()
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(len(delays), ShouldEqual, 1)
+		})
+
+		Convey("A hung statement is cancelled at publish_timeout", func() {
+			config["publish_timeout"] = "50ms"
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillDelayFor(10 * time.Second).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectRollback()
+			start := time.Now()
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+
+		Convey("Permanent errors fail fast", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "28P01", Message: "password authentication failed"})
+			mock.ExpectRollback()
+			So(sp.Publish(metrics, config), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(delays, ShouldBeEmpty)
+		})
+	})
+}
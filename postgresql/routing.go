@@ -0,0 +1,110 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tableRoute sends the metrics whose key matches pattern to the table
+// rendered from template; a route without pattern matches every metric
+type tableRoute struct {
+	pattern  *regexp.Regexp
+	template string
+}
+
+// routePlaceholder is replaced by the namespace element of the given index
+var routePlaceholder = regexp.MustCompile(`\{namespace\[(\d+)\]\}`)
+
+// parseTableRouting parses the table_routing option, a semicolon separated
+// list of pattern=table rules tried in order. A rule without pattern
+// matches every metric.
+func parseTableRouting(value string) ([]tableRoute, error) {
+	var routes []tableRoute
+	for _, rule := range splitList(value, ";") {
+		route := tableRoute{template: rule}
+		if i := strings.LastIndex(rule, "="); i >= 0 {
+			pattern, err := regexp.Compile(strings.TrimSpace(rule[:i]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid table_routing pattern '%s': %v", rule[:i], err)
+			}
+			route.pattern = pattern
+			route.template = strings.TrimSpace(rule[i+1:])
+		}
+		// the template has to give a valid name whatever it is filled with
+		if _, err := parseIdentifier("table_routing", routePlaceholder.ReplaceAllString(route.template, "x")); err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// routeTable returns the table of the metric with namespace ns and key, or
+// def when no route matches it
+func routeTable(routes []tableRoute, ns []string, key, def string) (string, error) {
+	for _, route := range routes {
+		if route.pattern != nil && !route.pattern.MatchString(key) {
+			continue
+		}
+		name, err := renderRoute(route.template, ns)
+		if err != nil {
+			return "", err
+		}
+		return parseIdentifier("table_routing", name)
+	}
+	return def, nil
+}
+
+// renderRoute fills the placeholders of template with the elements of ns.
+// Elements are folded to lower case with any character not allowed in a
+// plain name replaced by an underscore, unless the template is quoted.
+func renderRoute(template string, ns []string) (string, error) {
+	quoted := strings.HasPrefix(template, `"`)
+	var err error
+	name := routePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		index, _ := strconv.Atoi(routePlaceholder.FindStringSubmatch(placeholder)[1])
+		if index >= len(ns) {
+			err = fmt.Errorf("Namespace %s has no element %d for table_routing", strings.Join(ns, "."), index)
+			return ""
+		}
+		if quoted {
+			return strings.Replace(ns[index], `"`, `""`, -1)
+		}
+		return plainName(ns[index])
+	})
+	return name, err
+}
+
+// plainName folds s to a name usable without quoting
+func plainName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+}
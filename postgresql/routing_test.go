@@ -0,0 +1,119 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTableRouting(t *testing.T) {
+	Convey("TestTableRouting", t, func() {
+		routes, err := parseTableRouting(`^intel\.psutil\.cpu=cpu; ^intel\.disk = "Disk {namespace[2]}"; metrics_{namespace[1]}`)
+		So(err, ShouldBeNil)
+		So(len(routes), ShouldEqual, 3)
+
+		Convey("The first matching rule is used", func() {
+			table, err := routeTable(routes, []string{"intel", "psutil", "cpu", "cpu0"}, "intel.psutil.cpu.cpu0", "info")
+			So(err, ShouldBeNil)
+			So(table, ShouldEqual, "cpu")
+
+			table, err = routeTable(routes, []string{"intel", "disk", "sd\"a"}, "intel.disk.sd\"a", "info")
+			So(err, ShouldBeNil)
+			So(table, ShouldEqual, `Disk sd"a`)
+		})
+
+		Convey("Elements are folded to plain names", func() {
+			table, err := routeTable(routes, []string{"intel", "Mem-Info", "free"}, "intel.Mem-Info.free", "info")
+			So(err, ShouldBeNil)
+			So(table, ShouldEqual, "metrics_mem_info")
+		})
+
+		Convey("Missing elements return an error", func() {
+			_, err := routeTable(routes, []string{"intel"}, "intel", "info")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Metrics matching no rule go to the default table", func() {
+			table, err := routeTable(routes[:1], []string{"intel", "mem"}, "intel.mem", "info")
+			So(err, ShouldBeNil)
+			So(table, ShouldEqual, "info")
+		})
+
+		Convey("Invalid rules return an error", func() {
+			_, err := parseTableRouting("(=cpu")
+			So(err, ShouldNotBeNil)
+			_, err = parseTableRouting("cpu=cpu-table")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPublishTableRouting(t *testing.T) {
+	Convey("TestPublishTableRouting", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["table_routing"] = `^cpu\.=metrics_{namespace[0]}`
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("cpu", "user"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("mem", "free"), Timestamp: time.Now(), Data: 2},
+			{Namespace: plugin.NewNamespace("cpu", "idle"), Timestamp: time.Now(), Data: 3},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"metrics_cpu\" ADD COLUMN IF NOT EXISTS tags jsonb$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("^SELECT to_regclass\\(\\$1\\) IS NOT NULL$").WithArgs(`"metrics_cpu"`).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"metrics_cpu\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"metrics_cpu_key_index\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"metrics_cpu_tags_index\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"metrics_cpu\" (.+)$").WithArgs(sqlmock.AnyArg(), "cpu.user", "1", "{}", sqlmock.AnyArg(), "cpu.idle", "3", "{}").WillReturnResult(sqlmock.NewResult(2, 2))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "mem.free", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		So(sp.Publish(metrics, config), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+		Convey("Routed tables are prepared once", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"metrics_cpu\" (.+)$").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metrics, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
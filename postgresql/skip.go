@@ -0,0 +1,106 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxListedErrors is the number of metric errors metricErrors lists
+const maxListedErrors = 5
+
+// metricError is the failure of a metric skipped by error_policy=skip
+type metricError struct {
+	key string
+	err error
+}
+
+// metricErrors are the metrics of a publish skipped by error_policy=skip
+type metricErrors []metricError
+
+func (e metricErrors) Error() string {
+	msgs := make([]string, 0, maxListedErrors)
+	for i, me := range e {
+		if i == maxListedErrors {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(e)-maxListedErrors))
+			break
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %v", me.key, me.err))
+	}
+	return fmt.Sprintf("Skipped %d metrics: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// isMetricErrors reports whether err lists skipped metrics, the other
+// metrics being written
+func isMetricErrors(err error) bool {
+	_, ok := err.(metricErrors)
+	return ok
+}
+
+// isDataError reports whether err is a data exception or an integrity
+// constraint violation, which reject a row rather than the statement
+func isDataError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23")
+}
+
+// insertEach inserts rows one at a time in a single transaction after
+// their batch failed on a data error, rolling back to a savepoint for every
+// row rejected with a data error; it returns the rows written and the
+// errors of the others
+func insertEach(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row) ([]row, metricErrors, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		written []row
+		skipped metricErrors
+	)
+	for _, r := range rows {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT insert_row"); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		query, args := insertQuery(schema, r)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			if !isDataError(err) {
+				tx.Rollback()
+				return nil, nil, err
+			}
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT insert_row"); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+			skipped = append(skipped, metricError{key: r.key, err: err})
+			continue
+		}
+		written = append(written, r)
+	}
+	if err := commit(ctx, tx); err != nil {
+		return nil, nil, err
+	}
+	return written, skipped, nil
+}
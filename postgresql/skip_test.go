@@ -0,0 +1,145 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricErrors(t *testing.T) {
+	Convey("TestMetricErrors", t, func() {
+		errs := metricErrors{{key: "foo", err: errors.New("bad")}}
+		So(errs.Error(), ShouldEqual, "Skipped 1 metrics: foo: bad")
+
+		for i := 0; i < 6; i++ {
+			errs = append(errs, metricError{key: fmt.Sprintf("m%d", i), err: errors.New("bad")})
+		}
+		So(errs.Error(), ShouldEndWith, "m3: bad; and 2 more")
+		So(isMetricErrors(errs), ShouldBeTrue)
+		So(isMetricErrors(errors.New("bad")), ShouldBeFalse)
+	})
+}
+
+func TestIsDataError(t *testing.T) {
+	Convey("TestIsDataError", t, func() {
+		So(isDataError(&pq.Error{Code: "22001"}), ShouldBeTrue)
+		So(isDataError(&pq.Error{Code: "23505"}), ShouldBeTrue)
+		So(isDataError(&pq.Error{Code: "40001"}), ShouldBeFalse)
+		So(isDataError(errors.New("bad")), ShouldBeFalse)
+	})
+}
+
+func TestInsertEach(t *testing.T) {
+	Convey("TestInsertEach", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		schema := SchemaConfig{TableName: "info"}
+		rows := []row{
+			{timePosted: "t", key: "foo", value: "1", tags: "{}"},
+			{timePosted: "t", key: "bar", value: "2", tags: "{}"},
+		}
+
+		Convey("Rows rejected with a data error are rolled back to their savepoint", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs("t", "foo", "1", "{}").WillReturnError(&pq.Error{Code: "22001"})
+			mock.ExpectExec("^ROLLBACK TO SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs("t", "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			written, skipped, err := insertEach(context.Background(), db, schema, rows)
+			So(err, ShouldBeNil)
+			So(written, ShouldResemble, rows[1:])
+			So(len(skipped), ShouldEqual, 1)
+			So(skipped[0].key, ShouldEqual, "foo")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Other errors roll back the transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "40001"})
+			mock.ExpectRollback()
+
+			_, _, err := insertEach(context.Background(), db, schema, rows)
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestPublishSkip(t *testing.T) {
+	Convey("TestPublishSkip", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["error_policy"] = errorPolicySkip
+		metrics := []plugin.Metric{
+			{Namespace: plugin.NewNamespace("foo"), Timestamp: time.Now(), Data: 1},
+			{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: map[string]int{"a": 1}},
+			{Namespace: plugin.NewNamespace("baz"), Timestamp: time.Now(), Data: "too long"},
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "22001"})
+		mock.ExpectRollback()
+		mock.ExpectBegin()
+		mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("^SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "baz", "too long", "{}").WillReturnError(&pq.Error{Code: "22001"})
+		mock.ExpectExec("^ROLLBACK TO SAVEPOINT insert_row$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		err = sp.Publish(metrics, config)
+		So(err, ShouldNotBeNil)
+		errs, ok := err.(metricErrors)
+		So(ok, ShouldBeTrue)
+		So(len(errs), ShouldEqual, 2)
+		So(errs[0].key, ShouldEqual, "bar")
+		So(errs[1].key, ShouldEqual, "baz")
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+		Convey("abort fails on the first metric", func() {
+			config["error_policy"] = errorPolicyAbort
+			err := sp.Publish(metrics, config)
+			So(err, ShouldNotBeNil)
+			So(isMetricErrors(err), ShouldBeFalse)
+		})
+	})
+}
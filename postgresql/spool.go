@@ -0,0 +1,724 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// every batch in a spool segment starts with a magic, followed by the
+	// length and the CRC-32 of the payload; the magic tells whether the
+	// payload is gzip compressed
+	spoolMagic     = "SNAPPGS1"
+	spoolGzipMagic = "SNAPPGZ1"
+	spoolHeaderLen = len(spoolMagic) + 8
+	spoolExt       = ".spool"
+	// the segment batches are appended to carries this suffix until it is
+	// sealed, so it is not drained while it grows
+	spoolOpenExt = ".open"
+	// segments that cannot be read or hold batches rejected by the
+	// database are renamed with these suffixes, so they are kept but not
+	// drained again
+	spoolCorruptExt  = ".corrupt"
+	spoolRejectedExt = ".rejected"
+)
+
+// spoolSeq orders segments started within the same nanosecond
+var spoolSeq uint64
+
+// lastSequence is the sequence number of the last batch spooled; sequence
+// numbers start from the time in nanoseconds, and when a spool is opened
+// are raised above the ones it holds and the one last drained from it, so
+// they keep increasing across restarts even when the clock went backwards
+var lastSequence uint64
+
+// spoolSequenceTable is the table holding the sequence number of the last
+// batch drained from each spool
+const spoolSequenceTable = "snap_spool_sequence"
+
+// errReplayed is returned for a spooled batch that was already written,
+// when a crash kept the drain from removing it
+var errReplayed = errors.New("Spooled batch was already written")
+
+// spoolFileMutex serializes appending to, sealing and rewriting segments
+var spoolFileMutex sync.Mutex
+
+// spool keeps batches in segment files named after the time they were
+// started, so the oldest segment sorts first
+type spool struct {
+	dir         string
+	maxSize     int64
+	compress    bool
+	segmentSize int64
+}
+
+// spooledBatch is the on-disk form of a batch; Seq is zero for batches
+// spooled before sequence numbers were stored
+type spooledBatch struct {
+	Seq   uint64
+	Table string
+	Rows  []spooledRow
+}
+
+// segmentBatch is a batch of a segment with its sequence number
+type segmentBatch struct {
+	seq uint64
+	tableBatch
+}
+
+// spooledRow is the on-disk form of a row
+type spooledRow struct {
+	TimePosted  string
+	Key         string
+	Value       string
+	Data        interface{}
+	JSON        bool
+	Tags        string
+	Raw         []byte
+	Unit        string
+	Version     int64
+	Description string
+}
+
+// spoolFullError is returned for a batch that does not fit spool_max_size
+type spoolFullError struct {
+	dir  string
+	size int64
+}
+
+func (e spoolFullError) Error() string {
+	return fmt.Sprintf("Spool %s is full (%d bytes)", e.dir, e.size)
+}
+
+func newSpool(cfg SpoolConfig) spool {
+	return spool{dir: cfg.Dir, maxSize: cfg.MaxSize, compress: cfg.Compress, segmentSize: cfg.SegmentSize}
+}
+
+// write appends the rows of table to the open segment with the next
+// sequence number, the segment is sealed once it reaches the segment size;
+// a crash may leave a partial batch at the end of a segment, which read
+// detects by its checksum
+func (sp spool) write(table string, rows []row) error {
+	// sequence numbers are taken in the order the batches are appended
+	spoolFileMutex.Lock()
+	defer spoolFileMutex.Unlock()
+	record, err := sp.encodeRecord(segmentBatch{seq: nextSequence(), tableBatch: tableBatch{table: table, rows: rows}})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sp.dir, 0700); err != nil {
+		return err
+	}
+	size, err := sp.size()
+	if err != nil {
+		return err
+	}
+	if size+int64(len(record)) > sp.maxSize {
+		return spoolFullError{dir: sp.dir, size: size}
+	}
+
+	name, err := sp.openSegment()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sp.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(record)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() >= sp.segmentSize {
+		return sp.seal(name)
+	}
+	return nil
+}
+
+// nextSequence returns the sequence number of the next spooled batch
+func nextSequence() uint64 {
+	for {
+		last := atomic.LoadUint64(&lastSequence)
+		next := uint64(timeNow().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&lastSequence, last, next) {
+			return next
+		}
+	}
+}
+
+// raiseSequence makes the sequence numbers taken from now on greater than
+// seq
+func raiseSequence(seq uint64) {
+	for {
+		last := atomic.LoadUint64(&lastSequence)
+		if seq <= last || atomic.CompareAndSwapUint64(&lastSequence, last, seq) {
+			return
+		}
+	}
+}
+
+// maxSequence returns the greatest sequence number of the batches in the
+// segments of the spool, set aside ones included
+func (sp spool) maxSequence() (uint64, error) {
+	infos, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var max uint64
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !strings.Contains(info.Name(), spoolExt) {
+			continue
+		}
+		// the batches before damage still hold their numbers
+		batches, _ := sp.read(info.Name())
+		for _, batch := range batches {
+			if batch.seq > max {
+				max = batch.seq
+			}
+		}
+	}
+	return max, nil
+}
+
+// openSegment returns the name of the segment batches are appended to,
+// naming a new one when none is open
+func (sp spool) openSegment() (string, error) {
+	names, err := sp.list(spoolExt + spoolOpenExt)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > 0 {
+		return names[len(names)-1], nil
+	}
+	return fmt.Sprintf("%019d-%010d%s%s", time.Now().UnixNano(), atomic.AddUint64(&spoolSeq, 1), spoolExt, spoolOpenExt), nil
+}
+
+// seal renames the open segment name so it is drained
+func (sp spool) seal(name string) error {
+	return os.Rename(filepath.Join(sp.dir, name), filepath.Join(sp.dir, strings.TrimSuffix(name, spoolOpenExt)))
+}
+
+// sealAll seals the open segments, so the batches spooled so far are
+// drained
+func (sp spool) sealAll() error {
+	spoolFileMutex.Lock()
+	defer spoolFileMutex.Unlock()
+	names, err := sp.list(spoolExt + spoolOpenExt)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := sp.seal(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recover removes the temporary files a crash left in the spool and
+// seals the open segments, so the segments of an earlier run are drained
+func (sp spool) recover() error {
+	spoolFileMutex.Lock()
+	infos, err := ioutil.ReadDir(sp.dir)
+	spoolFileMutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		// a crash before the rename of a rewrite keeps the segment
+		if isSpoolTemp(info.Name()) && !info.IsDir() {
+			if err := os.Remove(filepath.Join(sp.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return sp.sealAll()
+}
+
+// isSpoolTemp reports whether name is the temporary file of a rewrite,
+// which is named after its segment with a dot prepended
+func isSpoolTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, spoolExt) || strings.HasSuffix(name, spoolExt+spoolOpenExt))
+}
+
+// rewrite replaces the segment name by one holding only batches; it is
+// written under a temporary name and renamed, so a crash never loses the
+// batches
+func (sp spool) rewrite(name string, batches []segmentBatch) error {
+	data, err := sp.encodeRecords(batches)
+	if err != nil {
+		return err
+	}
+	spoolFileMutex.Lock()
+	defer spoolFileMutex.Unlock()
+	tmp := filepath.Join(sp.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(sp.dir, name))
+}
+
+// setAsideBatches appends batches to the segment name set aside with ext,
+// so they are kept but not drained again
+func (sp spool) setAsideBatches(name, ext string, batches []segmentBatch) error {
+	data, err := sp.encodeRecords(batches)
+	if err != nil {
+		return err
+	}
+	spoolFileMutex.Lock()
+	defer spoolFileMutex.Unlock()
+	f, err := os.OpenFile(filepath.Join(sp.dir, name+ext), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encodeRecords returns batches with their headers, one after another
+func (sp spool) encodeRecords(batches []segmentBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, batch := range batches {
+		record, err := sp.encodeRecord(batch)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(record)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeRecord returns batch with its header, its payload compressed when
+// the spool compresses
+func (sp spool) encodeRecord(batch segmentBatch) ([]byte, error) {
+	payload, err := encodeSpooled(batch)
+	if err != nil {
+		return nil, err
+	}
+	magic := spoolMagic
+	if sp.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+		magic = spoolGzipMagic
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// encodeSpooled encodes the batch with gob; values of types gob does not know
+// are kept as their string form
+func encodeSpooled(batch segmentBatch) ([]byte, error) {
+	spooled := spooledBatch{Seq: batch.seq, Table: batch.table, Rows: make([]spooledRow, len(batch.rows))}
+	for i, r := range batch.rows {
+		spooled.Rows[i] = spooledRow{TimePosted: r.timePosted, Key: r.key, Value: r.value, Data: r.data, JSON: r.json, Tags: r.tags, Raw: r.raw,
+			Unit: r.unit, Version: r.version, Description: r.description}
+		if err := gob.NewEncoder(ioutil.Discard).Encode(&spooled.Rows[i]); err != nil {
+			spooled.Rows[i].Data = r.value
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&spooled); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// read returns the batches of the segment name; when a batch is truncated
+// or its checksum does not match, the batches before it are returned with
+// the error
+func (sp spool) read(name string) ([]segmentBatch, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sp.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var batches []segmentBatch
+	for len(data) > 0 {
+		if len(data) < spoolHeaderLen {
+			return batches, fmt.Errorf("Spool file %s has no valid header", name)
+		}
+		magic := string(data[:len(spoolMagic)])
+		if magic != spoolMagic && magic != spoolGzipMagic {
+			return batches, fmt.Errorf("Spool file %s has no valid header", name)
+		}
+		length := binary.BigEndian.Uint32(data[len(spoolMagic):])
+		checksum := binary.BigEndian.Uint32(data[len(spoolMagic)+4:])
+		data = data[spoolHeaderLen:]
+		if uint32(len(data)) < length || crc32.ChecksumIEEE(data[:length]) != checksum {
+			return batches, fmt.Errorf("Spool file %s is truncated or corrupt", name)
+		}
+		payload := data[:length]
+		data = data[length:]
+
+		if magic == spoolGzipMagic {
+			zr, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return batches, fmt.Errorf("Spool file %s cannot be decompressed: %v", name, err)
+			}
+			if payload, err = ioutil.ReadAll(zr); err != nil {
+				return batches, fmt.Errorf("Spool file %s cannot be decompressed: %v", name, err)
+			}
+		}
+		var spooled spooledBatch
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&spooled); err != nil {
+			return batches, fmt.Errorf("Spool file %s cannot be decoded: %v", name, err)
+		}
+		rows := make([]row, len(spooled.Rows))
+		for i, r := range spooled.Rows {
+			rows[i] = row{timePosted: r.TimePosted, key: r.Key, value: r.Value, data: r.Data, json: r.JSON, tags: r.Tags, raw: r.Raw,
+				unit: r.Unit, version: r.Version, description: r.Description}
+		}
+		batches = append(batches, segmentBatch{seq: spooled.Seq, tableBatch: tableBatch{table: spooled.Table, rows: rows}})
+	}
+	return batches, nil
+}
+
+// files returns the names of the sealed segments, oldest first
+func (sp spool) files() ([]string, error) {
+	return sp.list(spoolExt)
+}
+
+// list returns the names of the segments ending with ext, oldest first
+func (sp spool) list(ext string) ([]string, error) {
+	infos, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ext) && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// size returns the bytes taken by the segments waiting in the spool
+// directory, sealed or open; the files set aside and the temporary files
+// of rewrites do not count against spool_max_size
+func (sp spool) size() (int64, error) {
+	size, _, err := sp.usage(spoolExt, spoolExt+spoolOpenExt)
+	return size, err
+}
+
+// setAsideUsage returns the bytes and number of the segments set aside as
+// corrupt or rejected
+func (sp spool) setAsideUsage() (int64, int, error) {
+	return sp.usage(spoolCorruptExt, spoolRejectedExt)
+}
+
+// usage returns the bytes and number of the files of the spool directory
+// with one of the extensions exts
+func (sp spool) usage(exts ...string) (int64, int, error) {
+	infos, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		size  int64
+		count int
+	)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		for _, ext := range exts {
+			if strings.HasSuffix(info.Name(), ext) {
+				size += info.Size()
+				count++
+				break
+			}
+		}
+	}
+	return size, count, nil
+}
+
+// setAside renames the spool file name so it is no longer drained
+func (sp spool) setAside(name, ext string) error {
+	return os.Rename(filepath.Join(sp.dir, name), filepath.Join(sp.dir, name+ext))
+}
+
+// replaySpool drains the segments an earlier run left in the spool of
+// cfg, once per spool directory: with spool_replay=before the publishes
+// wait until the replay finished, with background they proceed while it
+// runs
+func (s *PostgreSQLPublisher) replaySpool(ctx context.Context, cfg *publisherConfig) {
+	if cfg.Spool.Dir == "" {
+		return
+	}
+	s.mutex.Lock()
+	done, started := s.replays[cfg.Spool.Dir]
+	if !started {
+		done = make(chan struct{})
+		if s.replays == nil {
+			s.replays = make(map[string]chan struct{})
+		}
+		s.replays[cfg.Spool.Dir] = done
+	}
+	s.mutex.Unlock()
+
+	if started {
+		if cfg.Spool.Replay == spoolReplayBefore {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+		}
+		return
+	}
+	s.seedSequence(ctx, cfg)
+	replay := func(ctx context.Context) {
+		defer close(done)
+		logger := cfg.Log.logger()
+		sp := newSpool(cfg.Spool)
+		if err := sp.recover(); err != nil {
+			logger.Error(err)
+			return
+		}
+		names, err := sp.files()
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		if len(names) == 0 {
+			return
+		}
+		logger.Infof("Replaying %d spooled segments from %s", len(names), cfg.Spool.Dir)
+		s.drainSpool(ctx, cfg)
+	}
+	if cfg.Spool.Replay == spoolReplayBefore {
+		replay(ctx)
+		return
+	}
+	// Drain waits for the replay as for a publish in flight
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		ctx, cancel := publishContext(cfg)
+		defer cancel()
+		replay(ctx)
+	}()
+}
+
+// drainSpool seals the open segment and writes the spooled batches of cfg
+// oldest first, stopping at the first batch failing on a transient error;
+// the segment it stopped in is rewritten with the batches left. Batches
+// the database rejects are set aside, and a segment that cannot be read
+// to the end is set aside once the batches before the damage were written
+func (s *PostgreSQLPublisher) drainSpool(ctx context.Context, cfg *publisherConfig) {
+	logger := cfg.Log.logger()
+	s.spoolMutex.Lock()
+	defer s.spoolMutex.Unlock()
+
+	sp := newSpool(cfg.Spool)
+	if err := sp.sealAll(); err != nil {
+		logger.Error(err)
+		return
+	}
+	names, err := sp.files()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	for _, name := range names {
+		batches, readErr := sp.read(name)
+		if readErr != nil {
+			logger.Error(readErr)
+		}
+		var rejected []segmentBatch
+		for i, batch := range batches {
+			// the metrics skipped by error_policy=skip were already logged
+			err := s.write(sp.withSequence(ctx, cfg.Schema, batch.seq), cfg, batch.table, batch.rows)
+			if err == nil || isMetricErrors(err) {
+				logger.Infof("Drained %d spooled metrics from %s", len(batch.rows), name)
+				continue
+			}
+			if err == errReplayed {
+				logger.Infof("Skipped %d spooled metrics from %s, they were already written", len(batch.rows), name)
+				continue
+			}
+			logger.Errorf("Draining %s failed: %v", name, err)
+			if !isTransient(err) {
+				rejected = append(rejected, batch)
+				continue
+			}
+			if len(rejected) > 0 {
+				if err := sp.setAsideBatches(name, spoolRejectedExt, rejected); err != nil {
+					logger.Error(err)
+					return
+				}
+			}
+			if i > 0 {
+				if err := sp.rewrite(name, batches[i:]); err != nil {
+					logger.Error(err)
+				}
+			}
+			return
+		}
+		if len(rejected) > 0 {
+			if err := sp.setAsideBatches(name, spoolRejectedExt, rejected); err != nil {
+				logger.Error(err)
+				return
+			}
+		}
+		if readErr != nil {
+			if err := sp.setAside(name, spoolCorruptExt); err != nil {
+				logger.Error(err)
+				return
+			}
+			continue
+		}
+		if err := os.Remove(filepath.Join(sp.dir, name)); err != nil {
+			logger.Error(err)
+			return
+		}
+	}
+}
+
+// createSequenceTable creates the table holding the sequence number of the
+// last batch drained from each spool
+func createSequenceTable(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (spool TEXT PRIMARY KEY, sequence BIGINT NOT NULL, updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now())",
+		schema.qualify(spoolSequenceTable))
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// seedSequence raises the sequence numbers of the batches spooled from now
+// on above the ones in the spool of cfg and the one last drained from it,
+// which the sequence table keeps, so a clock that went backwards across a
+// restart does not get new batches skipped as already written
+func (s *PostgreSQLPublisher) seedSequence(ctx context.Context, cfg *publisherConfig) {
+	logger := cfg.Log.logger()
+	sp := newSpool(cfg.Spool)
+	seq, err := sp.maxSequence()
+	if err != nil {
+		logger.Error(err)
+	}
+	raiseSequence(seq)
+	err = s.attempt(ctx, cfg, func(db *sql.DB) error {
+		seq, err := storedSequence(ctx, db, cfg.Schema, sp.id())
+		raiseSequence(seq)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Cannot read the last sequence number drained from %s: %v", cfg.Spool.Dir, err)
+	}
+}
+
+// storedSequence returns the sequence number of the last batch drained
+// from the spool id, zero when none was
+func storedSequence(ctx context.Context, db *sql.DB, schema SchemaConfig, id string) (uint64, error) {
+	var seq int64
+	query := fmt.Sprintf("SELECT sequence FROM %s WHERE spool = $1", schema.qualify(spoolSequenceTable))
+	err := db.QueryRowContext(ctx, query, id).Scan(&seq)
+	if err == sql.ErrNoRows || isUndefinedTable(err) {
+		// no batch was drained yet
+		return 0, nil
+	}
+	return uint64(seq), err
+}
+
+// withSequence returns ctx with a commit hook recording seq as the last
+// sequence number drained from the spool, in the transaction writing its
+// batch; the hook fails with errReplayed when a batch as recent was
+// already drained, so the transaction is rolled back
+func (sp spool) withSequence(ctx context.Context, schema SchemaConfig, seq uint64) context.Context {
+	if seq == 0 {
+		return ctx
+	}
+	return withCommitHook(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		query := fmt.Sprintf("INSERT INTO %s AS s (spool, sequence) VALUES ($1, $2) ON CONFLICT (spool) DO UPDATE "+
+			"SET sequence = EXCLUDED.sequence, updated_at = now() WHERE s.sequence < EXCLUDED.sequence", schema.qualify(spoolSequenceTable))
+		res, err := tx.ExecContext(ctx, query, sp.id(), int64(seq))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			err = errReplayed
+		}
+		return err
+	})
+}
+
+// id identifies the spool in the sequence table by the host and the
+// absolute path of its directory
+func (sp spool) id() string {
+	host, _ := os.Hostname()
+	dir, err := filepath.Abs(sp.dir)
+	if err != nil {
+		dir = sp.dir
+	}
+	return host + ":" + dir
+}
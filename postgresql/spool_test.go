@@ -0,0 +1,405 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSpool(t *testing.T) {
+	Convey("TestSpool", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		sp := spool{dir: filepath.Join(dir, "spool"), maxSize: 1 << 20}
+
+		rows := []row{
+			{timePosted: "2017-01-02T03:04:05Z", key: "foo", value: "1", data: 1, tags: "{}", raw: []byte{1, 2}, unit: "B", version: 1},
+			{timePosted: "2017-01-02T03:04:06Z", key: "bar", value: `{"A":1}`, data: struct{ A int }{1}, json: true, tags: `{"host":"a"}`},
+		}
+
+		Convey("Batches are read back oldest first", func() {
+			So(sp.write("info", rows[:1]), ShouldBeNil)
+			So(sp.write("cpu", rows[1:]), ShouldBeNil)
+			names, err := sp.files()
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 2)
+
+			batches, err := sp.read(names[0])
+			So(err, ShouldBeNil)
+			So(len(batches), ShouldEqual, 1)
+			So(batches[0].tableBatch, ShouldResemble, tableBatch{table: "info", rows: rows[:1]})
+			batches, err = sp.read(names[1])
+			So(err, ShouldBeNil)
+			So(batches[0].table, ShouldEqual, "cpu")
+			read := batches[0].rows
+			So(read[0].data, ShouldEqual, `{"A":1}`)
+			So(read[0].json, ShouldBeTrue)
+			So(read[0].tags, ShouldEqual, `{"host":"a"}`)
+		})
+
+		Convey("Batches are appended to a segment until it reaches the segment size", func() {
+			sp.compress = true
+			sp.segmentSize = 1 << 10
+			So(sp.write("info", rows[:1]), ShouldBeNil)
+			So(sp.write("cpu", rows[1:]), ShouldBeNil)
+			names, err := sp.files()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+			open, err := sp.list(spoolExt + spoolOpenExt)
+			So(err, ShouldBeNil)
+			So(len(open), ShouldEqual, 1)
+
+			So(sp.sealAll(), ShouldBeNil)
+			names, err = sp.files()
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 1)
+			data, err := ioutil.ReadFile(filepath.Join(sp.dir, names[0]))
+			So(err, ShouldBeNil)
+			So(string(data[:len(spoolGzipMagic)]), ShouldEqual, spoolGzipMagic)
+			batches, err := sp.read(names[0])
+			So(err, ShouldBeNil)
+			So(len(batches), ShouldEqual, 2)
+			So(batches[0].tableBatch, ShouldResemble, tableBatch{table: "info", rows: rows[:1]})
+			So(batches[1].seq, ShouldBeGreaterThan, batches[0].seq)
+			So(batches[1].table, ShouldEqual, "cpu")
+
+			sp.segmentSize = 1
+			So(sp.write("info", rows), ShouldBeNil)
+			names, err = sp.files()
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 2)
+		})
+
+		Convey("The batches before a truncated one are read", func() {
+			sp.segmentSize = 1 << 10
+			So(sp.write("info", rows[:1]), ShouldBeNil)
+			So(sp.write("cpu", rows[1:]), ShouldBeNil)
+			So(sp.sealAll(), ShouldBeNil)
+			names, err := sp.files()
+			So(err, ShouldBeNil)
+			path := filepath.Join(sp.dir, names[0])
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(path, data[:len(data)-1], 0600), ShouldBeNil)
+			batches, err := sp.read(names[0])
+			So(err, ShouldNotBeNil)
+			So(len(batches), ShouldEqual, 1)
+			So(batches[0].tableBatch, ShouldResemble, tableBatch{table: "info", rows: rows[:1]})
+		})
+
+		Convey("Truncated files are detected", func() {
+			So(sp.write("info", rows), ShouldBeNil)
+			names, err := sp.files()
+			So(err, ShouldBeNil)
+			path := filepath.Join(sp.dir, names[0])
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(path, data[:len(data)-1], 0600), ShouldBeNil)
+			_, err = sp.read(names[0])
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A full spool rejects batches", func() {
+			sp.maxSize = 16
+			So(sp.write("info", rows), ShouldNotBeNil)
+			names, err := sp.files()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+		})
+
+		Convey("Set aside and temporary files do not fill the spool", func() {
+			So(sp.write("info", rows[:1]), ShouldBeNil)
+			size, err := sp.size()
+			So(err, ShouldBeNil)
+			So(size, ShouldBeGreaterThan, 0)
+			for _, name := range []string{"1" + spoolExt + spoolCorruptExt, "2" + spoolExt + spoolRejectedExt, ".3" + spoolExt} {
+				So(ioutil.WriteFile(filepath.Join(sp.dir, name), make([]byte, 64), 0600), ShouldBeNil)
+			}
+			sp.maxSize = 2*size + 32
+			So(sp.write("info", rows[:1]), ShouldBeNil)
+			setAside, count, err := sp.setAsideUsage()
+			So(err, ShouldBeNil)
+			So(setAside, ShouldEqual, 128)
+			So(count, ShouldEqual, 2)
+		})
+	})
+}
+
+func TestPublishSpool(t *testing.T) {
+	Convey("TestPublishSpool", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["retry_count"] = int64(0)
+		config["spool_dir"] = dir
+		metric := func(name string, value int) []plugin.Metric {
+			return []plugin.Metric{
+				{Namespace: plugin.NewNamespace(name), Timestamp: time.Now(), Data: value},
+			}
+		}
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		cfg, err := sp.configs.get(config)
+		So(err, ShouldBeNil)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "53300", Message: "too many connections"})
+		mock.ExpectRollback()
+		So(sp.Publish(metric("foo", 1), config), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+		names, err := newSpool(cfg.Spool).files()
+		So(err, ShouldBeNil)
+		So(len(names), ShouldEqual, 1)
+
+		Convey("The next successful publish drains the spool", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metric("bar", 2), config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			names, err := newSpool(cfg.Spool).files()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+		})
+
+		Convey("Corrupt batches are set aside", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, names[0]), []byte("garbage"), 0600), ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish(metric("bar", 2), config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			_, err := os.Stat(filepath.Join(dir, names[0]+spoolCorruptExt))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("With queue_full drop batches the full spool cannot take are dropped", func() {
+			config["spool_max_size"] = int64(1)
+			config["queue_full"] = "drop"
+			So(ioutil.WriteFile(filepath.Join(dir, "filler"+spoolExt), make([]byte, 1<<20), 0600), ShouldBeNil)
+			sp, mock, err := newMockPublisher(config)
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "53300", Message: "too many connections"})
+			mock.ExpectRollback()
+			So(sp.Publish(metric("bar", 2), config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(sp.stats.dropped, ShouldEqual, 1)
+		})
+
+		Convey("Permanent errors are not spooled", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "28P01", Message: "password authentication failed"})
+			mock.ExpectRollback()
+			So(sp.Publish(metric("bar", 2), config), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			names, err := newSpool(cfg.Spool).files()
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestDrainSegment(t *testing.T) {
+	Convey("TestDrainSegment", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["retry_count"] = int64(0)
+		config["spool_dir"] = dir
+		config["spool_segment_size"] = int64(1)
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		cfg, err := sp.configs.get(config)
+		So(err, ShouldBeNil)
+
+		spooled := newSpool(cfg.Spool)
+		So(spooled.write("info", []row{{timePosted: "2017-01-02T03:04:05Z", key: "foo", value: "1", tags: "{}"}}), ShouldBeNil)
+		So(spooled.write("info", []row{{timePosted: "2017-01-02T03:04:06Z", key: "bar", value: "2", tags: "{}"}}), ShouldBeNil)
+
+		Convey("A drain stopped midway keeps the batches left in the segment", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "53300", Message: "too many connections"})
+			mock.ExpectRollback()
+			sp.drainSpool(context.Background(), cfg)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+			names, err := spooled.files()
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 1)
+			batches, err := spooled.read(names[0])
+			So(err, ShouldBeNil)
+			So(len(batches), ShouldEqual, 1)
+			So(batches[0].rows[0].key, ShouldEqual, "bar")
+		})
+
+		Convey("Batches drained before a crash are not written again", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			sp.drainSpool(context.Background(), cfg)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+			names, err := spooled.files()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+			rejected, err := spooled.list(spoolRejectedExt)
+			So(err, ShouldBeNil)
+			So(rejected, ShouldBeEmpty)
+		})
+
+		Convey("Rejected batches are set aside and the others drained", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "42501", Message: "permission denied"})
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			sp.drainSpool(context.Background(), cfg)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+			names, err := spooled.files()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+			rejected, err := spooled.list(spoolRejectedExt)
+			So(err, ShouldBeNil)
+			So(len(rejected), ShouldEqual, 1)
+			batches, err := spooled.read(rejected[0])
+			So(err, ShouldBeNil)
+			So(batches[0].rows[0].key, ShouldEqual, "foo")
+		})
+	})
+}
+
+func TestReplaySpool(t *testing.T) {
+	Convey("TestReplaySpool", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["spool_dir"] = dir
+		config["spool_segment_size"] = int64(1)
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		cfg, err := sp.configs.get(config)
+		So(err, ShouldBeNil)
+		sp.replays = nil
+
+		// an earlier run left an open segment and an interrupted rewrite
+		So(newSpool(cfg.Spool).write("info", []row{{timePosted: "2017-01-02T03:04:05Z", key: "foo", value: "1", tags: "{}"}}), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, ".0-0"+spoolExt), []byte("partial"), 0600), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, ".gitkeep"), nil, 0600), ShouldBeNil)
+
+		Convey("The segments of an earlier run are written before the first publish", func() {
+			mock.ExpectQuery("^SELECT sequence FROM \"snap_spool_sequence\" (.+)$").WillReturnRows(sqlmock.NewRows([]string{"sequence"}))
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "foo", "1", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"snap_spool_sequence\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WithArgs(sqlmock.AnyArg(), "bar", "2", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(sp.Publish([]plugin.Metric{{Namespace: plugin.NewNamespace("bar"), Timestamp: time.Now(), Data: 2}}, config), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+			// files the plugin does not own are kept
+			infos, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(len(infos), ShouldEqual, 1)
+			So(infos[0].Name(), ShouldEqual, ".gitkeep")
+
+			// the replay runs once per spool directory
+			So(newSpool(cfg.Spool).write("info", []row{{key: "baz"}}), ShouldBeNil)
+			sp.replaySpool(context.Background(), cfg)
+			open, err := newSpool(cfg.Spool).list(spoolExt + spoolOpenExt)
+			So(err, ShouldBeNil)
+			So(len(open), ShouldEqual, 1)
+		})
+
+		Convey("Sequence numbers stay above the spooled and drained ones when the clock goes back", func() {
+			defer func() { timeNow = time.Now }()
+			segments := newSpool(cfg.Spool)
+			open, err := segments.list(spoolExt + spoolOpenExt)
+			So(err, ShouldBeNil)
+			batches, err := segments.read(open[0])
+			So(err, ShouldBeNil)
+			spooled := batches[0].seq
+			timeNow = func() time.Time { return time.Unix(0, int64(spooled)).Add(-time.Hour) }
+			atomic.StoreUint64(&lastSequence, 0)
+
+			mock.ExpectQuery("^SELECT sequence FROM \"snap_spool_sequence\" (.+)$").WillReturnRows(sqlmock.NewRows([]string{"sequence"}))
+			sp.seedSequence(context.Background(), cfg)
+			So(nextSequence(), ShouldBeGreaterThan, spooled)
+
+			drained := spooled + uint64(time.Minute)
+			mock.ExpectQuery("^SELECT sequence FROM \"snap_spool_sequence\" (.+)$").WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(int64(drained)))
+			sp.seedSequence(context.Background(), cfg)
+			So(nextSequence(), ShouldBeGreaterThan, drained)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,376 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// failure categories of the failures counter
+const (
+	failureConfig     = "config"
+	failureData       = "data"
+	failureConnection = "connection"
+	failureTransient  = "transient"
+	failurePermanent  = "permanent"
+)
+
+// latencyBuckets are the upper bounds in seconds of the write latency
+// histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// stats counts what the publisher did since it started
+type stats struct {
+	mutex       sync.Mutex
+	publishes   uint64
+	batches     uint64
+	rowsWritten uint64
+	retries     uint64
+	spooled     uint64
+	dropped     uint64
+	filtered    uint64
+	// lost counts the rows found missing on the replica of
+	// verify_replica_uri
+	lost     uint64
+	failures map[string]uint64
+	// latency is a histogram of the time writing a batch took, retries
+	// included; latencyCounts[i] counts the writes up to latencyBuckets[i]
+	latencyCounts []uint64
+	latencySum    float64
+	latencyCount  uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		failures:      make(map[string]uint64),
+		latencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (st *stats) publish() {
+	st.mutex.Lock()
+	st.publishes++
+	st.mutex.Unlock()
+}
+
+func (st *stats) retry() {
+	st.mutex.Lock()
+	st.retries++
+	st.mutex.Unlock()
+}
+
+func (st *stats) spool() {
+	st.mutex.Lock()
+	st.spooled++
+	st.mutex.Unlock()
+}
+
+func (st *stats) drop(rows int) {
+	st.mutex.Lock()
+	st.dropped += uint64(rows)
+	st.mutex.Unlock()
+}
+
+func (st *stats) filter(metrics int) {
+	st.mutex.Lock()
+	st.filtered += uint64(metrics)
+	st.mutex.Unlock()
+}
+
+func (st *stats) lose(rows int64) {
+	st.mutex.Lock()
+	st.lost += uint64(rows)
+	st.mutex.Unlock()
+}
+
+func (st *stats) fail(category string) {
+	st.mutex.Lock()
+	st.failures[category]++
+	st.mutex.Unlock()
+}
+
+// written returns the number of rows written
+func (st *stats) written() uint64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.rowsWritten
+}
+
+// write records a batch of rows written in d
+func (st *stats) write(rows int, d time.Duration) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.batches++
+	st.rowsWritten += uint64(rows)
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			st.latencyCounts[i]++
+		}
+	}
+	st.latencySum += seconds
+	st.latencyCount++
+}
+
+// failureCategory returns the failures category of a write error
+func failureCategory(err error) string {
+	switch {
+	case isConnectionError(err):
+		return failureConnection
+	case isTransient(err):
+		return failureTransient
+	}
+	return failurePermanent
+}
+
+// gauges are the current values reported along with the counters
+type gauges struct {
+	queued      int
+	queuedBytes int64
+	spoolFiles  int
+	spoolBytes  int64
+	// setAsideFiles and setAsideBytes are the spool segments set aside as
+	// corrupt or rejected, kept for inspection
+	setAsideFiles int
+	setAsideBytes int64
+}
+
+// gauges returns the current length of the async queues and size of the
+// spools of the configs prepared
+func (s *PostgreSQLPublisher) gauges() gauges {
+	var g gauges
+	spools := make(map[string]SpoolConfig)
+	s.mutex.Lock()
+	for _, q := range s.queues {
+		g.queued += len(q.batches)
+		g.queuedBytes += q.size()
+	}
+	for cfg := range s.prepared {
+		if cfg.Spool.Dir != "" {
+			spools[cfg.Spool.Dir] = cfg.Spool
+		}
+	}
+	s.mutex.Unlock()
+	for _, opts := range spools {
+		sp := newSpool(opts)
+		if names, err := sp.files(); err == nil {
+			g.spoolFiles += len(names)
+		}
+		if size, err := sp.size(); err == nil {
+			g.spoolBytes += size
+		}
+		if size, count, err := sp.setAsideUsage(); err == nil {
+			g.setAsideBytes += size
+			g.setAsideFiles += count
+		}
+	}
+	return g
+}
+
+// writeTo writes the counters and gauges in the Prometheus text format
+func (st *stats) writeTo(buf *bytes.Buffer, g gauges) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(buf, "# HELP snap_postgresql_%s %s\n# TYPE snap_postgresql_%s %s\n", name, help, name, kind)
+	}
+	metric("publishes_total", "counter", "Publishes received.")
+	fmt.Fprintf(buf, "snap_postgresql_publishes_total %d\n", st.publishes)
+	metric("batches_written_total", "counter", "Batches written to a table.")
+	fmt.Fprintf(buf, "snap_postgresql_batches_written_total %d\n", st.batches)
+	metric("rows_written_total", "counter", "Rows written.")
+	fmt.Fprintf(buf, "snap_postgresql_rows_written_total %d\n", st.rowsWritten)
+	metric("retries_total", "counter", "Writes retried after a transient error.")
+	fmt.Fprintf(buf, "snap_postgresql_retries_total %d\n", st.retries)
+	metric("spooled_batches_total", "counter", "Batches saved to the spool.")
+	fmt.Fprintf(buf, "snap_postgresql_spooled_batches_total %d\n", st.spooled)
+	metric("dropped_rows_total", "counter", "Rows dropped because the async queue or the spool was full.")
+	fmt.Fprintf(buf, "snap_postgresql_dropped_rows_total %d\n", st.dropped)
+	metric("filtered_metrics_total", "counter", "Metrics not written because of namespace_include or namespace_exclude.")
+	fmt.Fprintf(buf, "snap_postgresql_filtered_metrics_total %d\n", st.filtered)
+	metric("replica_missing_rows_total", "counter", "Rows of verified batches missing on the replica of verify_replica_uri.")
+	fmt.Fprintf(buf, "snap_postgresql_replica_missing_rows_total %d\n", st.lost)
+
+	metric("failures_total", "counter", "Failed publishes and writes by category.")
+	var categories []string
+	for category := range st.failures {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fmt.Fprintf(buf, "snap_postgresql_failures_total{category=%q} %d\n", category, st.failures[category])
+	}
+
+	metric("write_duration_seconds", "histogram", "Time writing a batch took, retries included.")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(buf, "snap_postgresql_write_duration_seconds_bucket{le=\"%g\"} %d\n", bound, st.latencyCounts[i])
+	}
+	fmt.Fprintf(buf, "snap_postgresql_write_duration_seconds_bucket{le=\"+Inf\"} %d\n", st.latencyCount)
+	fmt.Fprintf(buf, "snap_postgresql_write_duration_seconds_sum %g\n", st.latencySum)
+	fmt.Fprintf(buf, "snap_postgresql_write_duration_seconds_count %d\n", st.latencyCount)
+
+	metric("queued_batches", "gauge", "Batches waiting in the async queue.")
+	fmt.Fprintf(buf, "snap_postgresql_queued_batches %d\n", g.queued)
+	metric("queued_bytes", "gauge", "Approximate size of the rows held by the async queue.")
+	fmt.Fprintf(buf, "snap_postgresql_queued_bytes %d\n", g.queuedBytes)
+	metric("spool_files", "gauge", "Batches waiting in the spool.")
+	fmt.Fprintf(buf, "snap_postgresql_spool_files %d\n", g.spoolFiles)
+	metric("spool_bytes", "gauge", "Size of the batches waiting in the spool.")
+	fmt.Fprintf(buf, "snap_postgresql_spool_bytes %d\n", g.spoolBytes)
+	metric("spool_set_aside_files", "gauge", "Spool segments set aside as corrupt or rejected.")
+	fmt.Fprintf(buf, "snap_postgresql_spool_set_aside_files %d\n", g.setAsideFiles)
+	metric("spool_set_aside_bytes", "gauge", "Size of the spool segments set aside as corrupt or rejected.")
+	fmt.Fprintf(buf, "snap_postgresql_spool_set_aside_bytes %d\n", g.setAsideBytes)
+}
+
+// fields returns the counters and gauges as log fields
+func (st *stats) fields(g gauges) log.Fields {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	fields := log.Fields{
+		"publishes":             st.publishes,
+		"batches":               st.batches,
+		"rows_written":          st.rowsWritten,
+		"retries":               st.retries,
+		"spooled":               st.spooled,
+		"dropped_rows":          st.dropped,
+		"filtered":              st.filtered,
+		"replica_missing_rows":  st.lost,
+		"queued":                g.queued,
+		"queued_bytes":          g.queuedBytes,
+		"spool_files":           g.spoolFiles,
+		"spool_bytes":           g.spoolBytes,
+		"spool_set_aside_files": g.setAsideFiles,
+		"spool_set_aside_bytes": g.setAsideBytes,
+		"write_seconds":         st.latencySum,
+	}
+	for category, n := range st.failures {
+		fields["failures_"+category] = n
+	}
+	return fields
+}
+
+// statsListenRetry is the backoff between the attempts to listen on a
+// stats_listen address that could not be listened on
+var statsListenRetry = RetryConfig{InitialDelay: 5 * time.Second, MaxDelay: 5 * time.Minute}
+
+// statsReporter serves the stats over HTTP and logs them periodically,
+// as configured in opts
+type statsReporter struct {
+	opts     StatsConfig
+	listener net.Listener
+	stop     chan struct{}
+	// failures counts the failed attempts to listen on opts.Listen in a
+	// row, and retryAt is when the next one is due
+	failures int
+	retryAt  time.Time
+	// used is when a publish last asked for the reporter
+	used time.Time
+}
+
+// reportStats starts reporting the stats as configured in opts, keeping
+// a reporter for each options; an address that cannot be listened on is
+// retried with backoff on later calls, while the stats are still logged
+func (s *PostgreSQLPublisher) reportStats(opts StatsConfig) error {
+	if opts.Listen == "" && opts.LogInterval == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r := s.reporters[opts]; r != nil {
+		r.used = timeNow()
+		return r.listen(s)
+	}
+	r := &statsReporter{opts: opts, stop: make(chan struct{}), used: timeNow()}
+	for _, other := range s.reporters {
+		// the backoff carries over to the reporters of the same address
+		if other.listener == nil && other.opts.Listen == opts.Listen && other.failures > r.failures {
+			r.failures, r.retryAt = other.failures, other.retryAt
+		}
+	}
+
+	if opts.LogInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.LogInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					newLogger().WithFields(s.stats.fields(s.gauges())).Info("Publisher stats")
+				case <-r.stop:
+					return
+				}
+			}
+		}()
+	}
+	if s.reporters == nil {
+		s.reporters = make(map[StatsConfig]*statsReporter)
+	}
+	s.reporters[opts] = r
+	return r.listen(s)
+}
+
+// listen starts serving the stats of s on opts.Listen unless it or
+// another reporter of s already does or the retry after a failed attempt
+// is not due yet; s.mutex must be held
+func (r *statsReporter) listen(s *PostgreSQLPublisher) error {
+	if r.opts.Listen == "" || r.listener != nil || time.Now().Before(r.retryAt) {
+		return nil
+	}
+	for _, other := range s.reporters {
+		if other.listener != nil && other.opts.Listen == r.opts.Listen {
+			return nil
+		}
+	}
+	listener, err := net.Listen("tcp", r.opts.Listen)
+	if err != nil {
+		delay := statsListenRetry.backoff(r.failures)
+		r.failures++
+		r.retryAt = time.Now().Add(delay)
+		return fmt.Errorf("Error listening for stats on %s, retrying in %v: %v", r.opts.Listen, delay, err)
+	}
+	r.failures = 0
+	r.listener = listener
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		s.stats.writeTo(&buf, s.gauges())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// close stops serving and logging the stats
+func (r *statsReporter) close() {
+	close(r.stop)
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
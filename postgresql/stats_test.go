@@ -0,0 +1,145 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStats(t *testing.T) {
+	Convey("TestStats", t, func() {
+		st := newStats()
+		st.publish()
+		st.write(3, 20*time.Millisecond)
+		st.write(2, 2*time.Second)
+		st.retry()
+		st.fail(failureConnection)
+		st.fail(failureConnection)
+
+		var buf bytes.Buffer
+		st.writeTo(&buf, gauges{queued: 4})
+		text := buf.String()
+		So(text, ShouldContainSubstring, "snap_postgresql_publishes_total 1\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_batches_written_total 2\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_rows_written_total 5\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_retries_total 1\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_failures_total{category=\"connection\"} 2\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_write_duration_seconds_bucket{le=\"0.01\"} 0\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_write_duration_seconds_bucket{le=\"0.025\"} 1\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_write_duration_seconds_bucket{le=\"2.5\"} 2\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_write_duration_seconds_bucket{le=\"+Inf\"} 2\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_write_duration_seconds_count 2\n")
+		So(text, ShouldContainSubstring, "snap_postgresql_queued_batches 4\n")
+
+		fields := st.fields(gauges{})
+		So(fields["rows_written"], ShouldEqual, uint64(5))
+		So(fields["failures_connection"], ShouldEqual, uint64(2))
+	})
+}
+
+func TestFailureCategory(t *testing.T) {
+	Convey("TestFailureCategory", t, func() {
+		So(failureCategory(driver.ErrBadConn), ShouldEqual, failureConnection)
+		So(failureCategory(&pq.Error{Code: "40001"}), ShouldEqual, failureTransient)
+		So(failureCategory(errors.New("syntax error")), ShouldEqual, failurePermanent)
+	})
+}
+
+func TestReportStats(t *testing.T) {
+	Convey("TestReportStats", t, func() {
+		s := NewPostgreSQLPublisher()
+		So(s.reportStats(StatsConfig{}), ShouldBeNil)
+		So(s.reporters, ShouldBeEmpty)
+
+		opts := StatsConfig{Listen: "127.0.0.1:0"}
+		So(s.reportStats(opts), ShouldBeNil)
+		reporter := s.reporters[opts]
+		So(reporter, ShouldNotBeNil)
+		So(s.reportStats(opts), ShouldBeNil)
+		So(s.reporters[opts], ShouldEqual, reporter)
+
+		s.stats.publish()
+		resp, err := http.Get("http://" + reporter.listener.Addr().String() + "/metrics")
+		So(err, ShouldBeNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(body), ShouldContainSubstring, "snap_postgresql_publishes_total 1\n")
+
+		// the reporter of other options does not replace it
+		logged := StatsConfig{LogInterval: time.Hour}
+		So(s.reportStats(logged), ShouldBeNil)
+		So(s.reporters, ShouldHaveLength, 2)
+		So(s.reporters[opts], ShouldEqual, reporter)
+
+		defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+		now := time.Now().Add(idleTimeout + time.Second)
+		timeNow = func() time.Time { return now }
+		So(s.reportStats(logged), ShouldBeNil)
+		s.closeIdle()
+		So(s.reporters, ShouldHaveLength, 1)
+		So(s.reporters[logged], ShouldNotBeNil)
+		_, err = net.Dial("tcp", reporter.listener.Addr().String())
+		So(err, ShouldNotBeNil)
+		timeNow = time.Now
+
+		Convey("An address in use is retried with backoff", func() {
+			taken, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			opts := StatsConfig{Listen: taken.Addr().String()}
+			So(s.reportStats(opts), ShouldNotBeNil)
+			reporter := s.reporters[opts]
+			So(reporter, ShouldNotBeNil)
+			So(reporter.listener, ShouldBeNil)
+			So(reporter.retryAt, ShouldHappenAfter, time.Now())
+
+			So(s.reportStats(opts), ShouldBeNil)
+			So(reporter.failures, ShouldEqual, 1)
+			other := StatsConfig{Listen: opts.Listen, LogInterval: time.Hour}
+			So(s.reportStats(other), ShouldBeNil)
+			So(s.reporters[other].failures, ShouldEqual, 1)
+
+			taken.Close()
+			s.reporters[other].retryAt = time.Time{}
+			So(s.reportStats(other), ShouldBeNil)
+			So(s.reporters[other].listener, ShouldNotBeNil)
+			So(s.reporters[other].failures, ShouldEqual, 0)
+
+			// the address is served once
+			reporter.retryAt = time.Time{}
+			So(s.reportStats(opts), ShouldBeNil)
+			So(reporter.listener, ShouldBeNil)
+			s.Drain()
+		})
+	})
+}
@@ -0,0 +1,850 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+	"github.com/lib/pq"
+)
+
+// baseColumns are the columns every metrics table has besides its id
+const baseColumns = "time_posted timestamp with time zone, key_column VARCHAR(200)"
+
+// wideBaseColumns are the columns a table of the wide schema is created
+// with besides its id, a column is added for every namespace published
+// into it
+const wideBaseColumns = "time_posted timestamp with time zone"
+
+const (
+	// textColumns hold the values of the text schema
+	textColumns = "value_column VARCHAR(200)"
+	// typedColumns hold the values of the typed schema, one per type
+	typedColumns = "value_int BIGINT, value_float DOUBLE PRECISION, value_string TEXT, value_bool BOOLEAN"
+)
+
+// metadataColumns hold the unit, version and description of the metrics
+// when the schema stores them
+const metadataColumns = "unit TEXT, metric_version BIGINT, description TEXT"
+
+// batchIDColumn holds the id of the batch a row was written with when the
+// schema stores it
+const batchIDColumn = "batch_id uuid"
+
+// maxQueryParams is the number of parameters the wire protocol allows
+// per statement
+const maxQueryParams = 65535
+
+// tableColumns returns the column definitions of a table created for schema
+func tableColumns(schema SchemaConfig) string {
+	columns := []string{schema.idColumn(), baseColumns, textColumns, "tags jsonb"}
+	if schema.Layout == schemaTyped {
+		columns[2] = typedColumns
+	}
+	if schema.Layout == schemaWide {
+		columns = []string{schema.idColumn(), wideBaseColumns, "tags jsonb"}
+	}
+	if schema.jsonValues() {
+		columns = append(columns, "value_json jsonb")
+	}
+	if schema.Metadata {
+		columns = append(columns, metadataColumns)
+	}
+	if schema.BatchID {
+		columns = append(columns, batchIDColumn)
+	}
+	if schema.TimeBucket != "" {
+		columns = append(columns, "time_bucket timestamp with time zone")
+	}
+	if schema.InsertedAt {
+		columns = append(columns, "inserted_at timestamp with time zone DEFAULT now()")
+	}
+	if schema.ArchiveRaw {
+		columns = append(columns, "raw_payload bytea")
+	}
+	columns = append(columns, schema.GeneratedColumns...)
+	// the primary key of a partitioned table has to include the partition key
+	if schema.HashPartitions > 0 {
+		columns = append(columns, "PRIMARY KEY (id, key_column)")
+	} else if schema.TimescaleDB || schema.TimePartitioning != "" {
+		columns = append(columns, "PRIMARY KEY (id, time_posted)")
+	} else {
+		columns = append(columns, "PRIMARY KEY (id)")
+	}
+	return "(" + strings.Join(columns, ", ") + ")"
+}
+
+// idColumn returns the definition of the id column: a SERIAL, or on
+// CockroachDB, where sequences serialize the inserts, a unique_rowid()
+func (s SchemaConfig) idColumn() string {
+	if s.Dialect == dialectCockroachDB {
+		return "id INT8 DEFAULT unique_rowid()"
+	}
+	return "id SERIAL"
+}
+
+func createTable(ctx context.Context, db *sql.DB, schema SchemaConfig) (bool, error) {
+	logger := ctxLogger(ctx)
+	table := schema.quotedTable()
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", table, tableColumns(schema))
+	if schema.HashPartitions > 0 {
+		query += " PARTITION BY HASH (key_column)"
+	} else if schema.TimePartitioning != "" {
+		query += " PARTITION BY RANGE (time_posted)"
+	}
+	err := execCreate(ctx, db, query)
+	if err != nil {
+		logger.Error(err)
+		return false, err
+	}
+	if schema.TimescaleDB {
+		if err := createHypertable(ctx, db, schema); err != nil {
+			logger.Error(err)
+			return false, err
+		}
+	}
+	for i := 0; i < schema.HashPartitions; i++ {
+		partition := schema.qualify(fmt.Sprintf("%s_p%d", schema.TableName, i))
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+			partition, table, schema.HashPartitions, i)
+		err = execCreate(ctx, db, query)
+		if err != nil {
+			logger.Error(err)
+			return false, err
+		}
+	}
+	if schema.Layout != schemaWide {
+		query = fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s on %s (key_column)", pq.QuoteIdentifier(indexName(schema.TableName, "key")), table)
+		err = execCreateIndex(ctx, db, query)
+		if err != nil {
+			logger.Error(err)
+			return false, err
+		}
+	}
+	err = execCreateIndex(ctx, db, tagsIndexQuery(schema))
+	if err != nil {
+		logger.Error(err)
+		return false, err
+	}
+	if schema.Dedupe != "" {
+		if err = execCreateIndex(ctx, db, dedupeIndexQuery(schema)); err != nil {
+			logger.Error(err)
+			return false, err
+		}
+	}
+	if schema.BatchID {
+		if err = execCreateIndex(ctx, db, batchIndexQuery(schema)); err != nil {
+			logger.Error(err)
+			return false, err
+		}
+	}
+	return true, err
+}
+
+// execCreate runs a CREATE TABLE or SCHEMA ... IF NOT EXISTS statement;
+// IF NOT EXISTS does not guard against a publisher creating the same
+// relation concurrently, so the errors of a relation created meanwhile
+// are ignored
+func execCreate(ctx context.Context, db *sql.DB, query string) error {
+	_, err := db.ExecContext(ctx, query)
+	if isDuplicateRelation(err) {
+		return nil
+	}
+	return err
+}
+
+// execCreateIndex runs a CREATE INDEX ... IF NOT EXISTS statement; only
+// the unique_violation raised on the catalogs when a publisher creates the
+// same index concurrently is ignored, as a duplicate_table error means
+// the name is taken by another relation
+func execCreateIndex(ctx context.Context, db *sql.DB, query string) error {
+	_, err := db.ExecContext(ctx, query)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && strings.HasPrefix(pqErr.Constraint, "pg_") {
+		return nil
+	}
+	return err
+}
+
+// indexKinds are the kinds of the indexes createTable and upgradeTable
+// name with indexName
+var indexKinds = []string{"key", "tags", "dedupe", "batch"}
+
+// indexName returns the name of the kind index of table,
+// <table>_<kind>_index
+func indexName(table, kind string) string {
+	return suffixedName(table, "_"+kind+"_index")
+}
+
+// suffixedName returns name followed by suffix; when that is longer than
+// maxIdentifierLength, which PostgreSQL would truncate into the name of
+// another relation, name is cut short and followed by a hash of it
+func suffixedName(name, suffix string) string {
+	if len(name)+len(suffix) <= maxIdentifierLength {
+		return name + suffix
+	}
+	hash := fmt.Sprintf("_%08x", crc32.ChecksumIEEE([]byte(name)))
+	n := maxIdentifierLength - len(hash) - len(suffix)
+	// cut on a character boundary
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + hash + suffix
+}
+
+// isUndefinedTable reports whether err is PostgreSQL's undefined_table
+// error
+func isUndefinedTable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "42P01"
+}
+
+// isUndefinedColumn reports whether err is PostgreSQL's undefined_column
+// error
+func isUndefinedColumn(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "42703"
+}
+
+// isDuplicateRelation reports whether err means a relation or schema was
+// created concurrently: the duplicate_table, duplicate_schema and
+// duplicate_object errors, or the unique_violation raised on the catalogs
+// when two CREATE ... IF NOT EXISTS race
+func isDuplicateRelation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case "42P07", "42P06", "42710":
+		return true
+	case "23505":
+		return strings.HasPrefix(pqErr.Constraint, "pg_")
+	}
+	return false
+}
+
+// tagsIndexQuery returns the statement creating the GIN index that lets
+// rows be looked up by tag, e.g. WHERE tags @> '{"host": "a"}'
+func tagsIndexQuery(schema SchemaConfig) string {
+	// CockroachDB indexes JSON with its own syntax
+	if schema.Dialect == dialectCockroachDB {
+		return fmt.Sprintf("CREATE INVERTED INDEX IF NOT EXISTS %s on %s (tags)",
+			pq.QuoteIdentifier(indexName(schema.TableName, "tags")), schema.quotedTable())
+	}
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s on %s USING GIN (tags)",
+		pq.QuoteIdentifier(indexName(schema.TableName, "tags")), schema.quotedTable())
+}
+
+// dedupeIndexQuery returns the statement creating the unique index the
+// inserts of the dedupe modes resolve their conflicts on
+func dedupeIndexQuery(schema SchemaConfig) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s on %s (key_column, time_posted)",
+		pq.QuoteIdentifier(indexName(schema.TableName, "dedupe")), schema.quotedTable())
+}
+
+// batchIndexQuery returns the statement creating the index the rows of a
+// batch are counted with
+func batchIndexQuery(schema SchemaConfig) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s on %s (batch_id)",
+		pq.QuoteIdentifier(indexName(schema.TableName, "batch")), schema.quotedTable())
+}
+
+// upgradeTable adds the optional columns enabled in schema to a table
+// created before they were enabled; a missing table is left to createTable
+func upgradeTable(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	// tables created before tags were stored
+	query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS tags jsonb", schema.quotedTable())
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	exists, err := tableExists(ctx, db, schema.quotedTable())
+	if err != nil {
+		return err
+	}
+	if exists {
+		if _, err := db.ExecContext(ctx, tagsIndexQuery(schema)); err != nil {
+			return err
+		}
+		// fails while the table holds duplicates
+		if schema.Dedupe != "" {
+			if _, err := db.ExecContext(ctx, dedupeIndexQuery(schema)); err != nil {
+				return err
+			}
+		}
+	}
+	if schema.Layout == schemaTyped {
+		// tables of the text schema keep value_column for their old rows
+		var add []string
+		for _, column := range strings.Split(typedColumns, ", ") {
+			add = append(add, "ADD COLUMN IF NOT EXISTS "+column)
+		}
+		if schema.jsonValues() {
+			add = append(add, "ADD COLUMN IF NOT EXISTS value_json jsonb")
+		}
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s %s", schema.quotedTable(), strings.Join(add, ", "))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if schema.Metadata {
+		var add []string
+		for _, column := range strings.Split(metadataColumns, ", ") {
+			add = append(add, "ADD COLUMN IF NOT EXISTS "+column)
+		}
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s %s", schema.quotedTable(), strings.Join(add, ", "))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if schema.BatchID {
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS %s", schema.quotedTable(), batchIDColumn)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+		if exists {
+			if _, err := db.ExecContext(ctx, batchIndexQuery(schema)); err != nil {
+				return err
+			}
+		}
+	}
+	if schema.TimeBucket != "" {
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS time_bucket timestamp with time zone", schema.quotedTable())
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if schema.InsertedAt {
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS inserted_at timestamp with time zone DEFAULT now()", schema.quotedTable())
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if schema.ArchiveRaw {
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS raw_payload bytea", schema.quotedTable())
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	for _, column := range schema.GeneratedColumns {
+		query := fmt.Sprintf("ALTER TABLE IF EXISTS %s ADD COLUMN IF NOT EXISTS %s", schema.quotedTable(), column)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSchema creates the schema the table of schema is qualified with
+func createSchema(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	if schema.SchemaName == "" {
+		return nil
+	}
+	return execCreate(ctx, db, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(schema.SchemaName)))
+}
+
+// tableExists reports whether the table exists, table is quoted and
+// looked up in the search path unless qualified
+func tableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	return exists, err
+}
+
+// SwitchStagingTable atomically replaces the table named in config with
+// its staging table, the replaced table is kept as
+// <table>_retired_<timestamp>
+func SwitchStagingTable(config plugin.Config) error {
+	cfg, err := newPublisherConfig(config)
+	if err != nil {
+		return err
+	}
+	tableName, err := getRequiredString(config, "table_name")
+	if err != nil {
+		return err
+	}
+	live := cfg.Schema
+	if live.TableName, err = parseIdentifier("table_name", tableName); err != nil {
+		return err
+	}
+	staging := live
+	staging.TableName = stagingTable(live.TableName)
+	ctx, cancel := publishContext(cfg)
+	defer cancel()
+	db, err := getPostgreSQLConn(ctx, cfg.Connection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return switchTables(ctx, db, live, staging, time.Now())
+}
+
+// switchTables renames the table of live to its retired name for now and
+// the table of staging to the name of live in one transaction, along with
+// their indexes, so the indexes of the next staging table do not collide
+// with them and every switchover retires the table under a new name
+func switchTables(ctx context.Context, db *sql.DB, live, staging SchemaConfig, now time.Time) error {
+	retired := suffixedName(live.TableName, "_retired_"+now.UTC().Format("20060102150405"))
+	queries := []string{
+		fmt.Sprintf("ALTER TABLE IF EXISTS %s RENAME TO %s", live.quotedTable(), pq.QuoteIdentifier(retired)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", staging.quotedTable(), pq.QuoteIdentifier(live.TableName)),
+	}
+	// CockroachDB names indexes per table, they cannot collide
+	if live.Dialect != dialectCockroachDB {
+		for _, kind := range indexKinds {
+			queries = append(queries,
+				fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", live.qualify(indexName(live.TableName, kind)), pq.QuoteIdentifier(indexName(retired, kind))),
+				fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", live.qualify(indexName(staging.TableName, kind)), pq.QuoteIdentifier(indexName(live.TableName, kind))))
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// row holds the values of one metric to insert
+type row struct {
+	timePosted string
+	key        string
+	value      string
+	// data is the metric data value was formatted from
+	data interface{}
+	// json reports whether value is the JSON encoding of data, which
+	// goes to value_json with the typed schema
+	json bool
+	// tags is the JSON object of the metric tags
+	tags string
+	// raw is the encoded metric, only stored when the schema archives it
+	raw []byte
+	// unit, version and description are the metadata of the metric, only
+	// stored when the schema stores metadata
+	unit        string
+	version     int64
+	description string
+	// batch is the id of the batch the row is written with, only stored
+	// when the schema stores batch ids
+	batch string
+}
+
+// insertRows inserts the metrics of a publish in a single transaction,
+// batchSize rows per statement; when the table does not exist it is created
+// and the insert retried, and when a metric does not fit and schema allows
+// it the columns are widened and the insert retried
+func insertRows(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row, batchSize int) error {
+	if schema.Layout == schemaWide {
+		return insertWideRows(ctx, db, schema, rows, batchSize)
+	}
+	if schema.Dedupe != "" {
+		rows = dedupeRows(rows, schema.Dedupe)
+	}
+	err := insertBatches(ctx, db, schema, rows, batchSize)
+	if isUndefinedTable(err) {
+		if _, err := createTable(ctx, db, schema); err != nil {
+			return err
+		}
+		err = insertBatches(ctx, db, schema, rows, batchSize)
+	}
+	if schema.WidenColumns && isValueTooLong(err) {
+		if err := widenColumns(ctx, db, schema); err != nil {
+			return err
+		}
+		err = insertBatches(ctx, db, schema, rows, batchSize)
+	}
+	return err
+}
+
+// commitHookKey is the context key of the function run in the
+// transaction of a write right before it commits
+type commitHookKey struct{}
+
+// commitHook runs statements in the transaction of a write
+type commitHook func(ctx context.Context, tx *sql.Tx) error
+
+// withCommitHook returns ctx with hook run by the writes in its context
+func withCommitHook(ctx context.Context, hook commitHook) context.Context {
+	return context.WithValue(ctx, commitHookKey{}, hook)
+}
+
+// withoutCommitHook returns ctx without the commit hook, for the writes
+// that are not to run it
+func withoutCommitHook(ctx context.Context) context.Context {
+	if ctx.Value(commitHookKey{}) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, commitHookKey{}, commitHook(nil))
+}
+
+// commit runs the commit hook of ctx, if any, in tx and commits tx; tx is
+// rolled back when the hook fails
+func commit(ctx context.Context, tx *sql.Tx) error {
+	if hook, ok := ctx.Value(commitHookKey{}).(commitHook); ok && hook != nil {
+		if err := hook(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertBatches runs the multi-row inserts of rows in one transaction,
+// which is rolled back when any of them fails; with a dead letter table
+// the chunks rejected with a data error are written there instead
+func insertBatches(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row, batchSize int) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// a statement takes at most maxQueryParams parameters
+	if max := maxQueryParams / rowParams(schema); batchSize > max {
+		batchSize = max
+	}
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if schema.DeadLetterTable != "" {
+			if err := insertChunk(ctx, tx, schema, rows[start:end]); err != nil {
+				tx.Rollback()
+				return err
+			}
+			continue
+		}
+		query, args := insertQuery(schema, rows[start:end]...)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return commit(ctx, tx)
+}
+
+// isValueTooLong reports whether err is PostgreSQL's
+// string_data_right_truncation error
+func isValueTooLong(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "22001"
+}
+
+// widenColumns changes the VARCHAR(200) columns of the table to TEXT,
+// serialized across publishers by an advisory lock on the table name;
+// the typed schema only has key_column to widen
+func widenColumns(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	logger := ctxLogger(ctx)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", schema.relation()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN key_column TYPE TEXT, ALTER COLUMN value_column TYPE TEXT", schema.quotedTable())
+	if schema.Layout == schemaTyped {
+		query = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN key_column TYPE TEXT", schema.quotedTable())
+	}
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Infof("Widened the VARCHAR columns of %s to TEXT", schema.TableName)
+	return nil
+}
+
+// insertQuery returns the statement inserting rows into the table and its
+// arguments, the values of every row are passed as $n parameters
+func insertQuery(schema SchemaConfig, rows ...row) (string, []interface{}) {
+	columns := "id, " + rowColumns(schema)
+	if schema.TimeBucket != "" {
+		columns += ", time_bucket"
+	}
+	if schema.ArchiveRaw {
+		columns += ", raw_payload"
+	}
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*rowParams(schema))
+	for i, r := range rows {
+		n := len(args)
+		args = append(args, r.values(schema)...)
+		value := "DEFAULT"
+		for j := n + 1; j <= len(args); j++ {
+			value += fmt.Sprintf(", $%d", j)
+		}
+		if schema.TimeBucket != "" {
+			// time_bucket was checked against dateTruncFields
+			value += fmt.Sprintf(", date_trunc('%s', $%d::timestamp with time zone)", schema.TimeBucket, n+1)
+		}
+		if schema.ArchiveRaw {
+			args = append(args, r.raw)
+			value += fmt.Sprintf(", $%d", len(args))
+		}
+		values[i] = "(" + value + ")"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", schema.quotedTable(), columns, strings.Join(values, ", "))
+	return query + conflictClause(schema), args
+}
+
+// rowColumns returns the columns every row gives a value for, in the
+// order of row.values
+func rowColumns(schema SchemaConfig) string {
+	columns := "time_posted, key_column, value_column, tags"
+	if schema.Layout == schemaTyped {
+		columns = "time_posted, key_column, value_int, value_float, value_string, value_bool, tags"
+		if schema.jsonValues() {
+			columns = "time_posted, key_column, value_int, value_float, value_string, value_bool, value_json, tags"
+		}
+	}
+	if schema.Metadata {
+		columns += ", unit, metric_version, description"
+	}
+	if schema.BatchID {
+		columns += ", batch_id"
+	}
+	return columns
+}
+
+// values returns the values of the row for rowColumns
+func (r row) values(schema SchemaConfig) []interface{} {
+	values := []interface{}{r.timePosted, r.key}
+	if schema.Layout == schemaTyped {
+		values = append(values, r.typedValues()...)
+		if schema.jsonValues() {
+			values = append(values, r.jsonValue())
+		}
+	} else {
+		values = append(values, r.value)
+	}
+	values = append(values, r.tags)
+	if schema.Metadata {
+		values = append(values, r.unit, r.version, r.description)
+	}
+	if schema.BatchID {
+		values = append(values, r.batch)
+	}
+	return values
+}
+
+// aggregates are the expressions the aggregating dedupe modes set the
+// numeric columns of the stored row to, with the column as %[1]s and the
+// stored row as %[2]s; NULL values are ignored
+var aggregates = map[string]string{
+	dedupeSum: "COALESCE(%[2]s.%[1]s + EXCLUDED.%[1]s, EXCLUDED.%[1]s, %[2]s.%[1]s)",
+	dedupeMin: "LEAST(%[2]s.%[1]s, EXCLUDED.%[1]s)",
+	dedupeMax: "GREATEST(%[2]s.%[1]s, EXCLUDED.%[1]s)",
+}
+
+// conflictClause returns the ON CONFLICT clause of the dedupe mode of
+// schema: dedupeIgnore keeps the stored row, dedupeLatest overwrites its
+// values, and dedupeSum, dedupeMin and dedupeMax aggregate value_int and
+// value_float of the typed schema and overwrite the other values
+func conflictClause(schema SchemaConfig) string {
+	switch schema.Dedupe {
+	case dedupeIgnore:
+		return " ON CONFLICT (key_column, time_posted) DO NOTHING"
+	case dedupeLatest, dedupeSum, dedupeMin, dedupeMax:
+		columns := []string{"value_column", "tags"}
+		if schema.Layout == schemaTyped {
+			columns = []string{"value_int", "value_float", "value_string", "value_bool", "tags"}
+			if schema.jsonValues() {
+				columns = append(columns, "value_json")
+			}
+		}
+		if schema.Metadata {
+			columns = append(columns, "unit", "metric_version", "description")
+		}
+		if schema.BatchID {
+			columns = append(columns, "batch_id")
+		}
+		if schema.ArchiveRaw {
+			columns = append(columns, "raw_payload")
+		}
+		for i, column := range columns {
+			aggregate, ok := aggregates[schema.Dedupe]
+			if ok && (column == "value_int" || column == "value_float") {
+				columns[i] = column + " = " + fmt.Sprintf(aggregate, column, pq.QuoteIdentifier(schema.TableName))
+				continue
+			}
+			columns[i] = column + " = EXCLUDED." + column
+		}
+		return " ON CONFLICT (key_column, time_posted) DO UPDATE SET " + strings.Join(columns, ", ")
+	}
+	return ""
+}
+
+// dedupeRows drops the rows repeating the key and time of another row,
+// keeping the first one for dedupeIgnore and the last one for
+// dedupeLatest, and aggregating their values into the last one for the
+// aggregating modes; a statement may not update the same row twice
+func dedupeRows(rows []row, mode string) []row {
+	type rowKey struct{ key, timePosted string }
+	index := make(map[rowKey]int, len(rows))
+	deduped := rows[:0:0]
+	for _, r := range rows {
+		k := rowKey{r.key, r.timePosted}
+		if i, ok := index[k]; ok {
+			switch mode {
+			case dedupeLatest:
+				deduped[i] = r
+			case dedupeSum, dedupeMin, dedupeMax:
+				deduped[i] = aggregateRow(deduped[i], r, mode)
+			}
+			continue
+		}
+		index[k] = len(deduped)
+		deduped = append(deduped, r)
+	}
+	return deduped
+}
+
+// aggregateRow returns latest with its value aggregated with the one of
+// stored by mode, as the conflict clause of mode does; values of
+// different types are not aggregated
+func aggregateRow(stored, latest row, mode string) row {
+	a, b := stored.typedValues(), latest.typedValues()
+	var x, y interface{}
+	switch {
+	case a[0] != nil && b[0] != nil:
+		x, y = a[0], b[0]
+	case a[1] != nil && b[1] != nil:
+		x, y = a[1], b[1]
+	default:
+		return latest
+	}
+	var less bool
+	switch x := x.(type) {
+	case int64:
+		less = x < y.(int64)
+		if mode == dedupeSum {
+			latest.data = x + y.(int64)
+		}
+	case float64:
+		less = x < y.(float64)
+		if mode == dedupeSum {
+			latest.data = x + y.(float64)
+		}
+	}
+	if mode == dedupeMin && less || mode == dedupeMax && !less {
+		latest.data = x
+	}
+	latest.value, _ = interfaceToString(latest.data)
+	return latest
+}
+
+// rowParams returns the number of parameters insertQuery passes per row
+func rowParams(schema SchemaConfig) int {
+	params := 4
+	if schema.Layout == schemaTyped {
+		params += 3
+	}
+	if schema.jsonValues() {
+		params++
+	}
+	if schema.Metadata {
+		params += 3
+	}
+	if schema.BatchID {
+		params++
+	}
+	if schema.ArchiveRaw {
+		params++
+	}
+	return params
+}
+
+// typedValues returns the value_int, value_float, value_string and
+// value_bool arguments of the row, all but the one of the type of its
+// data being NULL; data of other types, and unsigned integers beyond
+// BIGINT, go to value_string, and JSON encoded data to value_json
+func (r row) typedValues() []interface{} {
+	values := make([]interface{}, 4)
+	if r.json {
+		return values
+	}
+	switch v := r.data.(type) {
+	case int:
+		values[0] = int64(v)
+	case int8:
+		values[0] = int64(v)
+	case int16:
+		values[0] = int64(v)
+	case int32:
+		values[0] = int64(v)
+	case int64:
+		values[0] = v
+	case uint8:
+		values[0] = int64(v)
+	case uint16:
+		values[0] = int64(v)
+	case uint32:
+		values[0] = int64(v)
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			values[0] = int64(v)
+		} else {
+			values[2] = r.value
+		}
+	case uint64:
+		if v <= math.MaxInt64 {
+			values[0] = int64(v)
+		} else {
+			values[2] = r.value
+		}
+	case float32:
+		// keep the shortest decimal of the float32, not its float64 expansion
+		values[1], _ = strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	case float64:
+		values[1] = v
+	case bool:
+		values[3] = v
+	default:
+		values[2] = r.value
+	}
+	return values
+}
+
+// jsonValue returns the value_json argument of the row
+func (r row) jsonValue() interface{} {
+	if r.json {
+		return r.value
+	}
+	return nil
+}
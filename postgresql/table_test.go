@@ -0,0 +1,574 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTimeBucketColumn(t *testing.T) {
+	Convey("TestTimeBucketColumn", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+
+		Convey("Column is left out when time_bucket is unset", func() {
+			So(tableColumns(schema), ShouldNotContainSubstring, "time_bucket")
+			query, args := insertQuery(schema, row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}"})
+			So(query, ShouldEqual, "INSERT INTO \"info\" (id, time_posted, key_column, value_column, tags) VALUES (DEFAULT, $1, $2, $3, $4)")
+			So(args, ShouldResemble, []interface{}{"2017-01-01T10:11:12Z", "foo", "1", "{}"})
+		})
+
+		Convey("Column is created and filled with date_trunc when time_bucket is set", func() {
+			schema.TimeBucket = "hour"
+			So(tableColumns(schema), ShouldContainSubstring, "time_bucket timestamp with time zone")
+			query, args := insertQuery(schema, row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}"})
+			So(query, ShouldEqual, "INSERT INTO \"info\" (id, time_posted, key_column, value_column, tags, time_bucket) VALUES "+
+				"(DEFAULT, $1, $2, $3, $4, date_trunc('hour', $1::timestamp with time zone))")
+			So(args, ShouldResemble, []interface{}{"2017-01-01T10:11:12Z", "foo", "1", "{}"})
+		})
+
+		Convey("Existing tables get the column added", func() {
+			schema.TimeBucket = "minute"
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			expectTagsUpgrade(mock)
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS time_bucket (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	Convey("TestGeneratedColumns", t, func() {
+		prefix := "key_prefix text GENERATED ALWAYS AS (split_part(key_column, '.', 1)) STORED"
+		schema := SchemaConfig{TableName: "info", GeneratedColumns: []string{prefix}}
+
+		Convey("Generated columns are part of the created table", func() {
+			So(tableColumns(schema), ShouldContainSubstring, ", "+prefix+", ")
+		})
+
+		Convey("Existing tables get the generated columns added", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			expectTagsUpgrade(mock)
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS key_prefix (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestHashPartitions(t *testing.T) {
+	Convey("TestHashPartitions", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+
+		Convey("Plain tables keep id as the primary key", func() {
+			So(tableColumns(schema), ShouldEndWith, "PRIMARY KEY (id))")
+		})
+
+		Convey("Partitioned tables are created with one table per partition", func() {
+			schema.HashPartitions = 2
+			So(tableColumns(schema), ShouldEndWith, "PRIMARY KEY (id, key_column))")
+
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info\" (.+) PARTITION BY HASH \\(key_column\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info_p0\" PARTITION OF \"info\" FOR VALUES WITH \\(MODULUS 2, REMAINDER 0\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info_p1\" PARTITION OF \"info\" FOR VALUES WITH \\(MODULUS 2, REMAINDER 1\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_key_index\" on \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_tags_index\" on \"info\" USING GIN \\(tags\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			ok, err := createTable(context.Background(), db, schema)
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestRawPayloadColumn(t *testing.T) {
+	Convey("TestRawPayloadColumn", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		r := row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}", raw: []byte{0x0a, 0xff}}
+
+		Convey("Column is left out when archive_raw_payload is unset", func() {
+			So(tableColumns(schema), ShouldNotContainSubstring, "raw_payload")
+			query, _ := insertQuery(schema, r)
+			So(query, ShouldNotContainSubstring, "raw_payload")
+		})
+
+		Convey("Column is created and filled with the encoded metric when archive_raw_payload is set", func() {
+			schema.ArchiveRaw = true
+			So(tableColumns(schema), ShouldContainSubstring, "raw_payload bytea")
+			query, args := insertQuery(schema, r, r)
+			So(query, ShouldEqual, "INSERT INTO \"info\" (id, time_posted, key_column, value_column, tags, raw_payload) VALUES "+
+				"(DEFAULT, $1, $2, $3, $4, $5), (DEFAULT, $6, $7, $8, $9, $10)")
+			So(args, ShouldResemble, []interface{}{"2017-01-01T10:11:12Z", "foo", "1", "{}", []byte{0x0a, 0xff},
+				"2017-01-01T10:11:12Z", "foo", "1", "{}", []byte{0x0a, 0xff}})
+		})
+	})
+}
+
+func TestInsertRows(t *testing.T) {
+	Convey("TestInsertRows", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		rows := []row{
+			{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}"},
+			{timePosted: "2017-01-01T10:11:12Z", key: "bar", value: "2", tags: `{"host":"a"}`},
+			{timePosted: "2017-01-01T10:11:12Z", key: "baz", value: "3", tags: "{}"},
+		}
+
+		Convey("Rows are inserted in one transaction, batch_size rows per statement", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" \\(.+\\) VALUES \\(.+\\), \\(.+\\)$").
+				WithArgs("2017-01-01T10:11:12Z", "foo", "1", "{}", "2017-01-01T10:11:12Z", "bar", "2", `{"host":"a"}`).WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectExec("^INSERT INTO \"info\" \\(.+\\) VALUES \\(.+\\)$").
+				WithArgs("2017-01-01T10:11:12Z", "baz", "3", "{}").WillReturnResult(sqlmock.NewResult(3, 1))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, 2), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("A failing statement rolls back the whole publish", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(errors.New("disk full"))
+			mock.ExpectRollback()
+			So(insertRows(context.Background(), db, schema, rows, 2), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Values with quotes are passed unchanged", func() {
+			rows[0].value = "it's '); DROP TABLE info; --"
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").
+				WithArgs("2017-01-01T10:11:12Z", "foo", "it's '); DROP TABLE info; --", "{}").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows[:1], 2), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Nothing is sent for an empty publish", func() {
+			So(insertRows(context.Background(), db, schema, nil, 2), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("A missing table is created and the insert retried", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(&pq.Error{Code: "42P01"})
+			mock.ExpectRollback()
+			// another publisher created the table meanwhile
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info\" (.+)$").WillReturnError(&pq.Error{Code: "42P07"})
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_key_index\" (.+)$").
+				WillReturnError(&pq.Error{Code: "23505", Constraint: "pg_class_relname_nsp_index"})
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_tags_index\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(3, 3))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, 3), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("An index name taken by another relation fails the create", func() {
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_key_index\" (.+)$").WillReturnError(&pq.Error{Code: "42P07"})
+			_, err := createTable(context.Background(), db, schema)
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestIndexName(t *testing.T) {
+	Convey("TestIndexName", t, func() {
+		So(indexName("info", "tags"), ShouldEqual, "info_tags_index")
+
+		long := strings.Repeat("a", 55)
+		name := indexName(long, "dedupe")
+		So(len(name), ShouldBeLessThanOrEqualTo, maxIdentifierLength)
+		So(name, ShouldStartWith, strings.Repeat("a", 41)+"_")
+		So(name, ShouldEndWith, "_dedupe_index")
+		// names PostgreSQL would truncate alike stay distinct
+		So(indexName(long+"b", "dedupe"), ShouldNotEqual, indexName(long+"c", "dedupe"))
+
+		// multibyte characters are not split
+		name = indexName(strings.Repeat("é", 30), "dedupe")
+		So(utf8.ValidString(name), ShouldBeTrue)
+		So(len(name), ShouldBeLessThanOrEqualTo, maxIdentifierLength)
+	})
+}
+
+func TestIsDuplicateRelation(t *testing.T) {
+	Convey("TestIsDuplicateRelation", t, func() {
+		So(isDuplicateRelation(&pq.Error{Code: "42P07"}), ShouldBeTrue)
+		So(isDuplicateRelation(&pq.Error{Code: "23505", Constraint: "pg_type_typname_nsp_index"}), ShouldBeTrue)
+		So(isDuplicateRelation(&pq.Error{Code: "23505", Constraint: "info_dedupe_index"}), ShouldBeFalse)
+		So(isDuplicateRelation(&pq.Error{Code: "42P01"}), ShouldBeFalse)
+		So(isDuplicateRelation(nil), ShouldBeFalse)
+	})
+}
+
+func TestInsertedAtColumn(t *testing.T) {
+	Convey("TestInsertedAtColumn", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		So(tableColumns(schema), ShouldNotContainSubstring, "inserted_at")
+
+		schema.InsertedAt = true
+		So(tableColumns(schema), ShouldContainSubstring, "inserted_at timestamp with time zone DEFAULT now()")
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		expectTagsUpgrade(mock)
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS inserted_at timestamp with time zone DEFAULT now\\(\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestCockroachDBTable(t *testing.T) {
+	Convey("TestCockroachDBTable", t, func() {
+		schema := SchemaConfig{TableName: "info", Dialect: dialectCockroachDB}
+		So(tableColumns(schema), ShouldStartWith, "(id INT8 DEFAULT unique_rowid(), time_posted")
+		So(tagsIndexQuery(schema), ShouldEqual, `CREATE INVERTED INDEX IF NOT EXISTS "info_tags_index" on "info" (tags)`)
+
+		schema.Dialect = dialectAurora
+		So(tableColumns(schema), ShouldStartWith, "(id SERIAL, time_posted")
+	})
+}
+
+func TestMetadataColumns(t *testing.T) {
+	Convey("TestMetadataColumns", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		r := row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}", unit: "B", version: 2, description: "bytes"}
+		So(tableColumns(schema), ShouldNotContainSubstring, "metric_version")
+
+		schema.Metadata = true
+		So(tableColumns(schema), ShouldContainSubstring, "unit TEXT, metric_version BIGINT, description TEXT")
+		query, args := insertQuery(schema, r)
+		So(query, ShouldEqual, "INSERT INTO \"info\" (id, time_posted, key_column, value_column, tags, unit, metric_version, description) VALUES "+
+			"(DEFAULT, $1, $2, $3, $4, $5, $6, $7)")
+		So(args, ShouldResemble, []interface{}{"2017-01-01T10:11:12Z", "foo", "1", "{}", "B", int64(2), "bytes"})
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		expectTagsUpgrade(mock)
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS unit TEXT, ADD COLUMN IF NOT EXISTS metric_version BIGINT, " +
+			"ADD COLUMN IF NOT EXISTS description TEXT$").WillReturnResult(sqlmock.NewResult(0, 0))
+		So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestDedupe(t *testing.T) {
+	Convey("TestDedupe", t, func() {
+		schema := SchemaConfig{TableName: "info", Dedupe: dedupeIgnore}
+		rows := []row{
+			{timePosted: "t1", key: "foo", value: "1", tags: "{}"},
+			{timePosted: "t1", key: "bar", value: "2", tags: "{}"},
+			{timePosted: "t1", key: "foo", value: "3", tags: "{}"},
+			{timePosted: "t2", key: "foo", value: "4", tags: "{}"},
+		}
+
+		Convey("Conflicting rows are ignored", func() {
+			query, _ := insertQuery(schema, rows[0])
+			So(query, ShouldEndWith, "VALUES (DEFAULT, $1, $2, $3, $4) ON CONFLICT (key_column, time_posted) DO NOTHING")
+			So(dedupeRows(rows, dedupeIgnore), ShouldResemble, []row{rows[0], rows[1], rows[3]})
+		})
+
+		Convey("Conflicting rows overwrite the stored values in latest mode", func() {
+			schema.Dedupe = dedupeLatest
+			schema.ArchiveRaw = true
+			query, _ := insertQuery(schema, rows[0])
+			So(query, ShouldEndWith, " ON CONFLICT (key_column, time_posted) DO UPDATE SET "+
+				"value_column = EXCLUDED.value_column, tags = EXCLUDED.tags, raw_payload = EXCLUDED.raw_payload")
+			So(dedupeRows(rows, dedupeLatest), ShouldResemble, []row{rows[2], rows[1], rows[3]})
+			So(rows[0].value, ShouldEqual, "1")
+		})
+
+		Convey("Conflicting rows aggregate the numeric values in the aggregating modes", func() {
+			schema.Layout = schemaTyped
+			schema.Dedupe = dedupeSum
+			query, _ := insertQuery(schema, rows[0])
+			So(query, ShouldEndWith, " ON CONFLICT (key_column, time_posted) DO UPDATE SET "+
+				"value_int = COALESCE(\"info\".value_int + EXCLUDED.value_int, EXCLUDED.value_int, \"info\".value_int), "+
+				"value_float = COALESCE(\"info\".value_float + EXCLUDED.value_float, EXCLUDED.value_float, \"info\".value_float), "+
+				"value_string = EXCLUDED.value_string, value_bool = EXCLUDED.value_bool, tags = EXCLUDED.tags")
+			schema.Dedupe = dedupeMax
+			query, _ = insertQuery(schema, rows[0])
+			So(query, ShouldContainSubstring, "value_int = GREATEST(\"info\".value_int, EXCLUDED.value_int)")
+
+			numeric := []row{
+				{timePosted: "t1", key: "foo", data: 1, tags: "{}"},
+				{timePosted: "t1", key: "foo", data: int64(5), tags: "{}"},
+				{timePosted: "t1", key: "bar", data: 1.5, tags: "{}"},
+				{timePosted: "t1", key: "bar", data: 0.5, tags: "{}"},
+			}
+			sum := dedupeRows(numeric, dedupeSum)
+			So(sum[0].data, ShouldEqual, int64(6))
+			So(sum[0].value, ShouldEqual, "6")
+			So(sum[1].data, ShouldEqual, 2.0)
+			minimum := dedupeRows(numeric, dedupeMin)
+			So(minimum[0].data, ShouldEqual, int64(1))
+			So(minimum[1].data, ShouldEqual, 0.5)
+			maximum := dedupeRows(numeric, dedupeMax)
+			So(maximum[0].data, ShouldEqual, int64(5))
+			So(maximum[1].data, ShouldEqual, 1.5)
+		})
+
+		Convey("Existing tables get the unique index", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			expectTagsUpgrade(mock)
+			mock.ExpectExec("^CREATE UNIQUE INDEX IF NOT EXISTS \"info_dedupe_index\" on \"info\" \\(key_column, time_posted\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestSchemaName(t *testing.T) {
+	Convey("TestSchemaName", t, func() {
+		schema := SchemaConfig{TableName: "info", SchemaName: "Team A", HashPartitions: 1}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Convey("Tables are created in the schema", func() {
+			mock.ExpectExec("^CREATE SCHEMA IF NOT EXISTS \"Team A\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"Team A\".\"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"Team A\".\"info_p0\" PARTITION OF \"Team A\".\"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_key_index\" on \"Team A\".\"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_tags_index\" on \"Team A\".\"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(createSchema(context.Background(), db, schema), ShouldBeNil)
+			_, err := createTable(context.Background(), db, schema)
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Tables are looked up and written in the schema", func() {
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"Team A\".\"info\" ADD COLUMN IF NOT EXISTS tags jsonb$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("^SELECT to_regclass\\(\\$1\\) IS NOT NULL$").WithArgs(`"Team A"."info"`).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+			query, _ := insertQuery(schema, row{timePosted: "t", key: "foo", value: "1", tags: "{}"})
+			So(query, ShouldStartWith, "INSERT INTO \"Team A\".\"info\" ")
+		})
+	})
+}
+
+func TestTypedSchema(t *testing.T) {
+	Convey("TestTypedSchema", t, func() {
+		schema := SchemaConfig{TableName: "info", Layout: schemaTyped}
+
+		Convey("Typed value columns replace value_column", func() {
+			So(tableColumns(schema), ShouldContainSubstring, typedColumns)
+			So(tableColumns(schema), ShouldNotContainSubstring, "value_column")
+		})
+
+		Convey("Values are routed to the column of their type", func() {
+			query, args := insertQuery(schema,
+				row{timePosted: "t", key: "int", value: "-1", data: int32(-1), tags: "{}"},
+				row{timePosted: "t", key: "float", value: "1.1", data: float32(1.1), tags: "{}"},
+				row{timePosted: "t", key: "bool", value: "true", data: true, tags: "{}"},
+				row{timePosted: "t", key: "huge", value: "18446744073709551615", data: uint64(math.MaxUint64), tags: "{}"},
+				row{timePosted: "t", key: "slice", value: "[1, 2]", data: []int{1, 2}, tags: "{}"},
+			)
+			So(query, ShouldStartWith, "INSERT INTO \"info\" (id, time_posted, key_column, value_int, value_float, value_string, value_bool, tags) VALUES "+
+				"(DEFAULT, $1, $2, $3, $4, $5, $6, $7), (DEFAULT, $8, ")
+			So(args, ShouldResemble, []interface{}{
+				"t", "int", int64(-1), nil, nil, nil, "{}",
+				"t", "float", nil, 1.1, nil, nil, "{}",
+				"t", "bool", nil, nil, nil, true, "{}",
+				"t", "huge", nil, nil, "18446744073709551615", nil, "{}",
+				"t", "slice", nil, nil, "[1, 2]", nil, "{}",
+			})
+		})
+
+		Convey("Existing tables get the typed columns added", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			expectTagsUpgrade(mock)
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS value_int BIGINT, ADD COLUMN IF NOT EXISTS value_float (.+), " +
+				"ADD COLUMN IF NOT EXISTS value_string TEXT, ADD COLUMN IF NOT EXISTS value_bool BOOLEAN$").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("JSON encoded values go to value_json", func() {
+			schema.ValueSerializer = serializerJSON
+			So(tableColumns(schema), ShouldContainSubstring, "value_json jsonb")
+
+			query, args := insertQuery(schema,
+				row{timePosted: "t", key: "int", value: "1", data: 1, tags: "{}"},
+				row{timePosted: "t", key: "map", value: `{"a":1}`, data: map[string]int{"a": 1}, json: true, tags: "{}"},
+			)
+			So(query, ShouldStartWith, "INSERT INTO \"info\" (id, time_posted, key_column, value_int, value_float, value_string, value_bool, value_json, tags) VALUES "+
+				"(DEFAULT, $1, $2, $3, $4, $5, $6, $7, $8), (DEFAULT, $9, ")
+			So(args, ShouldResemble, []interface{}{
+				"t", "int", int64(1), nil, nil, nil, nil, "{}",
+				"t", "map", nil, nil, nil, nil, `{"a":1}`, "{}",
+			})
+
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			expectTagsUpgrade(mock)
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS value_int (.+), ADD COLUMN IF NOT EXISTS value_json jsonb$").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Only key_column is widened", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+			mock.ExpectBegin()
+			mock.ExpectExec("^SELECT pg_advisory_xact_lock(.+)$").WithArgs("info").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info\" ALTER COLUMN key_column TYPE TEXT$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			So(widenColumns(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestWidenColumns(t *testing.T) {
+	Convey("TestWidenColumns", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		tooLong := &pq.Error{Code: "22001", Message: "value too long for type character varying(200)"}
+		rows := []row{{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "bar"}}
+
+		Convey("Too long values fail when widening is disabled", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(tooLong)
+			mock.ExpectRollback()
+			So(insertRows(context.Background(), db, schema, rows, defaultBatchSize), ShouldEqual, tooLong)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Columns are widened under a lock and the insert is retried", func() {
+			schema.WidenColumns = true
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnError(tooLong)
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("^SELECT pg_advisory_xact_lock\\(hashtext\\(\\$1\\)\\)$").WithArgs("info").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info\" ALTER COLUMN key_column TYPE TEXT, ALTER COLUMN value_column TYPE TEXT$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, defaultBatchSize), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestQuotedIdentifiers(t *testing.T) {
+	Convey("TestQuotedIdentifiers", t, func() {
+		schema := SchemaConfig{TableName: `Metrics.select"`}
+		query, _ := insertQuery(schema, row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1"})
+		So(query, ShouldStartWith, `INSERT INTO "Metrics.select""" (`)
+		So(maintenanceQueries(schema, MaintenanceConfig{Analyze: true}), ShouldResemble, []string{`ANALYZE "Metrics.select"""`})
+	})
+}
+
+func TestTagsColumn(t *testing.T) {
+	Convey("TestTagsColumn", t, func() {
+		schema := SchemaConfig{TableName: "info"}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Convey("Column is part of the created table", func() {
+			So(tableColumns(schema), ShouldContainSubstring, "tags jsonb")
+		})
+
+		Convey("Existing tables get the column and its index added", func() {
+			expectTagsUpgrade(mock)
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("No index is created before the table exists", func() {
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS tags jsonb$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("^SELECT to_regclass\\(\\$1\\) IS NOT NULL$").WithArgs(`"info"`).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+// expectTagsUpgrade expects the statements adding the tags column and its
+// index to the existing table info
+func expectTagsUpgrade(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS tags jsonb$").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT to_regclass\\(\\$1\\) IS NOT NULL$").WithArgs(`"info"`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_tags_index\" on \"info\" USING GIN \\(tags\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestSwitchTables(t *testing.T) {
+	Convey("TestSwitchTables", t, func() {
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		live := SchemaConfig{TableName: "info"}
+		staging := SchemaConfig{TableName: "info_staging"}
+		now := time.Date(2017, 1, 31, 10, 11, 12, 0, time.UTC)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" RENAME TO \"info_retired_20170131101112\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^ALTER TABLE \"info_staging\" RENAME TO \"info\"$").WillReturnResult(sqlmock.NewResult(0, 0))
+		for _, kind := range indexKinds {
+			mock.ExpectExec("^ALTER INDEX IF EXISTS \"info_" + kind + "_index\" RENAME TO \"info_retired_20170131101112_" + kind + "_index\"$").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER INDEX IF EXISTS \"info_staging_" + kind + "_index\" RENAME TO \"info_" + kind + "_index\"$").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectCommit()
+		So(switchTables(context.Background(), db, live, staging, now), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+
+		Convey("a failed rename rolls the switchover back", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" (.+)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info_staging\" (.+)$").WillReturnError(&pq.Error{Code: "42P01"})
+			mock.ExpectRollback()
+			So(switchTables(context.Background(), db, live, staging, now), ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
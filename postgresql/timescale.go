@@ -0,0 +1,71 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// hasTimescaleDB reports whether the timescaledb extension is installed
+// in the database
+func hasTimescaleDB(ctx context.Context, db *sql.DB) (bool, error) {
+	var installed bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&installed)
+	return installed, err
+}
+
+// createHypertable turns the newly created table into a hypertable on
+// time_posted and sets up the compression of old chunks; the table is left
+// a plain table when the extension is not installed
+func createHypertable(ctx context.Context, db *sql.DB, schema SchemaConfig) error {
+	logger := ctxLogger(ctx)
+	installed, err := hasTimescaleDB(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		logger.Warnf("The timescaledb extension is not installed, %s is created as a plain table", schema.TableName)
+		return nil
+	}
+
+	table := schema.quotedTable()
+	if schema.ChunkTimeInterval != "" {
+		_, err = db.ExecContext(ctx, "SELECT create_hypertable($1::regclass, 'time_posted', chunk_time_interval => $2::interval, if_not_exists => TRUE)",
+			table, schema.ChunkTimeInterval)
+	} else {
+		_, err = db.ExecContext(ctx, "SELECT create_hypertable($1::regclass, 'time_posted', if_not_exists => TRUE)", table)
+	}
+	if err != nil {
+		return err
+	}
+
+	if schema.CompressAfter != "" {
+		query := fmt.Sprintf("ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = 'key_column')", table)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "SELECT add_compression_policy($1::regclass, $2::interval, if_not_exists => TRUE)", table, schema.CompressAfter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCreateHypertable(t *testing.T) {
+	Convey("TestCreateHypertable", t, func() {
+		schema := SchemaConfig{TableName: "info", TimescaleDB: true}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Convey("The primary key includes the time column", func() {
+			So(tableColumns(schema), ShouldContainSubstring, "PRIMARY KEY (id, time_posted)")
+		})
+
+		Convey("The table is left plain without the extension", func() {
+			mock.ExpectQuery("^SELECT EXISTS (.+) extname = 'timescaledb'\\)$").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			So(createHypertable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("The table becomes a hypertable with compression", func() {
+			schema.ChunkTimeInterval = "1 day"
+			schema.CompressAfter = "7 days"
+			mock.ExpectQuery("^SELECT EXISTS (.+)$").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			mock.ExpectExec("^SELECT create_hypertable\\(\\$1::regclass, 'time_posted', chunk_time_interval => \\$2::interval, if_not_exists => TRUE\\)$").
+				WithArgs(`"info"`, "1 day").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^ALTER TABLE \"info\" SET \\(timescaledb.compress, timescaledb.compress_segmentby = 'key_column'\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^SELECT add_compression_policy\\(\\$1::regclass, \\$2::interval, if_not_exists => TRUE\\)$").
+				WithArgs(`"info"`, "7 days").WillReturnResult(sqlmock.NewResult(0, 0))
+			So(createHypertable(context.Background(), db, schema), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
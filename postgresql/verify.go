@@ -0,0 +1,159 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newBatchID returns a random version 4 UUID identifying the rows written
+// by one batch
+func newBatchID() string {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		rand.Read(b[:])
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// verifyLater counts the rows of batch id in the table of schema on the
+// replica of cfg once the verify delay passed, and reports the rows it is
+// missing compared to the primary; Drain stops the verifications still
+// waiting
+func (s *PostgreSQLPublisher) verifyLater(cfg *publisherConfig, schema SchemaConfig, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(cfg.Verify.Delay, func() {
+		s.mutex.Lock()
+		delete(s.verifyTimers, timer)
+		s.mutex.Unlock()
+		ctx, cancel := publishContext(cfg)
+		defer cancel()
+		logger := cfg.Log.logger().WithFields(log.Fields{
+			"table":    schema.TableName,
+			"batch_id": id,
+		})
+		lost, err := s.verify(ctx, cfg, schema, id)
+		if err == errDraining {
+			// fired as Drain was stopping it
+			return
+		}
+		if err != nil {
+			logger.Errorf("Verifying the batch on the replica failed: %v", err)
+			return
+		}
+		if lost > 0 {
+			logger.Errorf("Replica is missing %d rows of the batch", lost)
+			s.stats.lose(lost)
+		}
+	})
+	if s.verifyTimers == nil {
+		s.verifyTimers = make(map[*time.Timer]struct{})
+	}
+	s.verifyTimers[timer] = struct{}{}
+}
+
+// verify returns the number of rows of batch id the replica of cfg has
+// fewer than the primary; the rows are counted on the primary too, as
+// dedupe, error_policy=skip and retention keep the rows stored from
+// matching the rows published
+func (s *PostgreSQLPublisher) verify(ctx context.Context, cfg *publisherConfig, schema SchemaConfig, id string) (int64, error) {
+	// verifications serialize, so the replica is not replaced under one
+	s.verifyMutex.Lock()
+	defer s.verifyMutex.Unlock()
+	s.mutex.Lock()
+	draining := s.draining
+	s.mutex.Unlock()
+	if draining {
+		return 0, errDraining
+	}
+	replica, err := s.replicaConn(ctx, cfg)
+	if err != nil {
+		return 0, err
+	}
+	var primary int64
+	err = s.attempt(ctx, cfg, func(db *sql.DB) error {
+		var err error
+		primary, err = countBatch(ctx, db, schema, id)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	replicated, err := countBatch(ctx, replica, schema, id)
+	if err != nil {
+		return 0, err
+	}
+	if replicated >= primary {
+		return 0, nil
+	}
+	return primary - replicated, nil
+}
+
+// replicaConn returns the connection to the replica of cfg, opened on
+// first use and replaced when verify_replica_uri changes; s.verifyMutex
+// must be held
+func (s *PostgreSQLPublisher) replicaConn(ctx context.Context, cfg *publisherConfig) (*sql.DB, error) {
+	if s.replica != nil && s.replicaURI == cfg.Verify.ReplicaURI {
+		return s.replica, nil
+	}
+	s.closeReplica()
+	conn := cfg.Connection
+	conn.URI, conn.SRVService = cfg.Verify.ReplicaURI, ""
+	db, err := openConn(ctx, conn)
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	s.replica, s.replicaURI = db, cfg.Verify.ReplicaURI
+	return db, nil
+}
+
+// closeReplica closes the connection to the replica, if any; s.verifyMutex
+// must be held
+func (s *PostgreSQLPublisher) closeReplica() {
+	if s.replica != nil {
+		s.replica.Close()
+		s.replica, s.replicaURI = nil, ""
+	}
+}
+
+// countBatch returns the number of rows of batch id in the table of schema
+func countBatch(ctx context.Context, db *sql.DB, schema SchemaConfig, id string) (int64, error) {
+	var n int64
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE batch_id = $1", schema.quotedTable())
+	err := db.QueryRowContext(ctx, query, id).Scan(&n)
+	return n, err
+}
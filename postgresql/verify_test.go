@@ -0,0 +1,117 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/intelsdi-x/snap-plugin-lib-go/v1/plugin"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatchID(t *testing.T) {
+	Convey("TestBatchID", t, func() {
+		So(newBatchID(), ShouldNotEqual, newBatchID())
+		So(regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$").MatchString(newBatchID()), ShouldBeTrue)
+
+		schema := SchemaConfig{TableName: "info", BatchID: true}
+		r := row{timePosted: "2017-01-01T10:11:12Z", key: "foo", value: "1", tags: "{}", batch: "b1"}
+		So(tableColumns(schema), ShouldContainSubstring, ", batch_id uuid")
+		query, args := insertQuery(schema, r)
+		So(query, ShouldEqual, "INSERT INTO \"info\" (id, time_posted, key_column, value_column, tags, batch_id) VALUES "+
+			"(DEFAULT, $1, $2, $3, $4, $5)")
+		So(args, ShouldResemble, []interface{}{"2017-01-01T10:11:12Z", "foo", "1", "{}", "b1"})
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		expectTagsUpgrade(mock)
+		mock.ExpectExec("^ALTER TABLE IF EXISTS \"info\" ADD COLUMN IF NOT EXISTS batch_id uuid$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^CREATE INDEX IF NOT EXISTS \"info_batch_index\" on \"info\" \\(batch_id\\)$").WillReturnResult(sqlmock.NewResult(0, 0))
+		So(upgradeTable(context.Background(), db, schema), ShouldBeNil)
+		So(mock.ExpectationsWereMet(), ShouldBeNil)
+	})
+}
+
+func TestVerifyReplica(t *testing.T) {
+	Convey("TestVerifyReplica", t, func() {
+		config := make(plugin.Config)
+		config["username"] = "postgres"
+		config["password"] = ""
+		config["database"] = "snap_test"
+		config["table_name"] = "info"
+		config["batch_id_column"] = true
+		config["verify_replica_uri"] = "postgres://replica/snap_test"
+
+		sp, mock, err := newMockPublisher(config)
+		So(err, ShouldBeNil)
+		replica, replicaMock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		cfg, err := sp.configs.get(config)
+		So(err, ShouldBeNil)
+		sp.replica, sp.replicaURI = replica, cfg.Verify.ReplicaURI
+		So(cfg.Verify.Delay, ShouldEqual, time.Minute)
+
+		count := "^SELECT count\\(\\*\\) FROM \"info\" WHERE batch_id = \\$1$"
+		mock.ExpectQuery(count).WithArgs("b1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+
+		Convey("reports the rows missing on the replica", func() {
+			replicaMock.ExpectQuery(count).WithArgs("b1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+			lost, err := sp.verify(context.Background(), cfg, cfg.Schema, "b1")
+			So(err, ShouldBeNil)
+			So(lost, ShouldEqual, 2)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			So(replicaMock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("reports nothing once the replica caught up", func() {
+			replicaMock.ExpectQuery(count).WithArgs("b1").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+			lost, err := sp.verify(context.Background(), cfg, cfg.Schema, "b1")
+			So(err, ShouldBeNil)
+			So(lost, ShouldEqual, 0)
+			So(replicaMock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("waiting verifications are stopped by Drain", func() {
+			sp.verifyLater(cfg, cfg.Schema, "b1")
+			So(len(sp.verifyTimers), ShouldEqual, 1)
+			var timer *time.Timer
+			for timer = range sp.verifyTimers {
+			}
+			sp.Drain()
+			So(sp.verifyTimers, ShouldBeEmpty)
+			So(timer.Stop(), ShouldBeFalse)
+			sp.verifyLater(cfg, cfg.Schema, "b2")
+			So(sp.verifyTimers, ShouldBeEmpty)
+		})
+
+		Convey("requires the batch_id column", func() {
+			delete(config, "batch_id_column")
+			_, err := newPublisherConfig(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,249 @@
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// wideColumnTypes are the types of the columns of the wide schema, by the
+// index of the typedValues value of the first metric written to them
+var wideColumnTypes = []string{"BIGINT", "DOUBLE PRECISION", "TEXT", "BOOLEAN"}
+
+// wideBaseColumnNames are the columns of every table of the wide schema,
+// which no metric key can take
+var wideBaseColumnNames = []string{"id", "time_posted", "tags"}
+
+// wideRow holds the values of the metrics of one collection time and tags,
+// by their key
+type wideRow struct {
+	timePosted string
+	tags       string
+	values     map[string]interface{}
+}
+
+// wideColumn is the column of a key and its type
+type wideColumn struct {
+	key     string
+	sqlType string
+}
+
+// wideValue returns the value of the row in its column of the wide schema and
+// the type of that column
+func (r row) wideValue() (interface{}, string) {
+	if r.json {
+		return r.value, "jsonb"
+	}
+	for i, value := range r.typedValues() {
+		if value != nil {
+			return value, wideColumnTypes[i]
+		}
+	}
+	return r.value, "TEXT"
+}
+
+// wideTypeFits reports whether values typed valueType can be written to a
+// column of columnType
+func wideTypeFits(valueType, columnType string) bool {
+	valueType, columnType = strings.ToUpper(valueType), strings.ToUpper(columnType)
+	return valueType == columnType || columnType == "TEXT" || (valueType == "BIGINT" && columnType == "DOUBLE PRECISION")
+}
+
+// pivotRows groups rows by their time and tags into wide rows, in the
+// order of the first row of each group, and returns them with the columns
+// of their keys in the order they first appear; the last of the rows of a
+// group with the same key wins. A key with integer and float values gets a
+// float column, other keys with values of different types fail
+func pivotRows(rows []row) ([]wideRow, []wideColumn, error) {
+	type rowKey struct{ timePosted, tags string }
+	var (
+		wide    []wideRow
+		columns []wideColumn
+	)
+	index := make(map[rowKey]int)
+	seen := make(map[string]int)
+	for _, r := range rows {
+		k := rowKey{r.timePosted, r.tags}
+		i, ok := index[k]
+		if !ok {
+			i = len(wide)
+			index[k] = i
+			wide = append(wide, wideRow{timePosted: r.timePosted, tags: r.tags, values: make(map[string]interface{})})
+		}
+		value, sqlType := r.wideValue()
+		wide[i].values[r.key] = value
+		c, ok := seen[r.key]
+		if !ok {
+			seen[r.key] = len(columns)
+			columns = append(columns, wideColumn{key: r.key, sqlType: sqlType})
+			continue
+		}
+		switch column := &columns[c]; {
+		case wideTypeFits(sqlType, column.sqlType):
+		case wideTypeFits(column.sqlType, sqlType) && column.sqlType == "BIGINT":
+			column.sqlType = sqlType
+		default:
+			return nil, nil, fmt.Errorf("Namespace %s has %s and %s values, a column of the wide schema holds values of one type", r.key, column.sqlType, sqlType)
+		}
+	}
+	return wide, columns, nil
+}
+
+// insertWideRows inserts rows pivoted into one row per collection time
+// and tags in one transaction; when the table does not exist it is
+// created, and when it lacks the column of a key the columns are added,
+// and the insert retried
+func insertWideRows(ctx context.Context, db *sql.DB, schema SchemaConfig, rows []row, batchSize int) error {
+	wide, columns, err := pivotRows(rows)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if len(column.key) > maxIdentifierLength {
+			return fmt.Errorf("Namespace %s is too long for a column of the wide schema, column names must be at most %d bytes long", column.key, maxIdentifierLength)
+		}
+		for _, name := range wideBaseColumnNames {
+			if column.key == name {
+				return fmt.Errorf("Namespace %s is reserved for a base column of the wide schema", column.key)
+			}
+		}
+	}
+	err = insertWideBatches(ctx, db, schema, wide, columns, batchSize)
+	if isUndefinedTable(err) {
+		if _, err := createTable(ctx, db, schema); err != nil {
+			return err
+		}
+		err = insertWideBatches(ctx, db, schema, wide, columns, batchSize)
+	}
+	if isUndefinedColumn(err) {
+		if err := addWideColumns(ctx, db, schema, columns); err != nil {
+			return err
+		}
+		err = insertWideBatches(ctx, db, schema, wide, columns, batchSize)
+	}
+	if isWideTypeError(err) {
+		if mismatch := checkWideTypes(ctx, db, schema, columns); mismatch != nil {
+			return mismatch
+		}
+	}
+	return err
+}
+
+// isWideTypeError reports whether err may come from a value not fitting
+// the type of its column
+func isWideTypeError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code.Class() == "22" || pqErr.Code == "42804")
+}
+
+// checkWideTypes returns an error naming the first of columns whose values
+// do not fit the type of the column of the table, nil when all fit or the
+// types cannot be read
+func checkWideTypes(ctx context.Context, db *sql.DB, schema SchemaConfig, columns []wideColumn) error {
+	rows, err := db.QueryContext(ctx, "SELECT attname, format_type(atttypid, atttypmod) FROM pg_attribute "+
+		"WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped", schema.quotedTable())
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, sqlType string
+		if err := rows.Scan(&name, &sqlType); err != nil {
+			return nil
+		}
+		types[name] = sqlType
+	}
+	for _, column := range columns {
+		if sqlType, ok := types[column.key]; ok && !wideTypeFits(column.sqlType, sqlType) {
+			return fmt.Errorf("Namespace %s has %s values, but its column of the wide schema is %s", column.key, column.sqlType, strings.ToUpper(sqlType))
+		}
+	}
+	return nil
+}
+
+// addWideColumns adds the columns of the table missing for columns, typed
+// by the first value written to them
+func addWideColumns(ctx context.Context, db *sql.DB, schema SchemaConfig, columns []wideColumn) error {
+	add := make([]string, len(columns))
+	for i, column := range columns {
+		add[i] = fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", pq.QuoteIdentifier(column.key), column.sqlType)
+	}
+	query := fmt.Sprintf("ALTER TABLE %s %s", schema.quotedTable(), strings.Join(add, ", "))
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// insertWideBatches runs the multi-row inserts of the wide rows in one
+// transaction, which is rolled back when any of them fails
+func insertWideBatches(ctx context.Context, db *sql.DB, schema SchemaConfig, wide []wideRow, columns []wideColumn, batchSize int) error {
+	if len(wide) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// a statement takes at most maxQueryParams parameters
+	if max := maxQueryParams / (len(columns) + 2); batchSize > max {
+		batchSize = max
+	}
+	for start := 0; start < len(wide); start += batchSize {
+		end := start + batchSize
+		if end > len(wide) {
+			end = len(wide)
+		}
+		query, args := insertWideQuery(schema, columns, wide[start:end])
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return commit(ctx, tx)
+}
+
+// insertWideQuery returns the statement inserting the wide rows and its
+// arguments, NULL filling the columns of the keys a row has no value for
+func insertWideQuery(schema SchemaConfig, columns []wideColumn, wide []wideRow) (string, []interface{}) {
+	names := []string{"id", "time_posted", "tags"}
+	for _, column := range columns {
+		names = append(names, pq.QuoteIdentifier(column.key))
+	}
+	values := make([]string, len(wide))
+	args := make([]interface{}, 0, len(wide)*(len(columns)+2))
+	for i, r := range wide {
+		args = append(args, r.timePosted, r.tags)
+		for _, column := range columns {
+			args = append(args, r.values[column.key])
+		}
+		params := make([]string, len(columns)+2)
+		for j := range params {
+			params[j] = fmt.Sprintf("$%d", len(args)-len(params)+j+1)
+		}
+		values[i] = "(DEFAULT, " + strings.Join(params, ", ") + ")"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", schema.quotedTable(), strings.Join(names, ", "), strings.Join(values, ", "))
+	return query, args
+}
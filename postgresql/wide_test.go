@@ -0,0 +1,134 @@
+// +build small
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2015 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPivotRows(t *testing.T) {
+	Convey("TestPivotRows", t, func() {
+		rows := []row{
+			{timePosted: "2017-01-01T10:11:12Z", key: "cpu", value: "1", data: 1, tags: "{}"},
+			{timePosted: "2017-01-01T10:11:12Z", key: "load", value: "0.5", data: 0.5, tags: "{}"},
+			{timePosted: "2017-01-01T10:11:12Z", key: "cpu", value: "2", data: 2, tags: `{"host":"a"}`},
+			{timePosted: "2017-01-01T10:11:13Z", key: "state", value: "up", data: "up", tags: "{}"},
+		}
+		wide, columns, err := pivotRows(rows)
+		So(err, ShouldBeNil)
+		So(columns, ShouldResemble, []wideColumn{{"cpu", "BIGINT"}, {"load", "DOUBLE PRECISION"}, {"state", "TEXT"}})
+		So(len(wide), ShouldEqual, 3)
+		So(wide[0].values, ShouldResemble, map[string]interface{}{"cpu": int64(1), "load": 0.5})
+		So(wide[1].tags, ShouldEqual, `{"host":"a"}`)
+		So(wide[2].values, ShouldResemble, map[string]interface{}{"state": "up"})
+
+		Convey("Integer and float values of a key get a float column", func() {
+			rows = append(rows, row{timePosted: "2017-01-01T10:11:14Z", key: "cpu", value: "1.5", data: 1.5, tags: "{}"})
+			_, columns, err := pivotRows(rows)
+			So(err, ShouldBeNil)
+			So(columns[0], ShouldResemble, wideColumn{"cpu", "DOUBLE PRECISION"})
+		})
+
+		Convey("Values of other types of a key return an error", func() {
+			rows = append(rows, row{timePosted: "2017-01-01T10:11:14Z", key: "cpu", value: "true", data: true, tags: "{}"})
+			_, _, err := pivotRows(rows)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "cpu")
+		})
+	})
+}
+
+func TestInsertWideRows(t *testing.T) {
+	Convey("TestInsertWideRows", t, func() {
+		schema := SchemaConfig{TableName: "info", Layout: schemaWide}
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		rows := []row{
+			{timePosted: "2017-01-01T10:11:12Z", key: "cpu", value: "1", data: 1, tags: "{}"},
+			{timePosted: "2017-01-01T10:11:12Z", key: "load", value: "0.5", data: 0.5, tags: "{}"},
+			{timePosted: "2017-01-01T10:11:13Z", key: "cpu", value: "2", data: 2, tags: "{}"},
+		}
+		insert := "^INSERT INTO \"info\" \\(id, time_posted, tags, \"cpu\", \"load\"\\) VALUES \\(DEFAULT, \\$1, \\$2, \\$3, \\$4\\), \\(DEFAULT, \\$5, \\$6, \\$7, \\$8\\)$"
+		args := []driver.Value{"2017-01-01T10:11:12Z", "{}", int64(1), 0.5, "2017-01-01T10:11:13Z", "{}", int64(2), nil}
+
+		Convey("Metrics of one time and tags share a row", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(insert).WithArgs(args...).WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, defaultBatchSize), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Missing columns are added and the insert retried", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(insert).WillReturnError(&pq.Error{Code: "42703", Message: "column \"load\" does not exist"})
+			mock.ExpectRollback()
+			mock.ExpectExec("^ALTER TABLE \"info\" ADD COLUMN IF NOT EXISTS \"cpu\" BIGINT, ADD COLUMN IF NOT EXISTS \"load\" DOUBLE PRECISION$").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectBegin()
+			mock.ExpectExec(insert).WithArgs(args...).WillReturnResult(sqlmock.NewResult(2, 2))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, defaultBatchSize), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Batches are split by rows", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("^INSERT INTO \"info\" (.+) VALUES \\(DEFAULT, \\$1, \\$2, \\$3, \\$4\\)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO \"info\" (.+) VALUES \\(DEFAULT, \\$1, \\$2, \\$3, \\$4\\)$").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			So(insertRows(context.Background(), db, schema, rows, 1), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Keys named like a base column return an error", func() {
+			rows[0].key = "tags"
+			err := insertRows(context.Background(), db, schema, rows, defaultBatchSize)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "reserved")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Values not fitting the type of their column return an error", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(insert).WillReturnError(&pq.Error{Code: "22P02", Message: "invalid input syntax for type boolean"})
+			mock.ExpectRollback()
+			mock.ExpectQuery("^SELECT attname, format_type\\(atttypid, atttypmod\\) FROM pg_attribute (.+)$").WithArgs(`"info"`).
+				WillReturnRows(sqlmock.NewRows([]string{"attname", "format_type"}).AddRow("id", "integer").AddRow("cpu", "boolean").AddRow("load", "double precision"))
+			err := insertRows(context.Background(), db, schema, rows, defaultBatchSize)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Namespace cpu has BIGINT values, but its column of the wide schema is BOOLEAN")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("The table has no key_column", func() {
+			So(tableColumns(schema), ShouldEqual, "(id SERIAL, time_posted timestamp with time zone, tags jsonb, PRIMARY KEY (id))")
+		})
+	})
+}